@@ -32,6 +32,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"unsafe"
@@ -67,6 +68,7 @@ func main() {
 	var sshPublicKey []byte
 	var sshPrivateKey []byte
 	var pgpSecretKey []byte
+	var pgpSecretKeys [][]byte
 	var u2fPublicKey []byte
 	var u2fPrivateKey []byte
 
@@ -126,6 +128,28 @@ func main() {
 		}
 	}
 
+	if pgpSecretKeysPaths := os.Getenv("PGP_SECRET_KEYS"); pgpSecretKeysPaths != "" {
+		if len(pgpSecretKey) == 0 {
+			log.Fatal("PGP_SECRET_KEY is required with PGP_SECRET_KEYS")
+		}
+
+		for _, path := range filepath.SplitList(pgpSecretKeysPaths) {
+			var key []byte
+
+			if SNVS {
+				key, err = encrypt(path, icc.DiversifierPGP)
+			} else {
+				key, err = os.ReadFile(path)
+			}
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			pgpSecretKeys = append(pgpSecretKeys, key)
+		}
+	}
+
 	if u2fPublicKeyPath := os.Getenv("U2F_PUBLIC_KEY"); u2fPublicKeyPath != "" {
 		u2fPublicKey, err = os.ReadFile(u2fPublicKeyPath)
 
@@ -176,12 +200,22 @@ func init() {
 		fmt.Fprintf(out, "\tsshPrivateKey = []byte(%s)\n", strconv.Quote(string(sshPrivateKey)))
 	}
 
-	if len(pgpSecretKey) > 0 {
+	if len(pgpSecretKey) > 0 || os.Getenv("PGP_CARD") != "" {
+		fmt.Fprint(out, "\tpgpCard = true\n")
 		fmt.Fprintf(out, "\tpgpSecretKey = []byte(%s)\n", strconv.Quote(string(pgpSecretKey)))
+
+		for _, key := range pgpSecretKeys {
+			fmt.Fprintf(out, "\tpgpSecretKeys = append(pgpSecretKeys, []byte(%s))\n", strconv.Quote(string(key)))
+		}
+
 		fmt.Fprintf(out, "\tURL = %s\n", strconv.Quote(os.Getenv("URL")))
 		fmt.Fprintf(out, "\tNAME = %s\n", strconv.Quote(os.Getenv("NAME")))
 		fmt.Fprintf(out, "\tLANGUAGE = %s\n", strconv.Quote(os.Getenv("LANGUAGE")))
 		fmt.Fprintf(out, "\tSEX = %s\n", strconv.Quote(os.Getenv("SEX")))
+
+		if os.Getenv("RAW_PKCS1") != "" {
+			fmt.Fprint(out, "\tRAW_PKCS1 = true\n")
+		}
 	}
 
 	if len(u2fPublicKey) > 0 {
@@ -6,8 +6,10 @@ tool github.com/usbarmory/tamago/cmd/tamago
 
 require (
 	filippo.io/age v1.3.1
+	filippo.io/bigmod v0.1.1-0.20260103110540-f8a47775ebe5
 	filippo.io/keygen v0.0.0-20260114151900-8e2790ea4c5b
 	github.com/ProtonMail/go-crypto v1.3.0
+	github.com/cloudflare/circl v1.6.0
 	github.com/google/go-p11-kit v0.4.0
 	github.com/gsora/fidati v0.0.0-20230806170658-ab651720d7c3
 	github.com/hsanjuan/go-nfctype4 v0.0.2
@@ -15,18 +17,16 @@ require (
 	github.com/usbarmory/imx-usbnet v0.0.0-20250916125502-9c92e5468e13
 	github.com/usbarmory/tamago v1.26.2
 	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
 )
 
 require (
-	filippo.io/bigmod v0.1.1-0.20260103110540-f8a47775ebe5 // indirect
 	filippo.io/hpke v0.4.0 // indirect
 	github.com/albenik/go-serial/v2 v2.6.1 // indirect
-	github.com/cloudflare/circl v1.6.0 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/google/btree v1.1.2 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
-	golang.org/x/sys v0.41.0 // indirect
 	golang.org/x/term v0.40.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	gvisor.dev/gvisor v0.0.0-20240909175600-91fb8ad18db5 // indirect
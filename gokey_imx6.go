@@ -16,8 +16,14 @@ import (
 	"runtime"
 
 	"github.com/usbarmory/GoKey/internal/age"
+	"github.com/usbarmory/GoKey/internal/applet"
 	"github.com/usbarmory/GoKey/internal/ccid"
+	"github.com/usbarmory/GoKey/internal/fido2"
 	"github.com/usbarmory/GoKey/internal/icc"
+	"github.com/usbarmory/GoKey/internal/oath"
+	"github.com/usbarmory/GoKey/internal/piv"
+	"github.com/usbarmory/GoKey/internal/snvs"
+	"github.com/usbarmory/GoKey/internal/storage"
 	"github.com/usbarmory/GoKey/internal/u2f"
 	"github.com/usbarmory/GoKey/internal/usb"
 
@@ -39,37 +45,124 @@ func init() {
 	imx6ul.SetARMFreq(imx6ul.FreqMax)
 }
 
-func initCard(device *imxusb.Device, card *icc.Interface) {
+func initCard(device *imxusb.Device, card *icc.Interface, pivApplet *piv.Applet, oathApplet *oath.Applet, store storage.Storage) {
 	// Initialize an OpenPGP card with the bundled key information (defined
 	// in `keys.go` and generated at compilation time).
 	card.SNVS = SNVS
 	card.ArmoredKey = pgpSecretKey
+	card.ArmoredKeys = pgpSecretKeys
 	card.Name = NAME
 	card.Language = LANGUAGE
 	card.Sex = SEX
 	card.URL = URL
+	card.RawPKCS1 = RAW_PKCS1
 	card.Debug = false
 
+	// device key for key attestation, only available on secure booted
+	// units
+	if SNVS {
+		if key, err := snvs.DeviceKey(); err != nil {
+			log.Printf("OpenPGP attestation key error: %v", err)
+		} else {
+			card.AttestationKey = key
+		}
+	}
+
+	// persistent storage for card personalization
+	if store != nil {
+		card.Storage = store
+		card.Counter = counter()
+	}
+
+	// PIV applet, with slots backed by the OpenPGP card keys
+	pivApplet.Serial = card.Serial
+	pivApplet.SNVS = SNVS
+	pivApplet.Storage = card.Storage
+	pivApplet.Card = card
+
+	// OATH applet
+	oathApplet.SNVS = SNVS
+	oathApplet.Storage = card.Storage
+
 	if initAtBoot {
 		if err := card.Init(); err != nil {
 			log.Printf("OpenPGP ICC initialization error: %v", err)
 		}
+
+		if err := pivApplet.Init(); err != nil {
+			log.Printf("PIV initialization error: %v", err)
+		}
+
+		if err := oathApplet.Init(); err != nil {
+			log.Printf("OATH initialization error: %v", err)
+		}
 	}
 
-	// initialize CCID interface
+	// initialize CCID interface, with the OpenPGP card as default applet
 	reader := &ccid.Interface{
 		ICC: card,
+		Applets: &applet.Dispatcher{
+			Applets: []applet.Applet{card, pivApplet, oathApplet},
+		},
 	}
 
 	// configure Smart Card over USB endpoints (CCID protocol)
 	usb.ConfigureCCID(device, reader)
 }
 
-func initToken(device *imxusb.Device, token *u2f.Token) {
+// initStorage returns the persistent storage for card personalization and
+// FIDO2 credentials, placed at the end of the internal eMMC.
+func initStorage() storage.Storage {
+	mmc := &storage.MMC{
+		Card: usbarmory.MMC,
+	}
+
+	// storage area authentication, only available on secure booted units
+	if SNVS {
+		key, err := snvs.Key([]byte(storage.DiversifierStorage))
+
+		if err != nil {
+			log.Printf("storage key error: %v", err)
+			return nil
+		}
+
+		mmc.Key = key
+	}
+
+	if err := mmc.Init(); err != nil {
+		log.Printf("storage initialization error: %v", err)
+		return nil
+	}
+
+	return mmc
+}
+
+// counter returns the monotonic counter used for rollback detection of
+// persistent card counters, only the ATECC608A is supported as any counter
+// kept on the eMMC could be rolled back together with the storage area.
+func counter() storage.Counter {
+	if model, _ := usbarmory.Model(); model == usbarmory.BETA {
+		return &storage.ATECC{
+			KeyID: 0x00,
+		}
+	}
+
+	log.Printf("OpenPGP counters rollback protection not available")
+
+	return nil
+}
+
+func initToken(device *imxusb.Device, token *u2f.Token, store storage.Storage) {
 	token.SNVS = SNVS
 	token.PublicKey = u2fPublicKey
 	token.PrivateKey = u2fPrivateKey
 
+	// FIDO2 authenticator, on the U2F token HID interface
+	token.FIDO2 = &fido2.Authenticator{
+		SNVS:    SNVS,
+		Storage: store,
+	}
+
 	if err := u2f.Configure(device, token); err != nil {
 		log.Printf("U2F configuration error: %v", err)
 	}
@@ -84,6 +177,8 @@ func initToken(device *imxusb.Device, token *u2f.Token) {
 func main() {
 	device := &imxusb.Device{}
 	card := &icc.Interface{}
+	pivApplet := &piv.Applet{}
+	oathApplet := &oath.Applet{}
 	token := &u2f.Token{}
 
 	log.SetFlags(0)
@@ -99,16 +194,24 @@ func main() {
 		log.Fatalf("SNVS not available")
 	}
 
-	if len(pgpSecretKey) != 0 {
-		initCard(device, card)
+	u2fToken := len(u2fPublicKey) != 0 && len(u2fPrivateKey) != 0
+
+	var store storage.Storage
+
+	if pgpCard || u2fToken {
+		store = initStorage()
+	}
+
+	if pgpCard {
+		initCard(device, card, pivApplet, oathApplet, store)
 	}
 
-	if len(u2fPublicKey) != 0 && len(u2fPrivateKey) != 0 {
-		initToken(device, token)
+	if u2fToken {
+		initToken(device, token, store)
 	}
 
 	if len(sshPublicKey) != 0 {
-		configureNetworking(device, card, token)
+		configureNetworking(device, card, pivApplet, oathApplet, token)
 	}
 
 	// The plug is checked, rather than the receptacle, as a workaround for:
@@ -127,7 +230,7 @@ func main() {
 	usb.StartInterruptHandler(port)
 }
 
-func configureNetworking(device *imxusb.Device, card *icc.Interface, token *u2f.Token) {
+func configureNetworking(device *imxusb.Device, card *icc.Interface, pivApplet *piv.Applet, oathApplet *oath.Applet, token *u2f.Token) {
 	gonet := usbnet.Interface{}
 
 	if err := gonet.Add(device, deviceIP, deviceMAC, hostMAC); err != nil {
@@ -145,10 +248,18 @@ func configureNetworking(device *imxusb.Device, card *icc.Interface, token *u2f.
 	banner := fmt.Sprintf("GoKey • %s/%s (%s)",
 		runtime.GOOS, runtime.GOARCH, runtime.Version())
 
+	// user presence for OpenPGP keys with User Interaction Flag enabled,
+	// shared with PIV keys and OATH credentials requiring touch
+	card.Presence = make(chan bool)
+	pivApplet.Presence = card.Presence
+	oathApplet.Presence = card.Presence
+
 	console := &usb.Console{
 		AuthorizedKey: sshPublicKey,
 		PrivateKey:    sshPrivateKey,
 		Card:          card,
+		PIV:           pivApplet,
+		OATH:          oathApplet,
 		Token:         token,
 		Started:       make(chan bool),
 		Listener:      listener,
@@ -20,10 +20,20 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/usbarmory/GoKey/internal/applet"
 	"github.com/usbarmory/GoKey/internal/icc"
+	"github.com/usbarmory/GoKey/internal/oath"
+	"github.com/usbarmory/GoKey/internal/piv"
+	"github.com/usbarmory/GoKey/internal/storage"
 )
 
-var server string
+var (
+	server   string
+	storeDir string
+	adminPIN string
+	rawPKCS1 bool
+	identity int
+)
 
 // http://frankmorgner.github.io/vsmartcard/virtualsmartcard/api.html
 const (
@@ -41,6 +51,10 @@ func init() {
 	log.SetOutput(os.Stdout)
 
 	flag.StringVar(&server, "c", "127.0.0.1:35963", "vpcd address:port pair")
+	flag.StringVar(&storeDir, "s", "", "persistent storage directory")
+	flag.StringVar(&adminPIN, "a", "", "set admin PIN (PW3), requires -s")
+	flag.BoolVar(&rawPKCS1, "r", false, "enable raw PKCS#1 mode for PSO:CDS")
+	flag.IntVar(&identity, "i", -1, "select OpenPGP identity")
 }
 
 func main() {
@@ -49,24 +63,72 @@ func main() {
 	// Initialize an OpenPGP card with the bundled key information (defined
 	// in `keys.go` and generated at compilation time).
 	card := &icc.Interface{
-		Serial:     dummyUID,
-		SNVS:       SNVS,
-		ArmoredKey: pgpSecretKey,
-		Name:       NAME,
-		Language:   LANGUAGE,
-		Sex:        SEX,
-		URL:        URL,
-		Debug:      true,
+		Serial:      dummyUID,
+		SNVS:        SNVS,
+		ArmoredKey:  pgpSecretKey,
+		ArmoredKeys: pgpSecretKeys,
+		Name:        NAME,
+		Language:    LANGUAGE,
+		Sex:         SEX,
+		URL:         URL,
+		RawPKCS1:    rawPKCS1 || RAW_PKCS1,
+		Debug:       true,
+	}
+
+	if storeDir != "" {
+		card.Storage = &storage.File{Path: storeDir}
+		card.Counter = &storage.FileCounter{Path: filepath.Join(storeDir, ".counter")}
 	}
 
 	if err := card.Init(); err != nil {
 		log.Printf("initialization error: %v", err)
 	}
 
+	if adminPIN != "" {
+		if err := card.SetAdminPIN([]byte(adminPIN)); err != nil {
+			log.Fatalf("admin PIN error: %v", err)
+		}
+	}
+
+	if identity >= 0 {
+		if err := card.SelectIdentity(identity); err != nil {
+			log.Fatalf("identity error: %v", err)
+		}
+	}
+
 	go serveRPC(card)
 
+	// PIV applet, with slots backed by the OpenPGP card keys
+	pivApplet := &piv.Applet{
+		Serial:  dummyUID,
+		SNVS:    SNVS,
+		Storage: card.Storage,
+		Card:    card,
+		Debug:   true,
+	}
+
+	if err := pivApplet.Init(); err != nil {
+		log.Printf("PIV initialization error: %v", err)
+	}
+
+	// OATH applet
+	oathApplet := &oath.Applet{
+		SNVS:    SNVS,
+		Storage: card.Storage,
+		Debug:   true,
+	}
+
+	if err := oathApplet.Init(); err != nil {
+		log.Printf("OATH initialization error: %v", err)
+	}
+
+	// OpenPGP card as default applet
+	applets := &applet.Dispatcher{
+		Applets: []applet.Applet{card, pivApplet, oathApplet},
+	}
+
 	// never returns
-	dialVPCD(card)
+	dialVPCD(card, applets)
 }
 
 func serveRPC(card *icc.Interface) {
@@ -105,7 +167,7 @@ func serveRPC(card *icc.Interface) {
 	}
 }
 
-func dialVPCD(card *icc.Interface) {
+func dialVPCD(card *icc.Interface, applets *applet.Dispatcher) {
 	for {
 		conn, err := net.Dial("tcp", server)
 
@@ -115,11 +177,11 @@ func dialVPCD(card *icc.Interface) {
 			continue
 		}
 
-		handleVPCDConnection(conn, card)
+		handleVPCDConnection(conn, card, applets)
 	}
 }
 
-func handleVPCDConnection(conn net.Conn, card *icc.Interface) {
+func handleVPCDConnection(conn net.Conn, card *icc.Interface, applets *applet.Dispatcher) {
 	defer conn.Close()
 
 	for {
@@ -130,7 +192,7 @@ func handleVPCDConnection(conn net.Conn, card *icc.Interface) {
 			return
 		}
 
-		res, err := handleVPCDRequest(conn, length, card)
+		res, err := handleVPCDRequest(conn, length, card, applets)
 
 		if err != nil {
 			log.Fatalf("cannot handle request, %v", err)
@@ -143,7 +205,7 @@ func handleVPCDConnection(conn net.Conn, card *icc.Interface) {
 	}
 }
 
-func handleVPCDRequest(conn net.Conn, length []byte, card *icc.Interface) (res []byte, err error) {
+func handleVPCDRequest(conn net.Conn, length []byte, card *icc.Interface, applets *applet.Dispatcher) (res []byte, err error) {
 	if len(length) < 2 {
 		err = fmt.Errorf("request too short (%d)", len(length))
 		return
@@ -166,13 +228,14 @@ func handleVPCDRequest(conn net.Conn, length []byte, card *icc.Interface) (res [
 	if n == 1 {
 		switch req[0] {
 		case POWER_OFF, POWER_ON, RESET:
+			applets.Reset()
 			// no response
 			return
 		case GET_ATR:
 			res = card.ATR()
 		}
 	} else {
-		if res, err = card.RawCommand(req[0:]); err != nil {
+		if res, err = applets.RawCommand(req[0:]); err != nil {
 			return
 		}
 	}
@@ -0,0 +1,126 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package applet
+
+import (
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// ISO/IEC 7816-4, 5.1.3 Status bytes, shared across applets.
+
+func CommandNotAllowed() *apdu.RAPDU {
+	return apdu.NewRAPDU(apdu.RAPDUCommandNotAllowed)
+}
+
+func FileNotFound() *apdu.RAPDU {
+	return apdu.NewRAPDU(apdu.RAPDUFileNotFound)
+}
+
+func BytesAvailable(data []byte, n int) *apdu.RAPDU {
+	if n > 0xff {
+		n = 0x00
+	}
+
+	return &apdu.RAPDU{
+		SW1:          0x61,
+		SW2:          byte(n),
+		ResponseBody: data,
+	}
+}
+
+func MemoryFailure() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x65,
+		SW2: 0x81,
+	}
+}
+
+func WrongLength() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x67,
+		SW2: 0x00,
+	}
+}
+
+func LogicalChannelNotSupported() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x68,
+		SW2: 0x81,
+	}
+}
+
+func LastCommandExpected() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x68,
+		SW2: 0x83,
+	}
+}
+
+func SecurityConditionNotSatisfied() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x82,
+	}
+}
+
+func AuthenticationMethodBlocked() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x83,
+	}
+}
+
+func ConditionsNotSatisfied() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x85,
+	}
+}
+
+func WrongData() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6a,
+		SW2: 0x80,
+	}
+}
+
+func IncorrectParameters() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6a,
+		SW2: 0x86,
+	}
+}
+
+func ReferencedDataNotFound() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6a,
+		SW2: 0x88,
+	}
+}
+
+func InstructionNotSupported() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6d,
+		SW2: 0x00,
+	}
+}
+
+func ClassNotSupported() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6e,
+		SW2: 0x00,
+	}
+}
+
+func CommandCompleted(data []byte) *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1:          0x90,
+		SW2:          0x00,
+		ResponseBody: data,
+	}
+}
@@ -0,0 +1,153 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package applet
+
+import (
+	"bytes"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// ISO/IEC 7816-4, 5.4.1 Class byte
+	CLA_CHAINING = 0x10
+
+	// ISO/IEC 7816-4, 11.5.6 GET RESPONSE command
+	GET_RESPONSE = 0xc0
+
+	// maximum length of chained command data
+	MAX_CHAIN_LENGTH = 0x0bfe
+
+	// maximum response length for short Le fields
+	SHORT_LE = 256
+)
+
+// Chaining implements command chaining and response splitting (GET RESPONSE)
+// for applets, according to ISO/IEC 7816-4.
+type Chaining struct {
+	header   []byte
+	data     bytes.Buffer
+	chaining bool
+	response []byte
+}
+
+// Reset discards any pending command chain or response.
+func (c *Chaining) Reset() {
+	c.chaining = false
+	c.header = nil
+	c.data.Reset()
+	c.response = nil
+}
+
+// Command accumulates chained command APDUs (CLA with chaining bit),
+// acknowledging intermediate ones, the last command of the chain is returned
+// with the complete data field for processing. A nil CAPDU is returned, with
+// the relevant response, when no further processing is required.
+func (c *Chaining) Command(capdu *apdu.CAPDU) (*apdu.CAPDU, *apdu.RAPDU) {
+	header := []byte{capdu.CLA &^ CLA_CHAINING, capdu.INS, capdu.P1, capdu.P2}
+
+	if c.chaining && !bytes.Equal(c.header, header) {
+		c.Reset()
+		return nil, LastCommandExpected()
+	}
+
+	if capdu.CLA&CLA_CHAINING == 0 {
+		if !c.chaining {
+			return capdu, nil
+		}
+
+		defer c.Reset()
+
+		if c.data.Len()+len(capdu.Data) > MAX_CHAIN_LENGTH {
+			return nil, WrongLength()
+		}
+
+		c.data.Write(capdu.Data)
+
+		return &apdu.CAPDU{
+			CLA:  capdu.CLA,
+			INS:  capdu.INS,
+			P1:   capdu.P1,
+			P2:   capdu.P2,
+			Data: bytes.Clone(c.data.Bytes()),
+			Le:   capdu.Le,
+		}, nil
+	}
+
+	if capdu.INS == GET_RESPONSE {
+		return nil, CommandNotAllowed()
+	}
+
+	if !c.chaining {
+		c.chaining = true
+		c.header = header
+	}
+
+	if c.data.Len()+len(capdu.Data) > MAX_CHAIN_LENGTH {
+		c.Reset()
+		return nil, WrongLength()
+	}
+
+	c.data.Write(capdu.Data)
+
+	return nil, CommandCompleted(nil)
+}
+
+// Response limits the response data to the expected length (Le), retaining
+// any remaining bytes for subsequent GET RESPONSE commands.
+func (c *Chaining) Response(capdu *apdu.CAPDU, rapdu *apdu.RAPDU) *apdu.RAPDU {
+	c.response = nil
+
+	if rapdu.SW1 != 0x90 || rapdu.SW2 != 0x00 {
+		return rapdu
+	}
+
+	le := int(capdu.GetLe())
+
+	switch {
+	case len(capdu.Le) == 0:
+		le = SHORT_LE
+	case le == 0:
+		// extended Le field set to 0x0000 (65536)
+		return rapdu
+	}
+
+	if len(rapdu.ResponseBody) <= le {
+		return rapdu
+	}
+
+	c.response = rapdu.ResponseBody[le:]
+
+	return BytesAvailable(rapdu.ResponseBody[:le], len(c.response))
+}
+
+// GetResponse implements
+// ISO/IEC 7816-4, 11.5.6 GET RESPONSE command.
+func (c *Chaining) GetResponse(P1 byte, P2 byte, le int) *apdu.RAPDU {
+	if P1 != 0x00 || P2 != 0x00 {
+		return IncorrectParameters()
+	}
+
+	if len(c.response) == 0 {
+		return CommandNotAllowed()
+	}
+
+	if le == 0 || le > len(c.response) {
+		le = len(c.response)
+	}
+
+	data := c.response[:le]
+	c.response = c.response[le:]
+
+	if len(c.response) == 0 {
+		c.response = nil
+		return CommandCompleted(data)
+	}
+
+	return BytesAvailable(data, len(c.response))
+}
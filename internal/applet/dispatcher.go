@@ -0,0 +1,263 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package applet implements routing of smartcard commands to card applications
+// (applets) selected by AID, with logical channel support, according to
+// ISO/IEC 7816-4.
+package applet
+
+import (
+	"bytes"
+	"log"
+	"sync"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// ISO/IEC 7816-4, 11.1.1 SELECT command
+	SELECT = 0xa4
+	// ISO/IEC 7816-4, 11.1.2 MANAGE CHANNEL command
+	MANAGE_CHANNEL = 0x70
+
+	// SELECT by DF name (AID)
+	SELECT_DF_NAME = 0x04
+
+	MANAGE_CHANNEL_OPEN  = 0x00
+	MANAGE_CHANNEL_CLOSE = 0x80
+
+	// proprietary class
+	CLA_PROPRIETARY = 0x80
+	// further interindustry class (logical channels 4 to 19)
+	CLA_FURTHER = 0x40
+	// logical channel number of first interindustry class
+	CLA_CHANNEL = 0x03
+	// invalid class
+	CLA_INVALID = 0xff
+
+	// ISO/IEC 7816-5, minimum AID length (RID only)
+	MIN_AID_LENGTH = 5
+
+	// logical channels supported with first interindustry class
+	MAX_CHANNELS = 4
+)
+
+// Applet represents a card application selectable by AID.
+type Applet interface {
+	// AID returns the application identifier.
+	AID() []byte
+	// Command handles command APDUs addressed to the applet, including
+	// the SELECT by DF name matching its AID. Logical channel bits are
+	// cleared from the class byte.
+	Command(capdu *apdu.CAPDU) (*apdu.RAPDU, error)
+	// Deselect is invoked when the applet is no longer selected on any
+	// logical channel.
+	Deselect()
+}
+
+// Dispatcher routes command APDUs to the applet selected on each logical
+// channel.
+//
+// Applets are shared across logical channels, an applet selected on more than
+// one channel therefore shares its state (e.g. PIN verification status)
+// among them.
+type Dispatcher struct {
+	sync.Mutex
+
+	// Applets available for selection, the first one is implicitly
+	// selected on the basic logical channel after reset.
+	Applets []Applet
+
+	// applet selected on each logical channel
+	channels [MAX_CHANNELS]Applet
+	// open logical channels, the basic one is always open
+	open [MAX_CHANNELS]bool
+
+	initialized bool
+}
+
+// Reset closes all logical channels and deselects all applets, the default
+// applet is implicitly selected on the basic logical channel.
+func (d *Dispatcher) Reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.reset()
+}
+
+func (d *Dispatcher) reset() {
+	for n := range d.channels {
+		d.set(n, nil)
+		d.open[n] = false
+	}
+
+	d.open[0] = true
+
+	if len(d.Applets) > 0 {
+		d.channels[0] = d.Applets[0]
+	}
+
+	d.initialized = true
+}
+
+// set selects an applet on a logical channel, the previously selected applet
+// is deselected unless still selected on other channels.
+func (d *Dispatcher) set(n int, applet Applet) {
+	prev := d.channels[n]
+	d.channels[n] = applet
+
+	if prev == nil || prev == applet {
+		return
+	}
+
+	for _, a := range d.channels {
+		if a == prev {
+			return
+		}
+	}
+
+	prev.Deselect()
+}
+
+// RawCommand parses a buffer representing an APDU command and redirects it to
+// the relevant applet. A buffer representing the APDU response is returned.
+func (d *Dispatcher) RawCommand(buf []byte) ([]byte, error) {
+	capdu := &apdu.CAPDU{}
+	_, err := capdu.Unmarshal(buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rapdu, err := d.Command(capdu)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rapdu.Marshal()
+}
+
+// Command handles logical channel management and applet selection, any other
+// APDU command is redirected to the applet selected on its logical channel.
+func (d *Dispatcher) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.initialized {
+		d.reset()
+	}
+
+	if capdu.CLA == CLA_INVALID {
+		return ClassNotSupported(), nil
+	}
+
+	if capdu.CLA&(CLA_PROPRIETARY|CLA_FURTHER) == CLA_FURTHER {
+		return LogicalChannelNotSupported(), nil
+	}
+
+	n := int(capdu.CLA & CLA_CHANNEL)
+
+	if !d.open[n] {
+		return LogicalChannelNotSupported(), nil
+	}
+
+	capdu.CLA &^= CLA_CHANNEL
+
+	if capdu.CLA&CLA_PROPRIETARY == 0 {
+		switch {
+		case capdu.INS == MANAGE_CHANNEL:
+			return d.manageChannel(n, capdu.P1, capdu.P2), nil
+		case capdu.INS == SELECT && capdu.P1 == SELECT_DF_NAME:
+			return d.selectApplet(n, capdu)
+		}
+	}
+
+	if d.channels[n] == nil {
+		return CommandNotAllowed(), nil
+	}
+
+	return d.channels[n].Command(capdu)
+}
+
+// selectApplet implements SELECT by DF name, the applet is matched by its
+// AID, or its initial portion, passed in the command data.
+func (d *Dispatcher) selectApplet(n int, capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error) {
+	for _, a := range d.Applets {
+		if len(capdu.Data) < MIN_AID_LENGTH || !bytes.HasPrefix(a.AID(), capdu.Data) {
+			continue
+		}
+
+		if rapdu, err = a.Command(capdu); err != nil {
+			return
+		}
+
+		if rapdu.SW1 == 0x6a && rapdu.SW2 == 0x82 {
+			continue
+		}
+
+		d.set(n, a)
+
+		return
+	}
+
+	log.Printf("application % X not found", capdu.Data)
+	d.set(n, nil)
+
+	return FileNotFound(), nil
+}
+
+// manageChannel implements
+// ISO/IEC 7816-4, 11.1.2 MANAGE CHANNEL command.
+func (d *Dispatcher) manageChannel(n int, p1 byte, p2 byte) *apdu.RAPDU {
+	m := int(p2)
+
+	switch p1 {
+	case MANAGE_CHANNEL_OPEN:
+		if m == 0 {
+			for m = 1; m < MAX_CHANNELS && d.open[m]; m++ {
+			}
+		}
+
+		if m >= MAX_CHANNELS {
+			return LogicalChannelNotSupported()
+		}
+
+		if d.open[m] {
+			return IncorrectParameters()
+		}
+
+		d.open[m] = true
+
+		// the new channel inherits the applet selected on the channel
+		// it was opened from, or the default one from the basic channel
+		if n == 0 && len(d.Applets) > 0 {
+			d.channels[m] = d.Applets[0]
+		} else {
+			d.channels[m] = d.channels[n]
+		}
+
+		if p2 == 0 {
+			return CommandCompleted([]byte{byte(m)})
+		}
+	case MANAGE_CHANNEL_CLOSE:
+		if m == 0 {
+			m = n
+		}
+
+		if m == 0 || m >= MAX_CHANNELS || !d.open[m] {
+			return IncorrectParameters()
+		}
+
+		d.set(m, nil)
+		d.open[m] = false
+	default:
+		return IncorrectParameters()
+	}
+
+	return CommandCompleted(nil)
+}
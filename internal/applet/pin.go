@@ -0,0 +1,61 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package applet
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+const (
+	// PIN verifier parameters
+	pinSaltSize   = 16
+	pinIterations = 4096
+	pinHashSize   = 32
+)
+
+// PINVerifier represents a salted PIN verifier, suitable for persistent
+// storage, the PIN itself is never stored.
+type PINVerifier struct {
+	Salt   []byte
+	Hash   []byte
+	Length int
+}
+
+// NewPINVerifier returns the verifier for a PIN, an empty PIN results in an
+// empty verifier.
+func NewPINVerifier(pin []byte) (v *PINVerifier, err error) {
+	v = &PINVerifier{}
+
+	if len(pin) == 0 {
+		return
+	}
+
+	v.Salt = make([]byte, pinSaltSize)
+
+	if _, err = rand.Read(v.Salt); err != nil {
+		return
+	}
+
+	v.Hash, err = v.hash(pin)
+	v.Length = len(pin)
+
+	return
+}
+
+func (v *PINVerifier) hash(pin []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, string(pin), v.Salt, pinIterations, pinHashSize)
+}
+
+// Verify returns whether a PIN matches the verifier.
+func (v *PINVerifier) Verify(pin []byte) bool {
+	hash, err := v.hash(pin)
+	return err == nil && hmac.Equal(hash, v.Hash)
+}
@@ -0,0 +1,267 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package bertlv implements encoding and decoding of BER-TLV data objects, as
+// used by smartcard applications (ISO/IEC 7816-4 and 8825-1).
+//
+// Tags of up to 4 bytes are supported, along with length fields of up to 4
+// bytes (excluding the indefinite form). Decoding performs strict bounds
+// checking.
+package bertlv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	// maximum size of tag and length fields
+	maxTagSize    = 4
+	maxLengthSize = 4
+
+	constructed  = 0x20
+	multiByteTag = 0x1f
+	moreTagBytes = 0x80
+	longLength   = 0x80
+)
+
+// Tag represents a BER-TLV tag, as its big-endian encoding (e.g. 0x7f49).
+type Tag uint32
+
+// Bytes returns the tag encoding.
+func (t Tag) Bytes() (buf []byte) {
+	for s := 24; s > 0; s -= 8 {
+		if b := byte(t >> s); b != 0 || len(buf) > 0 {
+			buf = append(buf, b)
+		}
+	}
+
+	return append(buf, byte(t))
+}
+
+// Constructed returns whether the tag represents a constructed data object,
+// whose value is a sequence of data objects.
+func (t Tag) Constructed() bool {
+	return t.Bytes()[0]&constructed != 0
+}
+
+// TLV represents a BER-TLV data object, either primitive (with a value) or
+// constructed (with child data objects).
+type TLV struct {
+	Tag      Tag
+	Value    []byte
+	Children []*TLV
+}
+
+// New returns a primitive data object.
+func New(tag Tag, value []byte) *TLV {
+	return &TLV{Tag: tag, Value: value}
+}
+
+// NewConstructed returns a constructed data object.
+func NewConstructed(tag Tag, children ...*TLV) *TLV {
+	return &TLV{Tag: tag, Children: children}
+}
+
+// Bytes returns the data object encoding, the value of constructed objects is
+// the encoding of their children.
+func (t *TLV) Bytes() []byte {
+	if !t.Tag.Constructed() {
+		return Encode(t.Tag, t.Value)
+	}
+
+	var value bytes.Buffer
+
+	for _, child := range t.Children {
+		value.Write(child.Bytes())
+	}
+
+	return Encode(t.Tag, value.Bytes())
+}
+
+// Find returns the first child data object matching a tag.
+func (t *TLV) Find(tag Tag) *TLV {
+	for _, child := range t.Children {
+		if child.Tag == tag {
+			return child
+		}
+	}
+
+	return nil
+}
+
+// Length returns the encoding of a length field, in its shortest form.
+func Length(l int) []byte {
+	if l <= 0x7f {
+		return []byte{byte(l)}
+	}
+
+	var buf []byte
+
+	for ; l > 0; l >>= 8 {
+		buf = append([]byte{byte(l)}, buf...)
+	}
+
+	return append([]byte{longLength | byte(len(buf))}, buf...)
+}
+
+// Encode returns the encoding of a data object with a given tag and value.
+func Encode(tag Tag, value []byte) (buf []byte) {
+	buf = append(buf, tag.Bytes()...)
+	buf = append(buf, Length(len(value))...)
+	buf = append(buf, value...)
+
+	return
+}
+
+// Header parses the tag and length fields of a data object, returning the
+// offset of its value. The value itself is not required to be present (e.g.
+// in data object lists).
+func Header(buf []byte) (tag Tag, l int, off int, err error) {
+	if len(buf) < 1 {
+		return 0, 0, 0, errors.New("invalid TLV, missing tag")
+	}
+
+	tag = Tag(buf[0])
+	off = 1
+
+	if buf[0]&multiByteTag == multiByteTag {
+		for {
+			if off >= len(buf) {
+				return 0, 0, 0, errors.New("invalid TLV, tag too short")
+			}
+
+			if off == maxTagSize {
+				return 0, 0, 0, errors.New("invalid TLV, tag too long")
+			}
+
+			tag = tag<<8 | Tag(buf[off])
+			off += 1
+
+			if buf[off-1]&moreTagBytes == 0 {
+				break
+			}
+		}
+	}
+
+	if off >= len(buf) {
+		return 0, 0, 0, errors.New("invalid TLV, missing length")
+	}
+
+	n := buf[off]
+	off += 1
+
+	if n&longLength == 0 {
+		return tag, int(n), off, nil
+	}
+
+	size := int(n &^ longLength)
+
+	if size == 0 || size > maxLengthSize {
+		return 0, 0, 0, fmt.Errorf("invalid TLV, unsupported length field %x", n)
+	}
+
+	if len(buf) < off+size {
+		return 0, 0, 0, errors.New("invalid TLV, length too short")
+	}
+
+	for _, b := range buf[off : off+size] {
+		l = l<<8 | int(b)
+	}
+
+	off += size
+
+	if l < 0 {
+		return 0, 0, 0, errors.New("invalid TLV, length overflow")
+	}
+
+	return
+}
+
+// Next parses the first data object of a buffer, returning its tag, value and
+// the following bytes.
+func Next(buf []byte) (tag Tag, value []byte, rest []byte, err error) {
+	tag, l, off, err := Header(buf)
+
+	if err != nil {
+		return
+	}
+
+	if len(buf)-off < l {
+		return 0, nil, nil, errors.New("invalid TLV, value too short")
+	}
+
+	return tag, buf[off : off+l], buf[off+l:], nil
+}
+
+// Parse parses a sequence of data objects, constructed data objects are
+// parsed recursively.
+func Parse(buf []byte) (objects []*TLV, err error) {
+	for len(buf) > 0 {
+		var obj *TLV
+
+		if obj, buf, err = parse(buf); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return
+}
+
+func parse(buf []byte) (obj *TLV, rest []byte, err error) {
+	tag, value, rest, err := Next(buf)
+
+	if err != nil {
+		return
+	}
+
+	obj = &TLV{Tag: tag}
+
+	if !tag.Constructed() {
+		obj.Value = value
+		return
+	}
+
+	if obj.Children, err = Parse(value); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// Find returns the value of a nested data object, identified by the tags of
+// each level (e.g. Find(buf, 0xa6, 0x7f49, 0x86)), each level is searched
+// among sibling data objects.
+func Find(buf []byte, path ...Tag) (value []byte, err error) {
+	value = buf
+
+	for _, tag := range path {
+		buf, value = value, nil
+
+		for value == nil {
+			var t Tag
+			var v []byte
+
+			if len(buf) == 0 {
+				return nil, fmt.Errorf("tag %x not found", tag)
+			}
+
+			if t, v, buf, err = Next(buf); err != nil {
+				return nil, err
+			}
+
+			if t == tag {
+				value = v
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,183 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package bertlv
+
+import (
+	"bytes"
+	"testing"
+)
+
+// validTag returns whether a tag encoding is well-formed, subsequent bytes
+// must be present only when the first byte signals a multi-byte tag, and each
+// but the last must signal a further one.
+func validTag(tag Tag) bool {
+	buf := tag.Bytes()
+
+	if len(buf) == 1 {
+		return buf[0]&multiByteTag != multiByteTag
+	}
+
+	if buf[0]&multiByteTag != multiByteTag {
+		return false
+	}
+
+	for i, b := range buf[1:] {
+		if more := b&moreTagBytes != 0; more != (i < len(buf)-2) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encode re-encodes parsed data objects, in their shortest form.
+func encode(objects []*TLV) []byte {
+	var buf bytes.Buffer
+
+	for _, obj := range objects {
+		buf.Write(obj.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(uint32(0x4f), []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01})
+	f.Add(uint32(0x5f2d), []byte("en"))
+	f.Add(uint32(0x7f49), bytes.Repeat([]byte{0x81, 0x01, 0xff}, 100))
+	f.Add(uint32(0x65), []byte{0x5b, 0x00})
+	f.Add(uint32(0x1f8101), make([]byte, 0x10000))
+	f.Add(uint32(0x9f818101), []byte{})
+
+	f.Fuzz(func(t *testing.T, t32 uint32, value []byte) {
+		tag := Tag(t32)
+
+		if !validTag(tag) {
+			t.Skip()
+		}
+
+		buf := Encode(tag, value)
+
+		parsedTag, parsedValue, rest, err := Next(buf)
+
+		if err != nil {
+			t.Fatalf("Next(%x), %v", buf, err)
+		}
+
+		if parsedTag != tag || !bytes.Equal(parsedValue, value) || len(rest) != 0 {
+			t.Fatalf("Next(%x) = %x, %x, %x", buf, parsedTag, parsedValue, rest)
+		}
+
+		objects, err := Parse(buf)
+
+		if tag.Constructed() {
+			// the value must itself be a sequence of data objects
+			if err == nil && (len(objects) != 1 || objects[0].Tag != tag) {
+				t.Fatalf("Parse(%x) mismatch", buf)
+			}
+
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("Parse(%x), %v", buf, err)
+		}
+
+		if len(objects) != 1 || objects[0].Tag != tag || !bytes.Equal(objects[0].Value, value) {
+			t.Fatalf("Parse(%x) mismatch", buf)
+		}
+
+		if !bytes.Equal(objects[0].Bytes(), buf) {
+			t.Fatalf("Parse(%x) does not re-encode", buf)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	// well-formed
+	f.Add([]byte{0x65, 0x07, 0x5b, 0x00, 0x5f, 0x2d, 0x02, 0x65, 0x6e})
+	f.Add([]byte{0x7f, 0x49, 0x81, 0x03, 0x86, 0x01, 0x04})
+	// tag too short
+	f.Add([]byte{0x5f})
+	f.Add([]byte{0x7f, 0x81})
+	// tag too long
+	f.Add([]byte{0x1f, 0x81, 0x81, 0x81, 0x01, 0x00})
+	// missing length
+	f.Add([]byte{0x4f})
+	// indefinite length
+	f.Add([]byte{0x30, 0x80, 0x00, 0x00})
+	// unsupported length field
+	f.Add([]byte{0x04, 0x85, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00})
+	// length too short
+	f.Add([]byte{0x5f, 0x2d, 0x82, 0x01})
+	// length overflow
+	f.Add([]byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff})
+	// value too short
+	f.Add([]byte{0x4f, 0x10, 0xd2, 0x76})
+	// constructed with malformed child
+	f.Add([]byte{0x65, 0x03, 0x5f, 0x2d, 0x05})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if tag, l, off, err := Header(buf); err == nil {
+			if off <= 0 || off > len(buf) || l < 0 {
+				t.Fatalf("Header(%x) = %x, %d, %d", buf, tag, l, off)
+			}
+		}
+
+		if _, value, rest, err := Next(buf); err == nil {
+			if len(value)+len(rest) > len(buf) {
+				t.Fatalf("Next(%x) exceeds input", buf)
+			}
+		}
+
+		objects, err := Parse(buf)
+
+		if err != nil {
+			return
+		}
+
+		// Non minimal length fields are accepted on parsing, therefore
+		// only the re-encoding must be stable.
+		enc := encode(objects)
+		reparsed, err := Parse(enc)
+
+		if err != nil {
+			t.Fatalf("Parse(%x) re-encoding %x, %v", buf, enc, err)
+		}
+
+		if !bytes.Equal(encode(reparsed), enc) {
+			t.Fatalf("Parse(%x) re-encoding %x not stable", buf, enc)
+		}
+	})
+}
+
+func FuzzLength(f *testing.F) {
+	f.Add(0)
+	f.Add(0x7f)
+	f.Add(0x80)
+	f.Add(0xffff)
+	f.Add(0x7fffffff)
+
+	f.Fuzz(func(t *testing.T, l int) {
+		if l < 0 || uint64(l) > 0xffffffff {
+			t.Skip()
+		}
+
+		buf := append([]byte{0x04}, Length(l)...)
+
+		_, parsed, off, err := Header(buf)
+
+		if err != nil {
+			t.Fatalf("Header(%x), %v", buf, err)
+		}
+
+		if parsed != l || off != len(buf) {
+			t.Fatalf("Header(%x) = %d, %d", buf, parsed, off)
+		}
+	})
+}
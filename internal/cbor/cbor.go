@@ -0,0 +1,323 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package cbor implements encoding and decoding of the CBOR (RFC 8949) data
+// items used by the FIDO Client to Authenticator Protocol (CTAP2).
+//
+// Only definite length integers, byte and text strings, arrays, maps and
+// simple values (false, true, null) are supported. Encoding follows the CTAP2
+// canonical form, where map keys are sorted by the length and value of their
+// encoding.
+package cbor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// CBOR major types
+const (
+	typeUnsigned = 0
+	typeNegative = 1
+	typeBytes    = 2
+	typeText     = 3
+	typeArray    = 4
+	typeMap      = 5
+	typeTag      = 6
+	typeSimple   = 7
+)
+
+// CBOR simple values
+const (
+	simpleFalse = 20
+	simpleTrue  = 21
+	simpleNull  = 22
+)
+
+// maximum nesting level of decoded data items
+const maxDepth = 8
+
+// Raw represents a pre-encoded data item.
+type Raw []byte
+
+func header(major byte, n uint64) []byte {
+	major <<= 5
+
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{major | 24, byte(n)}
+	case n <= math.MaxUint16:
+		return []byte{major | 25, byte(n >> 8), byte(n)}
+	case n <= math.MaxUint32:
+		return []byte{major | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	return []byte{major | 27,
+		byte(n >> 56), byte(n >> 48), byte(n >> 40), byte(n >> 32),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func encodeInt(n int64) []byte {
+	if n < 0 {
+		return header(typeNegative, uint64(-(n + 1)))
+	}
+
+	return header(typeUnsigned, uint64(n))
+}
+
+func encodeMap[K comparable](m map[K]any) (buf []byte, err error) {
+	var entries [][2][]byte
+
+	for k, v := range m {
+		var key, val []byte
+
+		if key, err = Encode(k); err != nil {
+			return
+		}
+
+		if val, err = Encode(v); err != nil {
+			return
+		}
+
+		entries = append(entries, [2][]byte{key, val})
+	}
+
+	// canonical ordering, shorter keys sort earlier
+	slices.SortFunc(entries, func(a, b [2][]byte) int {
+		if len(a[0]) != len(b[0]) {
+			return len(a[0]) - len(b[0])
+		}
+
+		return bytes.Compare(a[0], b[0])
+	})
+
+	buf = header(typeMap, uint64(len(m)))
+
+	for _, e := range entries {
+		buf = append(buf, e[0]...)
+		buf = append(buf, e[1]...)
+	}
+
+	return
+}
+
+// Encode returns the CBOR encoding of a value, supported types are integers,
+// []byte, string, bool, nil, Raw, arrays ([]any, []string, []map[string]any)
+// and maps (map[int]any, map[string]any, map[any]any).
+func Encode(v any) (buf []byte, err error) {
+	switch v := v.(type) {
+	case nil:
+		return []byte{typeSimple<<5 | simpleNull}, nil
+	case bool:
+		if v {
+			return []byte{typeSimple<<5 | simpleTrue}, nil
+		}
+		return []byte{typeSimple<<5 | simpleFalse}, nil
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case uint32:
+		return header(typeUnsigned, uint64(v)), nil
+	case uint64:
+		return header(typeUnsigned, v), nil
+	case []byte:
+		return append(header(typeBytes, uint64(len(v))), v...), nil
+	case string:
+		return append(header(typeText, uint64(len(v))), v...), nil
+	case Raw:
+		return bytes.Clone(v), nil
+	case []any:
+		buf = header(typeArray, uint64(len(v)))
+
+		for _, e := range v {
+			var item []byte
+
+			if item, err = Encode(e); err != nil {
+				return
+			}
+
+			buf = append(buf, item...)
+		}
+
+		return
+	case []string:
+		buf = header(typeArray, uint64(len(v)))
+
+		for _, e := range v {
+			buf = append(buf, append(header(typeText, uint64(len(e))), e...)...)
+		}
+
+		return
+	case []map[string]any:
+		buf = header(typeArray, uint64(len(v)))
+
+		for _, e := range v {
+			var item []byte
+
+			if item, err = encodeMap(e); err != nil {
+				return
+			}
+
+			buf = append(buf, item...)
+		}
+
+		return
+	case map[int]any:
+		return encodeMap(v)
+	case map[string]any:
+		return encodeMap(v)
+	case map[any]any:
+		return encodeMap(v)
+	}
+
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+func decodeHeader(buf []byte) (major byte, n uint64, rest []byte, err error) {
+	if len(buf) < 1 {
+		return 0, 0, nil, errors.New("invalid CBOR, missing header")
+	}
+
+	major = buf[0] >> 5
+	info := buf[0] & 0x1f
+	buf = buf[1:]
+
+	if info < 24 {
+		return major, uint64(info), buf, nil
+	}
+
+	if info > 27 {
+		return 0, 0, nil, errors.New("invalid CBOR, unsupported length")
+	}
+
+	size := 1 << (info - 24)
+
+	if len(buf) < size {
+		return 0, 0, nil, errors.New("invalid CBOR, header too short")
+	}
+
+	for _, b := range buf[:size] {
+		n = n<<8 | uint64(b)
+	}
+
+	return major, n, buf[size:], nil
+}
+
+func decode(buf []byte, depth int) (v any, rest []byte, err error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("invalid CBOR, maximum nesting exceeded")
+	}
+
+	if len(buf) > 0 && buf[0]>>5 == typeSimple && buf[0]&0x1f >= 24 {
+		return nil, nil, errors.New("invalid CBOR, floating point values are not supported")
+	}
+
+	major, n, buf, err := decodeHeader(buf)
+
+	if err != nil {
+		return
+	}
+
+	switch major {
+	case typeUnsigned:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("invalid CBOR, integer overflow")
+		}
+
+		return int64(n), buf, nil
+	case typeNegative:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("invalid CBOR, integer overflow")
+		}
+
+		return -1 - int64(n), buf, nil
+	case typeBytes, typeText:
+		if uint64(len(buf)) < n {
+			return nil, nil, errors.New("invalid CBOR, string too short")
+		}
+
+		if major == typeText {
+			return string(buf[:n]), buf[n:], nil
+		}
+
+		return bytes.Clone(buf[:n]), buf[n:], nil
+	case typeArray:
+		// each item takes at least one byte
+		if uint64(len(buf)) < n {
+			return nil, nil, errors.New("invalid CBOR, array too short")
+		}
+
+		a := make([]any, n)
+
+		for i := range a {
+			if a[i], buf, err = decode(buf, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		return a, buf, nil
+	case typeMap:
+		if uint64(len(buf)) < 2*n {
+			return nil, nil, errors.New("invalid CBOR, map too short")
+		}
+
+		m := make(map[any]any, n)
+
+		for range n {
+			var key, val any
+
+			if key, buf, err = decode(buf, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("invalid CBOR, unsupported map key type")
+			}
+
+			if _, ok := m[key]; ok {
+				return nil, nil, errors.New("invalid CBOR, duplicate map key")
+			}
+
+			if val, buf, err = decode(buf, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			m[key] = val
+		}
+
+		return m, buf, nil
+	case typeSimple:
+		switch n {
+		case simpleFalse:
+			return false, buf, nil
+		case simpleTrue:
+			return true, buf, nil
+		case simpleNull:
+			return nil, buf, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("invalid CBOR, unsupported major type %d (%d)", major, n)
+}
+
+// Decode parses the first data item of a buffer, returning its value and the
+// following bytes.
+//
+// Integers are returned as int64, byte strings as []byte, text strings as
+// string, arrays as []any and maps as map[any]any (with int64 or string
+// keys).
+func Decode(buf []byte) (v any, rest []byte, err error) {
+	return decode(buf, 0)
+}
@@ -7,10 +7,6 @@
 
 package ccid
 
-import (
-	"github.com/usbarmory/GoKey/internal/icc"
-)
-
 // GetParameters implements p31, 6.1.5 PC_to_RDR_GetParameters, CCID Rev1.1.
 type GetParameters struct {
 	MessageType uint8
@@ -32,7 +28,7 @@ type Parameters struct {
 }
 
 // Handle get/reset/set parameters requests.
-func (cmd *GetParameters) Handle(_ []byte, _ *icc.Interface) ([]byte, error) {
+func (cmd *GetParameters) Handle(_ []byte, _ *Interface) ([]byte, error) {
 	res := &Parameters{
 		MessageType: PARAMETERS,
 		Slot:        cmd.Slot,
@@ -7,10 +7,6 @@
 
 package ccid
 
-import (
-	"github.com/usbarmory/GoKey/internal/icc"
-)
-
 // IccPowerOn implements p26, 6.1.1 PC_to_RDR_IccPowerOn, CCID Rev1.1.
 type IccPowerOn struct {
 	MessageType uint8
@@ -30,15 +26,18 @@ type IccPowerOff struct {
 	RFU         [3]byte
 }
 
-// Handle ICC power on requests by returning the ATR.
-func (cmd *IccPowerOn) Handle(_ []byte, card *icc.Interface) (buf []byte, err error) {
+// Handle ICC power on requests by resetting applet selection and returning
+// the ATR.
+func (cmd *IccPowerOn) Handle(_ []byte, reader *Interface) (buf []byte, err error) {
+	reader.Applets.Reset()
+
 	res := &DataBlock{
 		MessageType: DATA_BLOCK,
 		Slot:        cmd.Slot,
 		Seq:         cmd.Seq,
 	}
 
-	atr := card.ATR()
+	atr := reader.ICC.ATR()
 	res.Length = uint32(len(atr))
 
 	if buf, err = Serialize(res); err != nil {
@@ -51,7 +50,7 @@ func (cmd *IccPowerOn) Handle(_ []byte, card *icc.Interface) (buf []byte, err er
 }
 
 // Handle ICC power off requests (NOP, card always active).
-func (cmd *IccPowerOff) Handle(_ []byte, _ *icc.Interface) ([]byte, error) {
+func (cmd *IccPowerOff) Handle(_ []byte, _ *Interface) ([]byte, error) {
 	res := &SlotStatus{
 		MessageType: SLOT_STATUS,
 		Slot:        cmd.Slot,
@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/usbarmory/GoKey/internal/applet"
 	"github.com/usbarmory/GoKey/internal/icc"
 )
 
@@ -36,12 +37,15 @@ const (
 
 // Interface implements a CCID compliant USB smartcard reader.
 type Interface struct {
+	// OpenPGP card, providing the ATR
 	ICC *icc.Interface
+	// Applets routes APDUs to the selected card application
+	Applets *applet.Dispatcher
 }
 
 // CCIDCommand is the interface of individual CCID command handlers.
 type CCIDCommand interface {
-	Handle(buf []byte, card *icc.Interface) (res []byte, err error)
+	Handle(buf []byte, reader *Interface) (res []byte, err error)
 }
 
 // Rx handles incoming CCID commands and invokes the relevant command handler.
@@ -75,5 +79,5 @@ func (ccid *Interface) Rx(buf []byte) (res []byte, err error) {
 		return
 	}
 
-	return cmd.Handle(buf, ccid.ICC)
+	return cmd.Handle(buf, ccid)
 }
@@ -7,10 +7,6 @@
 
 package ccid
 
-import (
-	"github.com/usbarmory/GoKey/internal/icc"
-)
-
 const (
 	// p55, Table 6.2-3 Slot Status register, CCID Rev1.1
 	ICC_PRESENT_AND_ACTIVE = 0
@@ -38,7 +34,7 @@ type SlotStatus struct {
 }
 
 // Handle slot status requests (NOP, card always active).
-func (cmd *GetSlotStatus) Handle(_ []byte, _ *icc.Interface) ([]byte, error) {
+func (cmd *GetSlotStatus) Handle(_ []byte, _ *Interface) ([]byte, error) {
 	res := &SlotStatus{
 		MessageType: SLOT_STATUS,
 		Slot:        cmd.Slot,
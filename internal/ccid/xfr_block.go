@@ -7,10 +7,6 @@
 
 package ccid
 
-import (
-	"github.com/usbarmory/GoKey/internal/icc"
-)
-
 const (
 	BAD_LEVEL_PARAMETER = 8
 )
@@ -26,7 +22,7 @@ type XfrBlock struct {
 }
 
 // Handle APDU transfer requests.
-func (cmd *XfrBlock) Handle(buf []byte, card *icc.Interface) (resBuf []byte, err error) {
+func (cmd *XfrBlock) Handle(buf []byte, reader *Interface) (resBuf []byte, err error) {
 	res := &DataBlock{
 		MessageType: DATA_BLOCK,
 		Slot:        cmd.Slot,
@@ -39,7 +35,7 @@ func (cmd *XfrBlock) Handle(buf []byte, card *icc.Interface) (resBuf []byte, err
 		return Serialize(res)
 	}
 
-	resData, err := card.RawCommand(Data(buf, cmd.Length))
+	resData, err := reader.Applets.RawCommand(Data(buf, cmd.Length))
 
 	if err != nil {
 		return
@@ -0,0 +1,336 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/usbarmory/GoKey/internal/cbor"
+)
+
+const (
+	// COSE algorithms
+	ES256 = -7
+	EdDSA = -8
+
+	// COSE key parameters
+	COSE_KTY = 1
+	COSE_ALG = 3
+	COSE_CRV = -1
+	COSE_X   = -2
+	COSE_Y   = -3
+
+	// COSE key types and curves
+	COSE_KTY_OKP     = 1
+	COSE_KTY_EC2     = 2
+	COSE_CRV_P256    = 1
+	COSE_CRV_ED25519 = 6
+
+	// authenticator data flags
+	FLAG_UP = 0x01
+	FLAG_UV = 0x04
+	FLAG_AT = 0x40
+	FLAG_ED = 0x80
+
+	CREDENTIAL_TYPE = "public-key"
+
+	// credential ID format version
+	CREDENTIAL_ID_VERSION = 0x01
+	// credential private key seed size
+	SEED_SIZE = 32
+	// credential ID size: version || nonce || AES-GCM(flags || alg || seed)
+	CREDENTIAL_ID_SIZE = 1 + 12 + 1 + 1 + SEED_SIZE + 16
+
+	// credential ID flags
+	CREDENTIAL_HMAC_SECRET = 0x01
+)
+
+var algorithmNames = map[int]string{
+	ES256: "ES256",
+	EdDSA: "EdDSA",
+}
+
+// Authenticator Attestation GUID
+var AAGUID = []byte{
+	0x8e, 0x5c, 0x3a, 0x1f, 0x4d, 0x27, 0x46, 0x0b,
+	0x9a, 0x61, 0x2f, 0xd3, 0x70, 0xc8, 0x15, 0xe4,
+}
+
+// credential represents a FIDO2 credential, only discoverable credentials
+// are kept on persistent storage.
+type credential struct {
+	ID        []byte
+	RPID      string
+	RPName    string
+	Algorithm int
+
+	UserID          []byte
+	UserName        string
+	UserDisplayName string
+
+	// creation order, for most recent first selection
+	Sequence uint64
+
+	// private key, unwrapped from the credential ID
+	signer crypto.Signer
+	// hmac-secret extension support, unwrapped from the credential ID
+	hmacSecret bool
+}
+
+// wrappingKey returns the key used to wrap credential private keys within
+// credential IDs, it is derived from the U2F token master key and the
+// authenticator salt (which changes on reset).
+func (a *Authenticator) wrappingKey() ([]byte, error) {
+	return hkdf.Key(sha256.New, a.masterKey, a.state.Salt, "GoKey FIDO2 credential wrapping", 32)
+}
+
+func (a *Authenticator) aead() (cipher.AEAD, error) {
+	key, err := a.wrappingKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func newSigner(alg int, seed []byte) (crypto.Signer, error) {
+	switch alg {
+	case ES256:
+		return ecdsa.ParseRawPrivateKey(elliptic.P256(), seed)
+	case EdDSA:
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	return nil, errors.New("unsupported algorithm")
+}
+
+func newSeed(alg int) ([]byte, error) {
+	switch alg {
+	case ES256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return k.Bytes()
+	case EdDSA:
+		return random(SEED_SIZE)
+	}
+
+	return nil, errors.New("unsupported algorithm")
+}
+
+// newCredential generates a new credential, its private key and hmac-secret
+// extension support are wrapped in the credential ID and bound to the relying
+// party.
+func (a *Authenticator) newCredential(rpID string, alg int, hmacSecret bool) (c *credential, err error) {
+	seed, err := newSeed(alg)
+
+	if err != nil {
+		return
+	}
+
+	c = &credential{
+		RPID:       rpID,
+		Algorithm:  alg,
+		hmacSecret: hmacSecret,
+	}
+
+	if c.signer, err = newSigner(alg, seed); err != nil {
+		return
+	}
+
+	aead, err := a.aead()
+
+	if err != nil {
+		return
+	}
+
+	nonce, err := random(aead.NonceSize())
+
+	if err != nil {
+		return
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	var flags byte
+
+	if hmacSecret {
+		flags |= CREDENTIAL_HMAC_SECRET
+	}
+
+	pt := append([]byte{flags, byte(-alg)}, seed...)
+
+	c.ID = append([]byte{CREDENTIAL_ID_VERSION}, nonce...)
+	c.ID = aead.Seal(c.ID, nonce, pt, rpIDHash[:])
+
+	return
+}
+
+// unwrap returns the credential matching a credential ID, which must be bound
+// to the relying party.
+func (a *Authenticator) unwrap(rpIDHash []byte, id []byte) (c *credential, err error) {
+	if len(id) != CREDENTIAL_ID_SIZE || id[0] != CREDENTIAL_ID_VERSION {
+		return nil, errors.New("invalid credential ID")
+	}
+
+	aead, err := a.aead()
+
+	if err != nil {
+		return
+	}
+
+	nonce := id[1 : 1+aead.NonceSize()]
+	pt, err := aead.Open(nil, nonce, id[1+aead.NonceSize():], rpIDHash)
+
+	if err != nil {
+		return
+	}
+
+	c = &credential{
+		ID:         bytes.Clone(id),
+		Algorithm:  -int(pt[1]),
+		hmacSecret: pt[0]&CREDENTIAL_HMAC_SECRET != 0,
+	}
+
+	if c.signer, err = newSigner(c.Algorithm, pt[2:]); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// publicKey returns the COSE encoding of the credential public key.
+func (c *credential) publicKey() (key map[int]any, err error) {
+	switch pub := c.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		buf, err := pub.Bytes()
+
+		if err != nil {
+			return nil, err
+		}
+
+		// uncompressed point
+		x := buf[1 : 1+32]
+		y := buf[1+32:]
+
+		return map[int]any{
+			COSE_KTY: COSE_KTY_EC2,
+			COSE_ALG: ES256,
+			COSE_CRV: COSE_CRV_P256,
+			COSE_X:   x,
+			COSE_Y:   y,
+		}, nil
+	case ed25519.PublicKey:
+		return map[int]any{
+			COSE_KTY: COSE_KTY_OKP,
+			COSE_ALG: EdDSA,
+			COSE_CRV: COSE_CRV_ED25519,
+			COSE_X:   []byte(pub),
+		}, nil
+	}
+
+	return nil, errors.New("unsupported key")
+}
+
+// sign returns the credential signature over authenticator data and client
+// data hash.
+func (c *credential) sign(authData []byte, clientDataHash []byte) ([]byte, error) {
+	msg := append(bytes.Clone(authData), clientDataHash...)
+
+	switch k := c.signer.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, k, digest[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, msg), nil
+	}
+
+	return nil, errors.New("unsupported key")
+}
+
+// descriptor returns the PublicKeyCredentialDescriptor of the credential.
+func (c *credential) descriptor() map[string]any {
+	return map[string]any{
+		"id":   c.ID,
+		"type": CREDENTIAL_TYPE,
+	}
+}
+
+// user returns the PublicKeyCredentialUserEntity of the credential, user
+// identifiable information is only returned after user verification.
+func (c *credential) user(uv bool) map[string]any {
+	user := map[string]any{
+		"id": c.UserID,
+	}
+
+	if !uv {
+		return user
+	}
+
+	if len(c.UserName) > 0 {
+		user["name"] = c.UserName
+	}
+
+	if len(c.UserDisplayName) > 0 {
+		user["displayName"] = c.UserDisplayName
+	}
+
+	return user
+}
+
+// authData returns the authenticator data (p131, 6.1 Authenticator Data,
+// WebAuthn Level 2), attested credential data is included when a credential
+// public key is passed.
+func authData(rpID string, flags byte, counter uint32, c *credential, extensions []byte) (buf []byte, err error) {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	buf = append(buf, rpIDHash[:]...)
+	buf = append(buf, flags)
+	buf = binary.BigEndian.AppendUint32(buf, counter)
+
+	if c != nil {
+		pub, err := c.publicKey()
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := cbor.Encode(pub)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, AAGUID...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(c.ID)))
+		buf = append(buf, c.ID...)
+		buf = append(buf, key...)
+	}
+
+	return append(buf, extensions...), nil
+}
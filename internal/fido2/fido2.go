@@ -0,0 +1,338 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package fido2 implements a FIDO2 authenticator, supporting the Client to
+// Authenticator Protocol (CTAP 2.1) over the CTAPHID transport shared with the
+// U2F token.
+package fido2
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/cbor"
+	"github.com/usbarmory/GoKey/internal/storage"
+)
+
+// Diversifier for hardware key derivation (FIDO2 persistent state wrapping).
+const DiversifierFIDO2 = "GoKeySNVSFIDO2  "
+
+const (
+	// CTAP2 authenticator API commands
+	MAKE_CREDENTIAL               = 0x01
+	GET_ASSERTION                 = 0x02
+	GET_INFO                      = 0x04
+	CLIENT_PIN                    = 0x06
+	RESET                         = 0x07
+	GET_NEXT_ASSERTION            = 0x08
+	CREDENTIAL_MANAGEMENT         = 0x0a
+	SELECTION                     = 0x0b
+	CREDENTIAL_MANAGEMENT_PREVIEW = 0x41
+)
+
+// Status represents a CTAP2 status code.
+type Status byte
+
+func (s Status) Error() string {
+	return fmt.Sprintf("CTAP2 status %#02x", byte(s))
+}
+
+// CTAP2 status codes (p39, 8.2 Status codes, CTAP 2.1)
+const (
+	CTAP2_OK                          Status = 0x00
+	CTAP1_ERR_INVALID_COMMAND         Status = 0x01
+	CTAP1_ERR_INVALID_PARAMETER       Status = 0x02
+	CTAP1_ERR_INVALID_LENGTH          Status = 0x03
+	CTAP2_ERR_CBOR_UNEXPECTED_TYPE    Status = 0x11
+	CTAP2_ERR_INVALID_CBOR            Status = 0x12
+	CTAP2_ERR_MISSING_PARAMETER       Status = 0x14
+	CTAP2_ERR_LIMIT_EXCEEDED          Status = 0x15
+	CTAP2_ERR_CREDENTIAL_EXCLUDED     Status = 0x19
+	CTAP2_ERR_UNSUPPORTED_ALGORITHM   Status = 0x26
+	CTAP2_ERR_OPERATION_DENIED        Status = 0x27
+	CTAP2_ERR_KEY_STORE_FULL          Status = 0x28
+	CTAP2_ERR_UNSUPPORTED_OPTION      Status = 0x2b
+	CTAP2_ERR_INVALID_OPTION          Status = 0x2c
+	CTAP2_ERR_NO_CREDENTIALS          Status = 0x2e
+	CTAP2_ERR_NOT_ALLOWED             Status = 0x30
+	CTAP2_ERR_PIN_INVALID             Status = 0x31
+	CTAP2_ERR_PIN_BLOCKED             Status = 0x32
+	CTAP2_ERR_PIN_AUTH_INVALID        Status = 0x33
+	CTAP2_ERR_PIN_AUTH_BLOCKED        Status = 0x34
+	CTAP2_ERR_PIN_NOT_SET             Status = 0x35
+	CTAP2_ERR_PUAT_REQUIRED           Status = 0x36
+	CTAP2_ERR_PIN_POLICY_VIOLATION    Status = 0x37
+	CTAP2_ERR_INVALID_SUBCOMMAND      Status = 0x3e
+	CTAP2_ERR_UNAUTHORIZED_PERMISSION Status = 0x40
+	CTAP1_ERR_OTHER                   Status = 0x7f
+)
+
+// Counter represents the monotonic counter, and user presence verification,
+// shared with the U2F token.
+type Counter interface {
+	// Increment increases the counter and returns its new value.
+	Increment(appID []byte, challenge []byte, keyHandle []byte) (uint32, error)
+	// UserPresence verifies the user presence.
+	UserPresence() bool
+	// PresenceAvailable returns whether user presence verification is
+	// configured, when not user presence is automatically assumed.
+	PresenceAvailable() bool
+}
+
+// Authenticator implements a FIDO2 authenticator instance.
+//
+// Credential private keys are never stored, as credential IDs wrap them with
+// a key derived from the U2F token master key. Discoverable (resident)
+// credentials only require their user information to be kept on persistent
+// storage.
+type Authenticator struct {
+	// enable device unique hardware encryption for persistent storage
+	SNVS bool
+	// persistent storage for PIN and resident credentials (optional)
+	Storage storage.Storage
+	// Counter is the U2F token counter, used for signature counters and
+	// user presence verification.
+	Counter Counter
+
+	// U2F token master key
+	masterKey []byte
+
+	// PIN and resident credentials
+	state *state
+
+	// PIN/UV auth protocols key agreement key
+	keyAgreement *ecdh.PrivateKey
+	// PIN/UV auth token and its usage restrictions
+	token *pinUvAuthToken
+	// consecutive PIN failures since power up
+	pinFailures int
+
+	// GET NEXT ASSERTION state
+	assertions *assertions
+	// credential management enumeration state
+	enumeration *enumeration
+
+	// internal state flags
+	initialized bool
+}
+
+// Init initializes the FIDO2 authenticator instance, with the U2F token master
+// key, restoring its state from persistent storage when available.
+func (a *Authenticator) Init(masterKey []byte) (err error) {
+	if a.initialized {
+		return errors.New("FIDO2 authenticator already initialized")
+	}
+
+	if len(masterKey) == 0 || a.Counter == nil {
+		return errors.New("FIDO2 authenticator initialization failed, missing U2F token")
+	}
+
+	a.masterKey = masterKey
+
+	if err = a.loadState(); err != nil {
+		return fmt.Errorf("FIDO2 state loading failed, %v", err)
+	}
+
+	if err = a.resetPinUvAuth(); err != nil {
+		return
+	}
+
+	a.initialized = true
+
+	log.Printf("FIDO2 authenticator initialized")
+
+	return
+}
+
+// Initialized returns the FIDO2 authenticator initialization state.
+func (a *Authenticator) Initialized() bool {
+	return a.initialized
+}
+
+// userPresence verifies the user presence through the U2F token counter,
+// which shares its Presence channel.
+func (a *Authenticator) userPresence() bool {
+	return a.Counter.UserPresence()
+}
+
+// confirmedPresence verifies the user presence, unlike userPresence it fails
+// when user presence verification is not configured.
+func (a *Authenticator) confirmedPresence() bool {
+	return a.Counter.PresenceAvailable() && a.userPresence()
+}
+
+func random(size int) (buf []byte, err error) {
+	buf = make([]byte, size)
+	_, err = rand.Read(buf)
+	return
+}
+
+// param returns a request parameter (or map member), an error is returned
+// when it is present with an unexpected type.
+func param[T any](m map[any]any, key any) (v T, present bool, err error) {
+	if k, ok := key.(int); ok {
+		key = int64(k)
+	}
+
+	raw, present := m[key]
+
+	if !present {
+		return
+	}
+
+	if v, ok := raw.(T); ok {
+		return v, true, nil
+	}
+
+	return v, true, CTAP2_ERR_CBOR_UNEXPECTED_TYPE
+}
+
+// option returns a request option, or its default value when absent.
+func option(params map[any]any, key int, name string, def bool) (v bool, err error) {
+	options, _, err := param[map[any]any](params, key)
+
+	if err != nil {
+		return
+	}
+
+	v, present, err := param[bool](options, name)
+
+	if !present {
+		return def, err
+	}
+
+	return
+}
+
+// Command parses a CTAP2 authenticator API request and redirects it to the
+// relevant handler, the response status code and CBOR encoded parameters are
+// returned.
+func (a *Authenticator) Command(req []byte) (res []byte) {
+	if len(req) == 0 {
+		return []byte{byte(CTAP1_ERR_INVALID_LENGTH)}
+	}
+
+	if !a.initialized {
+		log.Printf("FIDO2 authenticator not initialized")
+		return []byte{byte(CTAP2_ERR_NOT_ALLOWED)}
+	}
+
+	cmd := req[0]
+	params := make(map[any]any)
+
+	if len(req) > 1 {
+		v, rest, err := cbor.Decode(req[1:])
+
+		if err != nil || len(rest) != 0 {
+			return []byte{byte(CTAP2_ERR_INVALID_CBOR)}
+		}
+
+		var ok bool
+
+		if params, ok = v.(map[any]any); !ok {
+			return []byte{byte(CTAP2_ERR_CBOR_UNEXPECTED_TYPE)}
+		}
+	}
+
+	// stateful commands only follow themselves
+	if cmd != GET_NEXT_ASSERTION {
+		a.assertions = nil
+	}
+
+	if cmd != CREDENTIAL_MANAGEMENT && cmd != CREDENTIAL_MANAGEMENT_PREVIEW {
+		a.enumeration = nil
+	}
+
+	var rsp map[int]any
+	var err error
+
+	switch cmd {
+	case MAKE_CREDENTIAL:
+		rsp, err = a.MakeCredential(params)
+	case GET_ASSERTION:
+		rsp, err = a.GetAssertion(params)
+	case GET_NEXT_ASSERTION:
+		rsp, err = a.GetNextAssertion()
+	case GET_INFO:
+		rsp, err = a.GetInfo()
+	case CLIENT_PIN:
+		rsp, err = a.ClientPIN(params)
+	case RESET:
+		err = a.Reset()
+	case CREDENTIAL_MANAGEMENT, CREDENTIAL_MANAGEMENT_PREVIEW:
+		rsp, err = a.CredentialManagement(params)
+	case SELECTION:
+		err = a.Selection()
+	default:
+		log.Printf("FIDO2 unsupported command %x", cmd)
+		err = CTAP1_ERR_INVALID_COMMAND
+	}
+
+	var status Status
+
+	if errors.As(err, &status) {
+		return []byte{byte(status)}
+	} else if err != nil {
+		log.Printf("FIDO2 command %x error, %v", cmd, err)
+		return []byte{byte(CTAP1_ERR_OTHER)}
+	}
+
+	res = []byte{byte(CTAP2_OK)}
+
+	if rsp == nil {
+		return
+	}
+
+	buf, err := cbor.Encode(rsp)
+
+	if err != nil {
+		log.Printf("FIDO2 command %x encoding error, %v", cmd, err)
+		return []byte{byte(CTAP1_ERR_OTHER)}
+	}
+
+	return append(res, buf...)
+}
+
+// Selection implements the authenticatorSelection command (p64, 6.9,
+// CTAP 2.1).
+func (a *Authenticator) Selection() error {
+	if !a.userPresence() {
+		return CTAP2_ERR_OPERATION_DENIED
+	}
+
+	return nil
+}
+
+// Status returns the FIDO2 authenticator status in textual format.
+func (a *Authenticator) Status() string {
+	var status bytes.Buffer
+
+	fmt.Fprintf(&status, "-------------------------------------------------- FIDO2 authenticator ----\n")
+	fmt.Fprintf(&status, "Initialized ............: %v\n", a.initialized)
+
+	if !a.initialized {
+		return status.String()
+	}
+
+	if len(a.state.PIN) == 0 {
+		fmt.Fprintf(&status, "PIN ....................: not set\n")
+	} else {
+		fmt.Fprintf(&status, "PIN ....................: set (%d retries)\n", a.state.PINRetries)
+	}
+
+	fmt.Fprintf(&status, "Resident credentials ...: %d\n", len(a.state.Credentials))
+
+	for _, c := range a.state.Credentials {
+		fmt.Fprintf(&status, "  %s %s (%s)\n", c.RPID, c.UserName, algorithmNames[c.Algorithm])
+	}
+
+	return status.String()
+}
@@ -0,0 +1,333 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	// GetAssertion parameters
+	GA_RP_ID                = 0x01
+	GA_CLIENT_DATA_HASH     = 0x02
+	GA_ALLOW_LIST           = 0x03
+	GA_EXTENSIONS           = 0x04
+	GA_OPTIONS              = 0x05
+	GA_PIN_UV_AUTH_PARAM    = 0x06
+	GA_PIN_UV_AUTH_PROTOCOL = 0x07
+
+	// GetAssertion response parameters
+	GA_RSP_CREDENTIAL            = 0x01
+	GA_RSP_AUTH_DATA             = 0x02
+	GA_RSP_SIGNATURE             = 0x03
+	GA_RSP_USER                  = 0x04
+	GA_RSP_NUMBER_OF_CREDENTIALS = 0x05
+
+	// GetNextAssertion timeout in seconds
+	ASSERTIONS_TIMEOUT = 30
+)
+
+// assertions represents the state of a GetAssertion request, for subsequent
+// GetNextAssertion commands.
+type assertions struct {
+	rpID           string
+	clientDataHash []byte
+	flags          byte
+	uv             bool
+	hmacSecret     *hmacSecret
+
+	credentials []*credential
+	expiry      time.Time
+}
+
+// resident returns the discoverable credential matching a credential ID.
+func (a *Authenticator) resident(id []byte) *credential {
+	i := slices.IndexFunc(a.state.Credentials, func(c *credential) bool {
+		return bytes.Equal(c.ID, id)
+	})
+
+	if i < 0 {
+		return nil
+	}
+
+	return a.state.Credentials[i]
+}
+
+// discoverable returns the discoverable credentials for a relying party, most
+// recent first.
+func (a *Authenticator) discoverable(rpID string) (credentials []*credential) {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	for _, r := range a.state.Credentials {
+		if r.RPID != rpID {
+			continue
+		}
+
+		c, err := a.unwrap(rpIDHash[:], r.ID)
+
+		if err != nil {
+			log.Printf("FIDO2 invalid discoverable credential for %s, %v", rpID, err)
+			continue
+		}
+
+		signer, hmacSecret := c.signer, c.hmacSecret
+		*c = *r
+		c.signer, c.hmacSecret = signer, hmacSecret
+
+		credentials = append(credentials, c)
+	}
+
+	slices.SortFunc(credentials, func(a, b *credential) int {
+		return cmp.Compare(b.Sequence, a.Sequence)
+	})
+
+	return
+}
+
+// allowed returns the first credential, among the credential descriptors,
+// bound to the relying party.
+func (a *Authenticator) allowed(rpIDHash []byte, list []any) (*credential, error) {
+	for _, d := range list {
+		m, ok := d.(map[any]any)
+
+		if !ok {
+			return nil, CTAP2_ERR_CBOR_UNEXPECTED_TYPE
+		}
+
+		id, _, err := param[[]byte](m, "id")
+
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := a.unwrap(rpIDHash, id)
+
+		if err != nil {
+			continue
+		}
+
+		if r := a.resident(id); r != nil {
+			signer := c.signer
+			*c = *r
+			c.signer = signer
+		}
+
+		return c, nil
+	}
+
+	return nil, nil
+}
+
+// assertion returns a GetAssertion response for a credential, user
+// information is returned for discoverable credentials.
+//
+// The hmac-secret extension input is ignored for credentials not created with
+// it (p134, 12.5, CTAP 2.1).
+func (a *Authenticator) assertion(c *credential, rpID string, clientDataHash []byte, flags byte, uv bool, discoverable bool, hs *hmacSecret) (rsp map[int]any, err error) {
+	var ext []byte
+
+	if hs != nil && c.hmacSecret {
+		if ext, err = hs.output(a, c, uv); err != nil {
+			return
+		}
+
+		flags |= FLAG_ED
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	counter, err := a.Counter.Increment(rpIDHash[:], clientDataHash, c.ID)
+
+	if err != nil {
+		return
+	}
+
+	data, err := authData(rpID, flags, counter, nil, ext)
+
+	if err != nil {
+		return
+	}
+
+	sig, err := c.sign(data, clientDataHash)
+
+	if err != nil {
+		return
+	}
+
+	rsp = map[int]any{
+		GA_RSP_CREDENTIAL: c.descriptor(),
+		GA_RSP_AUTH_DATA:  data,
+		GA_RSP_SIGNATURE:  sig,
+	}
+
+	if discoverable {
+		rsp[GA_RSP_USER] = c.user(uv)
+	}
+
+	return
+}
+
+// GetAssertion implements the authenticatorGetAssertion command (p49, 6.2,
+// CTAP 2.1).
+//
+// Without an allow list the discoverable credentials for the relying party
+// are used, most recent first, the remaining ones being available with
+// GetNextAssertion.
+func (a *Authenticator) GetAssertion(params map[any]any) (rsp map[int]any, err error) {
+	rpID, ok1, err := param[string](params, GA_RP_ID)
+
+	if err != nil {
+		return
+	}
+
+	clientDataHash, ok2, err := param[[]byte](params, GA_CLIENT_DATA_HASH)
+
+	if err != nil {
+		return
+	} else if !ok1 || !ok2 {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	allowList, _, err := param[[]any](params, GA_ALLOW_LIST)
+
+	if err != nil {
+		return
+	}
+
+	uv, err := a.pinUvAuth(params, GA_PIN_UV_AUTH_PARAM, GA_PIN_UV_AUTH_PROTOCOL, clientDataHash, PERMISSION_GA, rpID)
+
+	if err != nil {
+		return
+	}
+
+	up, err := option(params, GA_OPTIONS, "up", true)
+
+	if err != nil {
+		return
+	}
+
+	// built-in user verification is not supported
+	if uvOption, err := option(params, GA_OPTIONS, "uv", false); err != nil || uvOption {
+		return nil, CTAP2_ERR_INVALID_OPTION
+	}
+
+	if options, _, _ := param[map[any]any](params, GA_OPTIONS); options != nil {
+		if _, present := options["rk"]; present {
+			return nil, CTAP2_ERR_UNSUPPORTED_OPTION
+		}
+	}
+
+	extensions, _, err := param[map[any]any](params, GA_EXTENSIONS)
+
+	if err != nil {
+		return
+	}
+
+	var hs *hmacSecret
+
+	if ext, present, err := param[map[any]any](extensions, EXT_HMAC_SECRET); err != nil {
+		return nil, err
+	} else if present {
+		// hmac-secret outputs are always gated by user presence,
+		// which must not be automatically assumed
+		if !up {
+			return nil, CTAP2_ERR_UNSUPPORTED_OPTION
+		}
+
+		if !a.Counter.PresenceAvailable() {
+			return nil, CTAP2_ERR_OPERATION_DENIED
+		}
+
+		if hs, err = a.parseHMACSecret(ext); err != nil {
+			return nil, err
+		}
+	}
+
+	var credentials []*credential
+
+	if len(allowList) > 0 {
+		rpIDHash := sha256.Sum256([]byte(rpID))
+		c, err := a.allowed(rpIDHash[:], allowList)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c != nil {
+			credentials = append(credentials, c)
+		}
+	} else {
+		credentials = a.discoverable(rpID)
+	}
+
+	if len(credentials) == 0 {
+		return nil, CTAP2_ERR_NO_CREDENTIALS
+	}
+
+	var flags byte
+
+	if up {
+		if !a.userPresence() {
+			return nil, CTAP2_ERR_OPERATION_DENIED
+		}
+
+		flags |= FLAG_UP
+	}
+
+	if uv {
+		flags |= FLAG_UV
+	}
+
+	discoverable := len(allowList) == 0
+
+	if rsp, err = a.assertion(credentials[0], rpID, clientDataHash, flags, uv, discoverable, hs); err != nil {
+		return
+	}
+
+	if n := len(credentials); discoverable && n > 1 {
+		rsp[GA_RSP_NUMBER_OF_CREDENTIALS] = n
+
+		a.assertions = &assertions{
+			rpID:           rpID,
+			clientDataHash: clientDataHash,
+			flags:          flags,
+			uv:             uv,
+			hmacSecret:     hs,
+			credentials:    credentials[1:],
+			expiry:         time.Now().Add(ASSERTIONS_TIMEOUT * time.Second),
+		}
+	}
+
+	if hs != nil && credentials[0].hmacSecret {
+		log.Printf("FIDO2 assertion for %s (hmac-secret)", rpID)
+	} else {
+		log.Printf("FIDO2 assertion for %s", rpID)
+	}
+
+	return
+}
+
+// GetNextAssertion implements the authenticatorGetNextAssertion command
+// (p53, 6.3, CTAP 2.1).
+func (a *Authenticator) GetNextAssertion() (rsp map[int]any, err error) {
+	s := a.assertions
+
+	if s == nil || len(s.credentials) == 0 || time.Now().After(s.expiry) {
+		a.assertions = nil
+		return nil, CTAP2_ERR_NOT_ALLOWED
+	}
+
+	c := s.credentials[0]
+	s.credentials = s.credentials[1:]
+
+	return a.assertion(c, s.rpID, s.clientDataHash, s.flags, s.uv, true, s.hmacSecret)
+}
@@ -0,0 +1,62 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+const (
+	// GetInfo response parameters
+	INFO_VERSIONS                           = 0x01
+	INFO_EXTENSIONS                         = 0x02
+	INFO_AAGUID                             = 0x03
+	INFO_OPTIONS                            = 0x04
+	INFO_MAX_MSG_SIZE                       = 0x05
+	INFO_PIN_UV_AUTH_PROTOCOLS              = 0x06
+	INFO_MAX_CREDENTIAL_COUNT_IN_LIST       = 0x07
+	INFO_MAX_CREDENTIAL_ID_LENGTH           = 0x08
+	INFO_TRANSPORTS                         = 0x09
+	INFO_ALGORITHMS                         = 0x0a
+	INFO_MIN_PIN_LENGTH                     = 0x0d
+	INFO_REMAINING_DISCOVERABLE_CREDENTIALS = 0x14
+
+	MAX_MSG_SIZE                 = 1200
+	MAX_CREDENTIAL_COUNT_IN_LIST = 8
+)
+
+// GetInfo implements the authenticatorGetInfo command (p54, 6.4, CTAP 2.1).
+func (a *Authenticator) GetInfo() (rsp map[int]any, err error) {
+	var algorithms []map[string]any
+
+	for _, alg := range []int{ES256, EdDSA} {
+		algorithms = append(algorithms, map[string]any{
+			"alg":  alg,
+			"type": CREDENTIAL_TYPE,
+		})
+	}
+
+	return map[int]any{
+		INFO_VERSIONS:   []string{"U2F_V2", "FIDO_2_0", "FIDO_2_1"},
+		INFO_EXTENSIONS: []string{EXT_HMAC_SECRET},
+		INFO_AAGUID:     AAGUID,
+		INFO_OPTIONS: map[string]any{
+			"rk":               true,
+			"up":               true,
+			"plat":             false,
+			"clientPin":        len(a.state.PIN) != 0,
+			"credMgmt":         true,
+			"pinUvAuthToken":   true,
+			"makeCredUvNotRqd": true,
+		},
+		INFO_MAX_MSG_SIZE:                       MAX_MSG_SIZE,
+		INFO_PIN_UV_AUTH_PROTOCOLS:              []any{2, 1},
+		INFO_MAX_CREDENTIAL_COUNT_IN_LIST:       MAX_CREDENTIAL_COUNT_IN_LIST,
+		INFO_MAX_CREDENTIAL_ID_LENGTH:           CREDENTIAL_ID_SIZE,
+		INFO_TRANSPORTS:                         []string{"usb"},
+		INFO_ALGORITHMS:                         algorithms,
+		INFO_MIN_PIN_LENGTH:                     a.state.MinPINLength,
+		INFO_REMAINING_DISCOVERABLE_CREDENTIALS: MAX_CREDENTIALS - len(a.state.Credentials),
+	}, nil
+}
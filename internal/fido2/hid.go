@@ -0,0 +1,66 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"crypto/rand"
+	"log"
+)
+
+const (
+	// CTAPHID commands (p107, 11.2.9, CTAP 2.1)
+	CTAPHID_INIT   = 0x86
+	CTAPHID_CBOR   = 0x90
+	CTAPHID_CANCEL = 0x91
+
+	// CTAPHID_INIT capability flags
+	CAPABILITY_WINK = 0x01
+	CAPABILITY_CBOR = 0x04
+	CAPABILITY_NMSG = 0x08
+
+	CTAPHID_PROTOCOL_VERSION = 2
+	CTAPHID_NONCE_SIZE       = 8
+)
+
+// HandleInit implements the CTAPHID_INIT command, replacing the U2FHID one to
+// advertise the CBOR capability (p108, 11.2.9.1.3, CTAP 2.1), a new channel
+// identifier is allocated on each request.
+func (a *Authenticator) HandleInit(nonce []byte) (res []byte) {
+	if len(nonce) != CTAPHID_NONCE_SIZE {
+		return
+	}
+
+	cid := make([]byte, 4)
+
+	if _, err := rand.Read(cid); err != nil {
+		log.Printf("FIDO2 channel allocation error, %v", err)
+		return
+	}
+
+	res = append(res, nonce...)
+	res = append(res, cid...)
+	res = append(res, CTAPHID_PROTOCOL_VERSION)
+	// device version (major, minor, build)
+	res = append(res, 1, 0, 0)
+	// CTAPHID_MSG is supported through the U2F token
+	res = append(res, CAPABILITY_CBOR)
+
+	return
+}
+
+// HandleCBOR implements the CTAPHID_CBOR command, carrying CTAP2
+// authenticator API requests and responses.
+func (a *Authenticator) HandleCBOR(req []byte) []byte {
+	return a.Command(req)
+}
+
+// HandleCancel implements the CTAPHID_CANCEL command, as requests are
+// processed synchronously there is nothing to cancel and no response is sent.
+func (a *Authenticator) HandleCancel(_ []byte) []byte {
+	return nil
+}
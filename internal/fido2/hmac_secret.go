@@ -0,0 +1,148 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"slices"
+
+	"github.com/usbarmory/GoKey/internal/cbor"
+)
+
+const (
+	// hmac-secret extension identifier
+	EXT_HMAC_SECRET = "hmac-secret"
+
+	// hmac-secret GetAssertion input parameters
+	HMAC_SECRET_KEY_AGREEMENT        = 0x01
+	HMAC_SECRET_SALT_ENC             = 0x02
+	HMAC_SECRET_SALT_AUTH            = 0x03
+	HMAC_SECRET_PIN_UV_AUTH_PROTOCOL = 0x04
+
+	HMAC_SECRET_SALT_SIZE = 32
+)
+
+// hmacSecret represents the hmac-secret extension input of a GetAssertion
+// request.
+type hmacSecret struct {
+	p      pinProtocol
+	secret []byte
+	// salt1 || salt2 (optional)
+	salts []byte
+}
+
+// credRandom returns the hmac-secret key of a credential, derived from the U2F
+// token master key and the credential ID. Distinct keys are returned for
+// requests with and without user verification.
+func (a *Authenticator) credRandom(c *credential, uv bool) (key []byte, err error) {
+	if key, err = hkdf.Key(sha256.New, a.masterKey, nil, "GoKey FIDO2 hmac-secret", 32); err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(c.ID)
+
+	if uv {
+		mac.Write([]byte{0x01})
+	} else {
+		mac.Write([]byte{0x00})
+	}
+
+	return mac.Sum(nil), nil
+}
+
+// parseHMACSecret parses the hmac-secret extension input (p134, 12.5,
+// CTAP 2.1), the salts are decrypted with the secret shared with the
+// platform.
+func (a *Authenticator) parseHMACSecret(ext map[any]any) (h *hmacSecret, err error) {
+	platformKey, ok1, err := param[map[any]any](ext, HMAC_SECRET_KEY_AGREEMENT)
+
+	if err != nil {
+		return
+	}
+
+	saltEnc, ok2, err := param[[]byte](ext, HMAC_SECRET_SALT_ENC)
+
+	if err != nil {
+		return
+	}
+
+	saltAuth, ok3, err := param[[]byte](ext, HMAC_SECRET_SALT_AUTH)
+
+	if err != nil {
+		return
+	} else if !ok1 || !ok2 || !ok3 {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	v, present, err := param[int64](ext, HMAC_SECRET_PIN_UV_AUTH_PROTOCOL)
+
+	if err != nil {
+		return
+	}
+
+	// PIN/UV auth protocol one is assumed when absent
+	if !present {
+		v, present = 1, true
+	}
+
+	h = &hmacSecret{}
+
+	if h.p, err = newPinProtocol(v, present); err != nil {
+		return nil, err
+	}
+
+	if h.secret, err = h.p.sharedSecret(a.keyAgreement, platformKey); err != nil {
+		return nil, err
+	}
+
+	if !h.p.verify(h.secret, saltEnc, saltAuth) {
+		return nil, CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	if h.salts, err = h.p.decrypt(h.secret, saltEnc); err != nil {
+		return nil, CTAP1_ERR_INVALID_LENGTH
+	}
+
+	if n := len(h.salts); n != HMAC_SECRET_SALT_SIZE && n != 2*HMAC_SECRET_SALT_SIZE {
+		return nil, CTAP1_ERR_INVALID_LENGTH
+	}
+
+	return
+}
+
+// output returns the hmac-secret extension output for a credential, the
+// HMAC of each salt with the credential key, encrypted with the secret shared
+// with the platform.
+func (h *hmacSecret) output(a *Authenticator, c *credential, uv bool) (ext []byte, err error) {
+	key, err := a.credRandom(c, uv)
+
+	if err != nil {
+		return
+	}
+
+	var out []byte
+
+	for salt := range slices.Chunk(h.salts, HMAC_SECRET_SALT_SIZE) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(salt)
+		out = mac.Sum(out)
+	}
+
+	enc, err := h.p.encrypt(h.secret, out)
+
+	if err != nil {
+		return
+	}
+
+	return cbor.Encode(map[string]any{
+		EXT_HMAC_SECRET: enc,
+	})
+}
@@ -0,0 +1,304 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"slices"
+
+	"github.com/usbarmory/GoKey/internal/cbor"
+)
+
+const (
+	// MakeCredential parameters
+	MC_CLIENT_DATA_HASH     = 0x01
+	MC_RP                   = 0x02
+	MC_USER                 = 0x03
+	MC_PUB_KEY_CRED_PARAMS  = 0x04
+	MC_EXCLUDE_LIST         = 0x05
+	MC_EXTENSIONS           = 0x06
+	MC_OPTIONS              = 0x07
+	MC_PIN_UV_AUTH_PARAM    = 0x08
+	MC_PIN_UV_AUTH_PROTOCOL = 0x09
+
+	// MakeCredential response parameters
+	MC_RSP_FMT       = 0x01
+	MC_RSP_AUTH_DATA = 0x02
+	MC_RSP_ATT_STMT  = 0x03
+
+	// self attestation format
+	ATTESTATION_FORMAT = "packed"
+)
+
+// selectAlgorithm returns the first supported algorithm among the requested
+// credential parameters.
+func selectAlgorithm(credParams []any) (alg int, err error) {
+	for _, p := range credParams {
+		m, ok := p.(map[any]any)
+
+		if !ok {
+			return 0, CTAP2_ERR_CBOR_UNEXPECTED_TYPE
+		}
+
+		t, _, err := param[string](m, "type")
+
+		if err != nil {
+			return 0, err
+		}
+
+		v, _, err := param[int64](m, "alg")
+
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := algorithmNames[int(v)]; ok && t == CREDENTIAL_TYPE {
+			return int(v), nil
+		}
+	}
+
+	return 0, CTAP2_ERR_UNSUPPORTED_ALGORITHM
+}
+
+// excluded returns whether any of the credential descriptors matches a
+// credential bound to the relying party.
+func (a *Authenticator) excluded(rpIDHash []byte, list []any) (bool, error) {
+	for _, d := range list {
+		m, ok := d.(map[any]any)
+
+		if !ok {
+			return false, CTAP2_ERR_CBOR_UNEXPECTED_TYPE
+		}
+
+		id, _, err := param[[]byte](m, "id")
+
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := a.unwrap(rpIDHash, id); err == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// storeCredential adds a discoverable credential, replacing any existing one
+// for the same relying party and user.
+func (a *Authenticator) storeCredential(c *credential) (err error) {
+	s := *a.state
+	s.Sequence += 1
+	c.Sequence = s.Sequence
+
+	s.Credentials = slices.DeleteFunc(slices.Clone(s.Credentials), func(r *credential) bool {
+		return r.RPID == c.RPID && bytes.Equal(r.UserID, c.UserID)
+	})
+
+	if len(s.Credentials) >= MAX_CREDENTIALS {
+		return CTAP2_ERR_KEY_STORE_FULL
+	}
+
+	s.Credentials = append(s.Credentials, c)
+
+	return a.setState(&s)
+}
+
+// MakeCredential implements the authenticatorMakeCredential command (p42,
+// 6.1, CTAP 2.1), with self attestation.
+//
+// User verification is only available through PIN/UV auth tokens, which are
+// always required for discoverable credentials once a PIN is set.
+func (a *Authenticator) MakeCredential(params map[any]any) (rsp map[int]any, err error) {
+	clientDataHash, ok1, err := param[[]byte](params, MC_CLIENT_DATA_HASH)
+
+	if err != nil {
+		return
+	}
+
+	rp, ok2, err := param[map[any]any](params, MC_RP)
+
+	if err != nil {
+		return
+	}
+
+	user, ok3, err := param[map[any]any](params, MC_USER)
+
+	if err != nil {
+		return
+	}
+
+	credParams, ok4, err := param[[]any](params, MC_PUB_KEY_CRED_PARAMS)
+
+	if err != nil {
+		return
+	}
+
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	rpID, ok1, err := param[string](rp, "id")
+
+	if err != nil {
+		return
+	}
+
+	userID, ok2, err := param[[]byte](user, "id")
+
+	if err != nil {
+		return
+	} else if !ok1 || !ok2 {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	rpName, _, err := param[string](rp, "name")
+
+	if err != nil {
+		return
+	}
+
+	userName, _, err := param[string](user, "name")
+
+	if err != nil {
+		return
+	}
+
+	displayName, _, err := param[string](user, "displayName")
+
+	if err != nil {
+		return
+	}
+
+	alg, err := selectAlgorithm(credParams)
+
+	if err != nil {
+		return
+	}
+
+	uv, err := a.pinUvAuth(params, MC_PIN_UV_AUTH_PARAM, MC_PIN_UV_AUTH_PROTOCOL, clientDataHash, PERMISSION_MC, rpID)
+
+	if err != nil {
+		return
+	}
+
+	rk, err := option(params, MC_OPTIONS, "rk", false)
+
+	if err != nil {
+		return
+	}
+
+	if up, err := option(params, MC_OPTIONS, "up", true); err != nil || !up {
+		return nil, CTAP2_ERR_INVALID_OPTION
+	}
+
+	// built-in user verification is not supported
+	if uvOption, err := option(params, MC_OPTIONS, "uv", false); err != nil || uvOption {
+		return nil, CTAP2_ERR_INVALID_OPTION
+	}
+
+	if rk && !uv && len(a.state.PIN) != 0 {
+		return nil, CTAP2_ERR_PUAT_REQUIRED
+	}
+
+	extensions, _, err := param[map[any]any](params, MC_EXTENSIONS)
+
+	if err != nil {
+		return
+	}
+
+	hmacSecret, _, err := param[bool](extensions, EXT_HMAC_SECRET)
+
+	if err != nil {
+		return
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	excludeList, _, err := param[[]any](params, MC_EXCLUDE_LIST)
+
+	if err != nil {
+		return
+	}
+
+	if excluded, err := a.excluded(rpIDHash[:], excludeList); err != nil {
+		return nil, err
+	} else if excluded {
+		a.userPresence()
+		return nil, CTAP2_ERR_CREDENTIAL_EXCLUDED
+	}
+
+	if !a.userPresence() {
+		return nil, CTAP2_ERR_OPERATION_DENIED
+	}
+
+	c, err := a.newCredential(rpID, alg, hmacSecret)
+
+	if err != nil {
+		return
+	}
+
+	c.RPName = rpName
+	c.UserID = userID
+	c.UserName = userName
+	c.UserDisplayName = displayName
+
+	if rk {
+		if err = a.storeCredential(c); err != nil {
+			return
+		}
+	}
+
+	counter, err := a.Counter.Increment(rpIDHash[:], clientDataHash, c.ID)
+
+	if err != nil {
+		return
+	}
+
+	flags := byte(FLAG_UP | FLAG_AT)
+
+	if uv {
+		flags |= FLAG_UV
+	}
+
+	var ext []byte
+
+	// the hmac-secret key is derived from the credential ID, its
+	// support is recorded within it (see newCredential)
+	if hmacSecret {
+		if ext, err = cbor.Encode(map[string]any{EXT_HMAC_SECRET: true}); err != nil {
+			return
+		}
+
+		flags |= FLAG_ED
+	}
+
+	data, err := authData(rpID, flags, counter, c, ext)
+
+	if err != nil {
+		return
+	}
+
+	sig, err := c.sign(data, clientDataHash)
+
+	if err != nil {
+		return
+	}
+
+	log.Printf("FIDO2 credential created for %s (%s, discoverable:%v)", rpID, algorithmNames[alg], rk)
+
+	return map[int]any{
+		MC_RSP_FMT:       ATTESTATION_FORMAT,
+		MC_RSP_AUTH_DATA: data,
+		MC_RSP_ATT_STMT: map[string]any{
+			"alg": alg,
+			"sig": sig,
+		},
+	}, nil
+}
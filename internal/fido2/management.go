@@ -0,0 +1,369 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"slices"
+
+	"github.com/usbarmory/GoKey/internal/cbor"
+)
+
+const (
+	// CredentialManagement subcommands
+	GET_CREDS_METADATA                        = 0x01
+	ENUMERATE_RPS_BEGIN                       = 0x02
+	ENUMERATE_RPS_GET_NEXT_RP                 = 0x03
+	ENUMERATE_CREDENTIALS_BEGIN               = 0x04
+	ENUMERATE_CREDENTIALS_GET_NEXT_CREDENTIAL = 0x05
+	DELETE_CREDENTIAL                         = 0x06
+	UPDATE_USER_INFORMATION                   = 0x07
+
+	// CredentialManagement parameters
+	CM_SUBCOMMAND           = 0x01
+	CM_SUBCOMMAND_PARAMS    = 0x02
+	CM_PIN_UV_AUTH_PROTOCOL = 0x03
+	CM_PIN_UV_AUTH_PARAM    = 0x04
+
+	// CredentialManagement subcommand parameters
+	CM_RP_ID_HASH    = 0x01
+	CM_CREDENTIAL_ID = 0x02
+	CM_USER          = 0x03
+
+	// CredentialManagement response parameters
+	CM_RSP_EXISTING_RESIDENT_CREDENTIALS_COUNT               = 0x01
+	CM_RSP_MAX_POSSIBLE_REMAINING_RESIDENT_CREDENTIALS_COUNT = 0x02
+	CM_RSP_RP                                                = 0x03
+	CM_RSP_RP_ID_HASH                                        = 0x04
+	CM_RSP_TOTAL_RPS                                         = 0x05
+	CM_RSP_USER                                              = 0x06
+	CM_RSP_CREDENTIAL_ID                                     = 0x07
+	CM_RSP_PUBLIC_KEY                                        = 0x08
+	CM_RSP_TOTAL_CREDENTIALS                                 = 0x09
+	CM_RSP_CRED_PROTECT                                      = 0x0a
+
+	// credProtect userVerificationOptional policy
+	CRED_PROTECT_UV_OPTIONAL = 0x01
+)
+
+// enumeration represents the state of credential management enumerations.
+type enumeration struct {
+	rps         []*credential
+	credentials []*credential
+}
+
+// rps returns one discoverable credential for each relying party.
+func (a *Authenticator) rps() (rps []*credential) {
+	for _, c := range a.state.Credentials {
+		if !slices.ContainsFunc(rps, func(r *credential) bool { return r.RPID == c.RPID }) {
+			rps = append(rps, c)
+		}
+	}
+
+	return
+}
+
+// rpID returns the relying party of discoverable credentials matching a
+// relying party ID hash.
+func (a *Authenticator) rpID(rpIDHash []byte) string {
+	for _, c := range a.state.Credentials {
+		if h := sha256.Sum256([]byte(c.RPID)); bytes.Equal(h[:], rpIDHash) {
+			return c.RPID
+		}
+	}
+
+	return ""
+}
+
+func rpResponse(c *credential) map[int]any {
+	rp := map[string]any{
+		"id": c.RPID,
+	}
+
+	if len(c.RPName) > 0 {
+		rp["name"] = c.RPName
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+
+	return map[int]any{
+		CM_RSP_RP:         rp,
+		CM_RSP_RP_ID_HASH: rpIDHash[:],
+	}
+}
+
+func credentialResponse(c *credential) (rsp map[int]any, err error) {
+	pub, err := c.publicKey()
+
+	if err != nil {
+		return
+	}
+
+	return map[int]any{
+		CM_RSP_USER:          c.user(true),
+		CM_RSP_CREDENTIAL_ID: c.descriptor(),
+		CM_RSP_PUBLIC_KEY:    pub,
+		CM_RSP_CRED_PROTECT:  CRED_PROTECT_UV_OPTIONAL,
+	}, nil
+}
+
+// credentialID returns the discoverable credential matching the credential
+// descriptor subcommand parameter.
+func (a *Authenticator) credentialID(subCommandParams map[any]any) (c *credential, err error) {
+	d, present, err := param[map[any]any](subCommandParams, CM_CREDENTIAL_ID)
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	id, present, err := param[[]byte](d, "id")
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if c = a.resident(id); c == nil {
+		return nil, CTAP2_ERR_NO_CREDENTIALS
+	}
+
+	return
+}
+
+// CredentialManagement implements the authenticatorCredentialManagement
+// command (p64, 6.8, CTAP 2.1), for discoverable credentials.
+func (a *Authenticator) CredentialManagement(params map[any]any) (rsp map[int]any, err error) {
+	subCommand, present, err := param[int64](params, CM_SUBCOMMAND)
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	subCommandParams, _, err := param[map[any]any](params, CM_SUBCOMMAND_PARAMS)
+
+	if err != nil {
+		return
+	}
+
+	e := a.enumeration
+	a.enumeration = nil
+
+	switch subCommand {
+	case ENUMERATE_RPS_GET_NEXT_RP:
+		if e == nil || len(e.rps) == 0 {
+			return nil, CTAP2_ERR_NOT_ALLOWED
+		}
+
+		rsp, e.rps = rpResponse(e.rps[0]), e.rps[1:]
+		a.enumeration = e
+
+		return
+	case ENUMERATE_CREDENTIALS_GET_NEXT_CREDENTIAL:
+		if e == nil || len(e.credentials) == 0 {
+			return nil, CTAP2_ERR_NOT_ALLOWED
+		}
+
+		c := e.credentials[0]
+		e.credentials = e.credentials[1:]
+		a.enumeration = e
+
+		return credentialResponse(c)
+	case GET_CREDS_METADATA, ENUMERATE_RPS_BEGIN, ENUMERATE_CREDENTIALS_BEGIN, DELETE_CREDENTIAL, UPDATE_USER_INFORMATION:
+	default:
+		return nil, CTAP2_ERR_INVALID_SUBCOMMAND
+	}
+
+	// resolve the relying party for the token permission check
+	var rpID string
+	var c *credential
+
+	switch subCommand {
+	case ENUMERATE_CREDENTIALS_BEGIN:
+		rpIDHash, present, err := param[[]byte](subCommandParams, CM_RP_ID_HASH)
+
+		if err != nil {
+			return nil, err
+		} else if !present {
+			return nil, CTAP2_ERR_MISSING_PARAMETER
+		}
+
+		rpID = a.rpID(rpIDHash)
+	case DELETE_CREDENTIAL, UPDATE_USER_INFORMATION:
+		if c, err = a.credentialID(subCommandParams); err == nil {
+			rpID = c.RPID
+		} else if err != CTAP2_ERR_NO_CREDENTIALS {
+			return
+		}
+	}
+
+	if err = a.verifyManagement(params, subCommand, subCommandParams, rpID); err != nil {
+		return
+	}
+
+	switch subCommand {
+	case GET_CREDS_METADATA:
+		return map[int]any{
+			CM_RSP_EXISTING_RESIDENT_CREDENTIALS_COUNT:               len(a.state.Credentials),
+			CM_RSP_MAX_POSSIBLE_REMAINING_RESIDENT_CREDENTIALS_COUNT: MAX_CREDENTIALS - len(a.state.Credentials),
+		}, nil
+	case ENUMERATE_RPS_BEGIN:
+		rps := a.rps()
+
+		if len(rps) == 0 {
+			return nil, CTAP2_ERR_NO_CREDENTIALS
+		}
+
+		rsp = rpResponse(rps[0])
+		rsp[CM_RSP_TOTAL_RPS] = len(rps)
+
+		a.enumeration = &enumeration{rps: rps[1:]}
+	case ENUMERATE_CREDENTIALS_BEGIN:
+		credentials := a.discoverable(rpID)
+
+		if len(rpID) == 0 || len(credentials) == 0 {
+			return nil, CTAP2_ERR_NO_CREDENTIALS
+		}
+
+		if rsp, err = credentialResponse(credentials[0]); err != nil {
+			return
+		}
+
+		rsp[CM_RSP_TOTAL_CREDENTIALS] = len(credentials)
+
+		a.enumeration = &enumeration{credentials: credentials[1:]}
+	case DELETE_CREDENTIAL:
+		if c == nil {
+			return nil, CTAP2_ERR_NO_CREDENTIALS
+		}
+
+		err = a.deleteCredential(c)
+	case UPDATE_USER_INFORMATION:
+		if c == nil {
+			return nil, CTAP2_ERR_NO_CREDENTIALS
+		}
+
+		err = a.updateUser(c, subCommandParams)
+	}
+
+	return
+}
+
+// verifyManagement verifies the pinUvAuthParam of CredentialManagement
+// requests, computed over the subcommand and its parameters.
+func (a *Authenticator) verifyManagement(params map[any]any, subCommand int64, subCommandParams map[any]any, rpID string) (err error) {
+	sig, present, err := param[[]byte](params, CM_PIN_UV_AUTH_PARAM)
+
+	if err != nil {
+		return
+	} else if !present {
+		return CTAP2_ERR_PUAT_REQUIRED
+	}
+
+	v, present, err := param[int64](params, CM_PIN_UV_AUTH_PROTOCOL)
+
+	if err != nil {
+		return
+	}
+
+	p, err := newPinProtocol(v, present)
+
+	if err != nil {
+		return
+	}
+
+	msg := []byte{byte(subCommand)}
+
+	if subCommandParams != nil {
+		// CTAP2 canonical encoding is expected from the platform
+		buf, err := cbor.Encode(subCommandParams)
+
+		if err != nil {
+			return CTAP2_ERR_INVALID_CBOR
+		}
+
+		msg = append(msg, buf...)
+	}
+
+	// metadata and relying parties enumeration require a token not bound
+	// to a relying party
+	if (subCommand == GET_CREDS_METADATA || subCommand == ENUMERATE_RPS_BEGIN) && a.token != nil && len(a.token.rpID) > 0 {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	return a.verifyToken(p, msg, sig, PERMISSION_CM, rpID)
+}
+
+func (a *Authenticator) deleteCredential(c *credential) (err error) {
+	s := *a.state
+	s.Credentials = slices.DeleteFunc(slices.Clone(s.Credentials), func(r *credential) bool {
+		return r == c
+	})
+
+	if err = a.setState(&s); err != nil {
+		return
+	}
+
+	log.Printf("FIDO2 credential for %s deleted", c.RPID)
+
+	return
+}
+
+func (a *Authenticator) updateUser(c *credential, subCommandParams map[any]any) (err error) {
+	user, present, err := param[map[any]any](subCommandParams, CM_USER)
+
+	if err != nil {
+		return
+	} else if !present {
+		return CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	userID, _, err := param[[]byte](user, "id")
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(userID, c.UserID) {
+		return CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	name, _, err := param[string](user, "name")
+
+	if err != nil {
+		return
+	}
+
+	displayName, _, err := param[string](user, "displayName")
+
+	if err != nil {
+		return
+	}
+
+	u := *c
+	u.UserName = name
+	u.UserDisplayName = displayName
+
+	s := *a.state
+	s.Credentials = slices.Clone(s.Credentials)
+	s.Credentials[slices.Index(s.Credentials, c)] = &u
+
+	if err = a.setState(&s); err != nil {
+		return
+	}
+
+	log.Printf("FIDO2 credential for %s updated", c.RPID)
+
+	return
+}
@@ -0,0 +1,611 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"unicode/utf8"
+)
+
+const (
+	// ClientPIN subcommands
+	GET_PIN_RETRIES                                  = 0x01
+	GET_KEY_AGREEMENT                                = 0x02
+	SET_PIN                                          = 0x03
+	CHANGE_PIN                                       = 0x04
+	GET_PIN_TOKEN                                    = 0x05
+	GET_PIN_UV_AUTH_TOKEN_USING_PIN_WITH_PERMISSIONS = 0x09
+
+	// ClientPIN parameters
+	PIN_UV_AUTH_PROTOCOL = 0x01
+	SUBCOMMAND           = 0x02
+	KEY_AGREEMENT        = 0x03
+	PIN_UV_AUTH_PARAM    = 0x04
+	NEW_PIN_ENC          = 0x05
+	PIN_HASH_ENC         = 0x06
+	PERMISSIONS          = 0x09
+	RP_ID                = 0x0a
+
+	// ClientPIN response parameters
+	RSP_KEY_AGREEMENT     = 0x01
+	RSP_PIN_UV_AUTH_TOKEN = 0x02
+	RSP_PIN_RETRIES       = 0x03
+
+	// pinUvAuthToken permissions
+	PERMISSION_MC = 0x01 // MakeCredential
+	PERMISSION_GA = 0x02 // GetAssertion
+	PERMISSION_CM = 0x04 // CredentialManagement
+
+	// COSE ECDH-ES+HKDF-256 algorithm, used for key agreement
+	ECDH_ES_HKDF_256 = -25
+
+	PIN_RETRIES      = 8
+	MIN_PIN_LENGTH   = 4
+	MAX_PIN_LENGTH   = 63
+	PADDED_PIN_SIZE  = 64
+	MAX_PIN_FAILURES = 3
+
+	PIN_UV_AUTH_TOKEN_SIZE = 32
+)
+
+// pinUvAuthToken represents a PIN/UV auth token and its usage restrictions.
+type pinUvAuthToken struct {
+	key         []byte
+	permissions int64
+	// bound relying party, if any
+	rpID string
+}
+
+// pinProtocol represents a PIN/UV auth protocol (p18, 6.5.6 and 6.5.7,
+// CTAP 2.1).
+type pinProtocol int64
+
+func newPinProtocol(v int64, present bool) (p pinProtocol, err error) {
+	if !present {
+		return 0, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	switch v {
+	case 1, 2:
+		return pinProtocol(v), nil
+	}
+
+	return 0, CTAP1_ERR_INVALID_PARAMETER
+}
+
+// sharedSecret returns the secret shared with the platform, following key
+// agreement with the platform key.
+func (p pinProtocol) sharedSecret(key *ecdh.PrivateKey, cose map[any]any) (secret []byte, err error) {
+	kty, _, _ := param[int64](cose, COSE_KTY)
+	crv, _, _ := param[int64](cose, COSE_CRV)
+	x, _, _ := param[[]byte](cose, COSE_X)
+	y, _, _ := param[[]byte](cose, COSE_Y)
+
+	if kty != COSE_KTY_EC2 || crv != COSE_CRV_P256 || len(x) != 32 || len(y) != 32 {
+		return nil, CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	pub, err := ecdh.P256().NewPublicKey(append(append([]byte{0x04}, x...), y...))
+
+	if err != nil {
+		return nil, CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	z, err := key.ECDH(pub)
+
+	if err != nil {
+		return nil, CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	if p == 1 {
+		secret := sha256.Sum256(z)
+		return secret[:], nil
+	}
+
+	salt := make([]byte, 32)
+
+	hmacKey, err := hkdf.Key(sha256.New, z, salt, "CTAP2 HMAC key", 32)
+
+	if err != nil {
+		return
+	}
+
+	aesKey, err := hkdf.Key(sha256.New, z, salt, "CTAP2 AES key", 32)
+
+	if err != nil {
+		return
+	}
+
+	return append(hmacKey, aesKey...), nil
+}
+
+func (p pinProtocol) aesKey(secret []byte) []byte {
+	if p == 1 {
+		return secret
+	}
+
+	return secret[32:]
+}
+
+func (p pinProtocol) hmacKey(secret []byte) []byte {
+	if p == 1 || len(secret) <= 32 {
+		return secret
+	}
+
+	return secret[:32]
+}
+
+func (p pinProtocol) encrypt(secret []byte, pt []byte) (ct []byte, err error) {
+	block, err := aes.NewCipher(p.aesKey(secret))
+
+	if err != nil {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	if p == 2 {
+		if _, err = rand.Read(iv); err != nil {
+			return
+		}
+
+		ct = bytes.Clone(iv)
+	}
+
+	buf := make([]byte, len(pt))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, pt)
+
+	return append(ct, buf...), nil
+}
+
+func (p pinProtocol) decrypt(secret []byte, ct []byte) (pt []byte, err error) {
+	block, err := aes.NewCipher(p.aesKey(secret))
+
+	if err != nil {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	if p == 2 {
+		if len(ct) < aes.BlockSize {
+			return nil, errors.New("invalid ciphertext")
+		}
+
+		iv, ct = ct[:aes.BlockSize], ct[aes.BlockSize:]
+	}
+
+	if len(ct) == 0 || len(ct)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	pt = make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ct)
+
+	return
+}
+
+func (p pinProtocol) authenticate(key []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, p.hmacKey(key))
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	if p == 1 {
+		return sum[:16]
+	}
+
+	return sum
+}
+
+func (p pinProtocol) verify(key []byte, msg []byte, sig []byte) bool {
+	return hmac.Equal(p.authenticate(key, msg), sig)
+}
+
+// coseKey returns the COSE encoding of the key agreement public key.
+func coseKey(key *ecdh.PrivateKey) map[int]any {
+	buf := key.PublicKey().Bytes()
+
+	return map[int]any{
+		COSE_KTY: COSE_KTY_EC2,
+		COSE_ALG: ECDH_ES_HKDF_256,
+		COSE_CRV: COSE_CRV_P256,
+		COSE_X:   buf[1 : 1+32],
+		COSE_Y:   buf[1+32:],
+	}
+}
+
+// resetPinUvAuth regenerates the key agreement key and invalidates the
+// PIN/UV auth token.
+func (a *Authenticator) resetPinUvAuth() (err error) {
+	if a.keyAgreement, err = ecdh.P256().GenerateKey(rand.Reader); err != nil {
+		return
+	}
+
+	a.token = nil
+
+	return
+}
+
+// verifyToken verifies a pinUvAuthParam against the PIN/UV auth token,
+// which must allow the requested permission and relying party. An unbound
+// token becomes bound to the relying party.
+func (a *Authenticator) verifyToken(p pinProtocol, msg []byte, sig []byte, permission int64, rpID string) error {
+	t := a.token
+
+	if t == nil || !p.verify(t.key, msg, sig) {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	if t.permissions&permission == 0 {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	if len(t.rpID) > 0 && len(rpID) > 0 && t.rpID != rpID {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	if len(t.rpID) == 0 {
+		t.rpID = rpID
+	}
+
+	return nil
+}
+
+// checkPIN verifies the encrypted PIN hash, decrementing the retry counter
+// (restored on success).
+func (a *Authenticator) checkPIN(p pinProtocol, secret []byte, pinHashEnc []byte) (err error) {
+	if a.state.PINRetries == 0 {
+		return CTAP2_ERR_PIN_BLOCKED
+	}
+
+	if a.pinFailures >= MAX_PIN_FAILURES {
+		return CTAP2_ERR_PIN_AUTH_BLOCKED
+	}
+
+	s := *a.state
+	s.PINRetries -= 1
+
+	if err = a.setState(&s); err != nil {
+		return
+	}
+
+	pinHash, err := p.decrypt(secret, pinHashEnc)
+
+	if err != nil || subtle.ConstantTimeCompare(pinHash, a.state.PIN) != 1 {
+		log.Printf("FIDO2 PIN verification failed")
+
+		if err = a.resetPinUvAuth(); err != nil {
+			return
+		}
+
+		a.pinFailures += 1
+
+		switch {
+		case a.state.PINRetries == 0:
+			return CTAP2_ERR_PIN_BLOCKED
+		case a.pinFailures >= MAX_PIN_FAILURES:
+			return CTAP2_ERR_PIN_AUTH_BLOCKED
+		}
+
+		return CTAP2_ERR_PIN_INVALID
+	}
+
+	a.pinFailures = 0
+
+	s = *a.state
+	s.PINRetries = PIN_RETRIES
+
+	return a.setState(&s)
+}
+
+// newPIN decrypts and validates a new PIN, returning its hash.
+func (a *Authenticator) newPIN(p pinProtocol, secret []byte, newPinEnc []byte) (pinHash []byte, err error) {
+	pin, err := p.decrypt(secret, newPinEnc)
+
+	if err != nil || len(pin) != PADDED_PIN_SIZE {
+		return nil, CTAP1_ERR_INVALID_PARAMETER
+	}
+
+	pin = bytes.TrimRight(pin, "\x00")
+
+	if utf8.RuneCount(pin) < a.state.MinPINLength || len(pin) > MAX_PIN_LENGTH {
+		return nil, CTAP2_ERR_PIN_POLICY_VIOLATION
+	}
+
+	sum := sha256.Sum256(pin)
+
+	return sum[:16], nil
+}
+
+// ClientPIN implements the authenticatorClientPIN command (p54, 6.5,
+// CTAP 2.1), built-in user verification methods are not supported.
+func (a *Authenticator) ClientPIN(params map[any]any) (rsp map[int]any, err error) {
+	v, present, err := param[int64](params, PIN_UV_AUTH_PROTOCOL)
+
+	if err != nil {
+		return
+	}
+
+	subCommand, present, err := param[int64](params, SUBCOMMAND)
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if subCommand == GET_PIN_RETRIES {
+		return map[int]any{
+			RSP_PIN_RETRIES: a.state.PINRetries,
+		}, nil
+	}
+
+	p, err := newPinProtocol(v, present)
+
+	if err != nil {
+		return
+	}
+
+	switch subCommand {
+	case GET_KEY_AGREEMENT:
+		return map[int]any{
+			RSP_KEY_AGREEMENT: coseKey(a.keyAgreement),
+		}, nil
+	case SET_PIN, CHANGE_PIN, GET_PIN_TOKEN, GET_PIN_UV_AUTH_TOKEN_USING_PIN_WITH_PERMISSIONS:
+	default:
+		return nil, CTAP2_ERR_INVALID_SUBCOMMAND
+	}
+
+	platformKey, present, err := param[map[any]any](params, KEY_AGREEMENT)
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	secret, err := p.sharedSecret(a.keyAgreement, platformKey)
+
+	if err != nil {
+		return
+	}
+
+	switch subCommand {
+	case SET_PIN:
+		return nil, a.setPIN(p, secret, params)
+	case CHANGE_PIN:
+		return nil, a.changePIN(p, secret, params)
+	default:
+		return a.getPinUvAuthToken(p, secret, subCommand, params)
+	}
+}
+
+func (a *Authenticator) setPIN(p pinProtocol, secret []byte, params map[any]any) (err error) {
+	sig, ok1, err := param[[]byte](params, PIN_UV_AUTH_PARAM)
+
+	if err != nil {
+		return
+	}
+
+	newPinEnc, ok2, err := param[[]byte](params, NEW_PIN_ENC)
+
+	if err != nil {
+		return
+	} else if !ok1 || !ok2 {
+		return CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if len(a.state.PIN) != 0 {
+		return CTAP2_ERR_NOT_ALLOWED
+	}
+
+	if !p.verify(secret, newPinEnc, sig) {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	pinHash, err := a.newPIN(p, secret, newPinEnc)
+
+	if err != nil {
+		return
+	}
+
+	s := *a.state
+	s.PIN = pinHash
+	s.PINRetries = PIN_RETRIES
+
+	if err = a.setState(&s); err != nil {
+		return
+	}
+
+	log.Printf("FIDO2 PIN set")
+
+	return
+}
+
+func (a *Authenticator) changePIN(p pinProtocol, secret []byte, params map[any]any) (err error) {
+	sig, ok1, err := param[[]byte](params, PIN_UV_AUTH_PARAM)
+
+	if err != nil {
+		return
+	}
+
+	newPinEnc, ok2, err := param[[]byte](params, NEW_PIN_ENC)
+
+	if err != nil {
+		return
+	}
+
+	pinHashEnc, ok3, err := param[[]byte](params, PIN_HASH_ENC)
+
+	if err != nil {
+		return
+	} else if !ok1 || !ok2 || !ok3 {
+		return CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if len(a.state.PIN) == 0 {
+		return CTAP2_ERR_PIN_NOT_SET
+	}
+
+	if a.state.PINRetries == 0 {
+		return CTAP2_ERR_PIN_BLOCKED
+	}
+
+	if !p.verify(secret, append(bytes.Clone(newPinEnc), pinHashEnc...), sig) {
+		return CTAP2_ERR_PIN_AUTH_INVALID
+	}
+
+	if err = a.checkPIN(p, secret, pinHashEnc); err != nil {
+		return
+	}
+
+	pinHash, err := a.newPIN(p, secret, newPinEnc)
+
+	if err != nil {
+		return
+	}
+
+	s := *a.state
+	s.PIN = pinHash
+
+	if err = a.setState(&s); err != nil {
+		return
+	}
+
+	a.token = nil
+
+	log.Printf("FIDO2 PIN changed")
+
+	return
+}
+
+func (a *Authenticator) getPinUvAuthToken(p pinProtocol, secret []byte, subCommand int64, params map[any]any) (rsp map[int]any, err error) {
+	pinHashEnc, present, err := param[[]byte](params, PIN_HASH_ENC)
+
+	if err != nil {
+		return
+	} else if !present {
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	permissions, present, err := param[int64](params, PERMISSIONS)
+
+	if err != nil {
+		return
+	}
+
+	rpID, _, err := param[string](params, RP_ID)
+
+	if err != nil {
+		return
+	}
+
+	switch {
+	case subCommand == GET_PIN_TOKEN:
+		if present {
+			return nil, CTAP1_ERR_INVALID_PARAMETER
+		}
+
+		// legacy tokens grant the CTAP 2.0 operations
+		permissions = PERMISSION_MC | PERMISSION_GA
+	case !present:
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	case permissions == 0:
+		return nil, CTAP1_ERR_INVALID_PARAMETER
+	case permissions&^(PERMISSION_MC|PERMISSION_GA|PERMISSION_CM) != 0:
+		return nil, CTAP2_ERR_UNAUTHORIZED_PERMISSION
+	case permissions&(PERMISSION_MC|PERMISSION_GA) != 0 && len(rpID) == 0:
+		return nil, CTAP2_ERR_MISSING_PARAMETER
+	}
+
+	if len(a.state.PIN) == 0 {
+		return nil, CTAP2_ERR_PIN_NOT_SET
+	}
+
+	if err = a.checkPIN(p, secret, pinHashEnc); err != nil {
+		return
+	}
+
+	key, err := random(PIN_UV_AUTH_TOKEN_SIZE)
+
+	if err != nil {
+		return
+	}
+
+	a.token = &pinUvAuthToken{
+		key:         key,
+		permissions: permissions,
+		rpID:        rpID,
+	}
+
+	enc, err := p.encrypt(secret, key)
+
+	if err != nil {
+		return
+	}
+
+	return map[int]any{
+		RSP_PIN_UV_AUTH_TOKEN: enc,
+	}, nil
+}
+
+// pinUvAuth verifies the pinUvAuthParam of MakeCredential and GetAssertion
+// requests, returning whether the user is verified (p42, 6.1.2, CTAP 2.1).
+func (a *Authenticator) pinUvAuth(params map[any]any, paramKey int, protocolKey int, clientDataHash []byte, permission int64, rpID string) (uv bool, err error) {
+	sig, present, err := param[[]byte](params, paramKey)
+
+	if err != nil || !present {
+		return
+	}
+
+	// a zero length pinUvAuthParam is used by platforms to select an
+	// authenticator with user presence
+	if len(sig) == 0 {
+		if !a.userPresence() {
+			return false, CTAP2_ERR_OPERATION_DENIED
+		}
+
+		if len(a.state.PIN) == 0 {
+			return false, CTAP2_ERR_PIN_NOT_SET
+		}
+
+		return false, CTAP2_ERR_PIN_INVALID
+	}
+
+	v, present, err := param[int64](params, protocolKey)
+
+	if err != nil {
+		return
+	}
+
+	p, err := newPinProtocol(v, present)
+
+	if err != nil {
+		return
+	}
+
+	if len(a.state.PIN) == 0 {
+		return false, CTAP2_ERR_PIN_NOT_SET
+	}
+
+	if err = a.verifyToken(p, clientDataHash, sig, permission, rpID); err != nil {
+		return
+	}
+
+	return true, nil
+}
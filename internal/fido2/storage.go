@@ -0,0 +1,138 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fido2
+
+import (
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/storage"
+)
+
+// Persistent storage entry names.
+const (
+	STORE_STATE = "fido2-credentials"
+)
+
+const (
+	// credential wrapping key derivation salt size
+	SALT_SIZE = 32
+	// maximum number of discoverable credentials
+	MAX_CREDENTIALS = 50
+)
+
+// state represents the FIDO2 PIN and discoverable credentials.
+type state struct {
+	// credential wrapping key derivation salt
+	Salt []byte
+
+	// LEFT(SHA-256(PIN), 16)
+	PIN          []byte
+	PINRetries   int
+	MinPINLength int
+
+	Credentials []*credential
+	// last credential sequence number
+	Sequence uint64
+}
+
+// newState returns an empty state, the credential wrapping salt is only
+// changed (invalidating existing credential IDs) when persistent storage is
+// available as, otherwise, credentials would not survive a power cycle.
+func (a *Authenticator) newState() (s *state, err error) {
+	s = &state{
+		MinPINLength: MIN_PIN_LENGTH,
+	}
+
+	if a.Storage != nil {
+		s.Salt, err = random(SALT_SIZE)
+	}
+
+	return
+}
+
+// load reads a persistent storage entry, decrypting it when SNVS is enabled.
+// A missing entry (or storage) is not an error and leaves the value
+// unchanged.
+func (a *Authenticator) load(name string, v any) (err error) {
+	return storage.Load(a.Storage, name, DiversifierFIDO2, a.SNVS, v)
+}
+
+// save writes a persistent storage entry, encrypting it when SNVS is enabled.
+// Without persistent storage the FIDO2 state is volatile and only retained in
+// memory.
+func (a *Authenticator) save(name string, v any) (err error) {
+	if a.Storage == nil {
+		return
+	}
+
+	return storage.Save(a.Storage, name, DiversifierFIDO2, a.SNVS, v)
+}
+
+func (a *Authenticator) loadState() (err error) {
+	s := &state{}
+
+	if err = a.load(STORE_STATE, s); err != nil {
+		return
+	}
+
+	if s.MinPINLength == 0 {
+		if s, err = a.newState(); err != nil {
+			return
+		}
+
+		if err = a.save(STORE_STATE, s); err != nil {
+			return
+		}
+	}
+
+	a.state = s
+
+	return
+}
+
+// setState updates the PIN and discoverable credentials, which are kept on
+// persistent storage, encrypted when SNVS is enabled.
+func (a *Authenticator) setState(s *state) (err error) {
+	if err = a.save(STORE_STATE, s); err != nil {
+		log.Printf("FIDO2 state error, %v", err)
+		return CTAP1_ERR_OTHER
+	}
+
+	a.state = s
+
+	return
+}
+
+// Reset implements the authenticatorReset command (p63, 6.6, CTAP 2.1), which
+// requires user presence and deletes the PIN and all credentials. The reset is
+// refused when user presence verification is not configured.
+func (a *Authenticator) Reset() (err error) {
+	if !a.confirmedPresence() {
+		return CTAP2_ERR_OPERATION_DENIED
+	}
+
+	s, err := a.newState()
+
+	if err != nil {
+		return
+	}
+
+	if err = a.setState(s); err != nil {
+		return
+	}
+
+	if err = a.resetPinUvAuth(); err != nil {
+		return
+	}
+
+	a.pinFailures = 0
+
+	log.Printf("FIDO2 authenticator reset")
+
+	return
+}
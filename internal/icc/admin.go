@@ -0,0 +1,137 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"errors"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	DEFAULT_PW3               = "12345678"
+	DEFAULT_PW3_ERROR_COUNTER = 3
+	PW3_MIN_LENGTH            = 8
+)
+
+func (card *Interface) loadAdmin() (err error) {
+	admin := &applet.PINVerifier{}
+
+	if err = card.load(STORE_ADMIN, admin); err != nil {
+		return
+	}
+
+	if len(admin.Hash) == 0 {
+		return
+	}
+
+	card.admin = admin
+
+	if card.errorCounterPW3 == 0 {
+		card.errorCounterPW3 = DEFAULT_PW3_ERROR_COUNTER
+	}
+
+	return
+}
+
+// SetAdminPIN configures the admin PIN (PW3), required for card
+// personalization through PUT DATA, an empty PIN disables PW3.
+//
+// The PIN verifier is kept on persistent storage, encrypted when SNVS is
+// enabled. When KDF is enabled the verifier is computed on the PIN derived
+// hash, as sent by the host.
+func (card *Interface) SetAdminPIN(pin []byte) (err error) {
+	if len(pin) != 0 && (len(pin) < PW3_MIN_LENGTH || len(pin) > PW3_MAX_LENGTH) {
+		return errors.New("invalid admin PIN length")
+	}
+
+	return card.setAdminPIN(card.kdfPIN(PW3, pin))
+}
+
+func (card *Interface) setAdminPIN(pin []byte) (err error) {
+	admin, err := applet.NewPINVerifier(pin)
+
+	if err != nil {
+		return
+	}
+
+	if err = card.save(STORE_ADMIN, admin); err != nil {
+		return
+	}
+
+	card.adminVerified = false
+
+	if len(pin) == 0 {
+		card.admin = nil
+		card.errorCounterPW3 = 0
+		log.Printf("OpenPGP admin PIN disabled")
+	} else {
+		card.admin = admin
+		card.errorCounterPW3 = DEFAULT_PW3_ERROR_COUNTER
+		log.Printf("OpenPGP admin PIN set")
+	}
+
+	if card.initialized {
+		err = card.saveCounters()
+	}
+
+	return
+}
+
+// verifyAdmin implements VERIFY for PW3, which is only available once an
+// admin PIN has been configured through the management interface.
+func (card *Interface) verifyAdmin(P1 byte, pin []byte) (rapdu *apdu.RAPDU) {
+	if card.admin == nil {
+		return applet.CommandNotAllowed()
+	}
+
+	switch P1 {
+	case PW_VERIFY:
+		switch {
+		case len(pin) == 0:
+			// return access status when PW empty
+			if !card.adminVerified {
+				rapdu = VerifyFail(card.errorCounterPW3)
+			}
+		case card.errorCounterPW3 == 0:
+			log.Printf("VERIFY: admin error counter blocked")
+			rapdu = VerifyFail(card.errorCounterPW3)
+		default:
+			card.adminVerified = false
+
+			// The counter is decreased, and saved, ahead of the
+			// verification attempt so that a power interruption
+			// cannot skip it.
+			if err := card.setCounter(&card.errorCounterPW3, card.errorCounterPW3-1); err != nil {
+				return UnrecoverableError()
+			}
+
+			if card.admin.Verify(pin) {
+				card.setCounter(&card.errorCounterPW3, DEFAULT_PW3_ERROR_COUNTER)
+				card.adminVerified = true
+				log.Printf("VERIFY: admin verified")
+			} else {
+				log.Printf("VERIFY: admin error")
+				rapdu = VerifyFail(card.errorCounterPW3)
+			}
+		}
+	case PW_LOCK:
+		card.adminVerified = false
+	default:
+		return applet.CommandNotAllowed()
+	}
+
+	if rapdu == nil {
+		rapdu = applet.CommandCompleted(nil)
+	}
+
+	return
+}
@@ -11,38 +11,16 @@ import (
 	"github.com/hsanjuan/go-nfctype4/apdu"
 )
 
-func CommandNotAllowed() *apdu.RAPDU {
-	return apdu.NewRAPDU(apdu.RAPDUCommandNotAllowed)
-}
-
-func FileNotFound() *apdu.RAPDU {
-	return apdu.NewRAPDU(apdu.RAPDUFileNotFound)
-}
-
-func CardKeyNotSupported() *apdu.RAPDU {
-	return &apdu.RAPDU{
-		SW1: 0x63,
-		SW2: 0x82,
-	}
-}
-
-func WrongData() *apdu.RAPDU {
+func TerminationState() *apdu.RAPDU {
 	return &apdu.RAPDU{
-		SW1: 0x6a,
-		SW2: 0x80,
+		SW1: 0x62,
+		SW2: 0x85,
 	}
 }
 
-func ReferencedDataNotFound() *apdu.RAPDU {
-	return &apdu.RAPDU{
-		SW1: 0x6a,
-		SW2: 0x88,
-	}
-}
-
-func SecurityConditionNotSatisfied() *apdu.RAPDU {
+func CardKeyNotSupported() *apdu.RAPDU {
 	return &apdu.RAPDU{
-		SW1: 0x69,
+		SW1: 0x63,
 		SW2: 0x82,
 	}
 }
@@ -54,14 +32,6 @@ func UnrecoverableError() *apdu.RAPDU {
 	}
 }
 
-func CommandCompleted(data []byte) *apdu.RAPDU {
-	return &apdu.RAPDU{
-		SW1:          0x90,
-		SW2:          0x00,
-		ResponseBody: data,
-	}
-}
-
 func VerifyFail(retries byte) *apdu.RAPDU {
 	return &apdu.RAPDU{
 		SW1: 0x63,
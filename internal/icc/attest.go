@@ -0,0 +1,266 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"crypto"
+	stdecdh "crypto/ecdh"
+	stdecdsa "crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/ProtonMail/go-crypto/openpgp/ecdh"
+	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// Yubico OpenPGP attestation, proprietary class and instruction
+	CLA_PROPRIETARY = 0x80
+	ATTEST          = 0xfb
+
+	// Yubico OpenPGP attestation certificate (intermediate)
+	DO_ATTESTATION_CERTIFICATE = 0xfc
+)
+
+// Yubico OpenPGP attestation extensions, used for compatibility with
+// existing verification tools.
+var (
+	oidAttestationCardholderName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 1}
+	oidAttestationKeySource      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 2}
+	oidAttestationSignatureCount = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 4}
+	oidAttestationSerial         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 5}
+	oidAttestationUIF            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 6}
+)
+
+var attestationNames = map[byte]string{
+	KEY_SIG: "SIG",
+	KEY_DEC: "DEC",
+	KEY_AUT: "AUT",
+}
+
+// no well-defined validity period
+var (
+	attestationNotBefore = time.Unix(0, 0).UTC()
+	attestationNotAfter  = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// initAttestation creates the device attestation certificate, self-signed by
+// the attestation key.
+func (card *Interface) initAttestation() (err error) {
+	if card.AttestationKey == nil {
+		return
+	}
+
+	serial := fmt.Sprintf("%X", card.Serial)
+
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(card.Serial[:]),
+		Subject: pkix.Name{
+			CommonName:   "GoKey Attestation " + serial,
+			SerialNumber: serial,
+		},
+		NotBefore:             attestationNotBefore,
+		NotAfter:              attestationNotAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, card.AttestationKey.Public(), card.AttestationKey)
+
+	if err != nil {
+		return
+	}
+
+	card.attestation, err = x509.ParseCertificate(der)
+
+	return
+}
+
+// AttestationCertificate returns the device attestation certificate, in DER
+// format, which signs key attestation statements (see Attest).
+func (card *Interface) AttestationCertificate() []byte {
+	if card.attestation == nil {
+		return nil
+	}
+
+	return card.attestation.Raw
+}
+
+// attestationPublicKey converts an OpenPGP public key to its standard library
+// counterpart, for certificate creation.
+func attestationPublicKey(pub crypto.PublicKey) (crypto.PublicKey, error) {
+	switch pubKey := pub.(type) {
+	case *rsa.PublicKey:
+		return pubKey, nil
+	case *ecdsa.PublicKey:
+		var curve elliptic.Curve
+
+		switch pubKey.GetCurve().GetCurveName() {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", pubKey.GetCurve().GetCurveName())
+		}
+
+		return stdecdsa.ParseUncompressedPublicKey(curve, pubKey.MarshalPoint())
+	case *ecdh.PublicKey:
+		switch name := pubKey.GetCurve().GetCurveName(); name {
+		case "P-256":
+			return stdecdh.P256().NewPublicKey(pubKey.MarshalPoint())
+		case "P-384":
+			return stdecdh.P384().NewPublicKey(pubKey.MarshalPoint())
+		case "P-521":
+			return stdecdh.P521().NewPublicKey(pubKey.MarshalPoint())
+		case CURVE25519:
+			return stdecdh.X25519().NewPublicKey(nativePoint(pubKey.Point, x25519.KeySize))
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", name)
+		}
+	case *eddsa.PublicKey:
+		if name := pubKey.GetCurve().GetCurveName(); name != ED25519 {
+			return nil, fmt.Errorf("unsupported curve %s", name)
+		}
+
+		return stded25519.PublicKey(pubKey.X), nil
+	case *ed25519.PublicKey:
+		return stded25519.PublicKey(pubKey.Point), nil
+	case *x25519.PublicKey:
+		return stdecdh.X25519().NewPublicKey(pubKey.Point)
+	}
+
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// attest returns a key attestation statement, as a certificate for the key
+// signed by the attestation key.
+func (card *Interface) attest(key byte) (der []byte, err error) {
+	subkey := card.subkey(key)
+
+	pub, err := attestationPublicKey(subkey.PublicKey.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return
+	}
+
+	fingerprint := card.Fingerprints()[int(key-KEY_SIG)*FINGERPRINT_SIZE:][:FINGERPRINT_SIZE]
+
+	source := []byte{0x00}
+
+	if card.slot(key).Status == KEY_GENERATED {
+		source[0] = 0x01
+	}
+
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, card.digitalSignatureCounter)
+
+	extensions := []pkix.Extension{
+		{Id: oidAttestationCardholderName, Value: []byte(card.Name)},
+		{Id: oidAttestationKeySource, Value: source},
+		{Id: oidAttestationSerial, Value: card.Serial[:]},
+		{Id: oidAttestationUIF, Value: []byte{card.slot(key).UIF}},
+	}
+
+	if key == KEY_SIG {
+		extensions = append(extensions, pkix.Extension{Id: oidAttestationSignatureCount, Value: counter})
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "GoKey OpenPGP Attestation " + attestationNames[key],
+			SerialNumber: strings.ToUpper(hex.EncodeToString(fingerprint)),
+		},
+		NotBefore:       attestationNotBefore,
+		NotAfter:        attestationNotAfter,
+		ExtraExtensions: extensions,
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, card.attestation, pub, card.AttestationKey)
+}
+
+// Attest implements the Yubico OpenPGP ATTEST command.
+//
+// A key attestation statement, signed by the device attestation key, is
+// stored as cardholder certificate for the key (see SelectData) and can be
+// verified against the attestation certificate (DO 0xFC).
+//
+// The statement includes the key fingerprint (as subject serial number), its
+// source (generated on card or imported), its User Interaction Flag, the card
+// serial number and, for the signature key, the digital signature counter.
+func (card *Interface) Attest(P1 byte, P2 byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 < KEY_SIG || P1 > KEY_AUT || P2 != 0x00 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if card.attestation == nil {
+		log.Printf("ATTEST: attestation key not available")
+		return applet.CommandNotAllowed(), nil
+	}
+
+	subkey := card.subkey(P1)
+
+	if subkey == nil || subkey.PrivateKey == nil {
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	// the attestation statement replaces any cardholder certificate,
+	// therefore it requires PW1 verification for the key
+	if subkey.PrivateKey.Encrypted {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	der, err := card.attest(P1)
+
+	if err != nil {
+		log.Printf("ATTEST error, %v", err)
+		return CardKeyNotSupported(), nil
+	}
+
+	certificates := card.certificates
+	certificates[KEY_AUT-P1] = der
+
+	if err = card.save(card.entry(STORE_CERTIFICATES), certificates); err != nil {
+		log.Printf("ATTEST error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.certificates = certificates
+
+	log.Printf("ATTEST: %s key attested", keyNames[P1])
+
+	return applet.CommandCompleted(nil), nil
+}
@@ -0,0 +1,104 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// p31, 4.4.3.6 Cardholder certificate, OpenPGP application Version 3.4
+	//
+	// The DO occurs up to three times, for the authentication, decryption
+	// and signature keys (in this order).
+	CERTIFICATE_AUT = 0
+	CERTIFICATE_DEC = 1
+	CERTIFICATE_SIG = 2
+
+	// bound by the maximum response APDU length
+	CERTIFICATE_MAX_LENGTH = 0x0bfe
+)
+
+func (card *Interface) loadCertificates() (err error) {
+	return card.load(card.entry(STORE_CERTIFICATES), &card.certificates)
+}
+
+// Certificate returns the cardholder certificate, if present, for the
+// authentication (0), decryption (1) or signature (2) key.
+func (card *Interface) Certificate(occurrence int) []byte {
+	if occurrence < CERTIFICATE_AUT || occurrence > CERTIFICATE_SIG {
+		return nil
+	}
+
+	return card.certificates[occurrence]
+}
+
+// SelectData implements
+// p56, 7.2.5 SELECT DATA, OpenPGP application Version 3.4.
+//
+// Only the cardholder certificate DO (0x7F21) can be selected.
+func (card *Interface) SelectData(occurrence byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if occurrence > CERTIFICATE_SIG || P2 != 0x04 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	tagList := []byte{0x5c, 0x02, 0x7f, 0x21}
+
+	// Some clients omit the outer tag (0x60), both forms are accepted.
+	if !bytes.Equal(data, bertlv.Encode(0x60, tagList)) && !bytes.Equal(data, tagList) {
+		log.Printf("unsupported SELECT DATA %x", data)
+		return applet.WrongData(), nil
+	}
+
+	card.certificate = int(occurrence)
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// GetNextData implements
+// p59, 7.2.7 GET NEXT DATA, OpenPGP application Version 3.4.
+func (card *Interface) GetNextData(tag uint16) (rapdu *apdu.RAPDU, err error) {
+	if tag != DO_CARDHOLDER_CERTIFICATE {
+		log.Printf("unsupported GET NEXT DATA tag %x", tag)
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	if card.certificate >= CERTIFICATE_SIG {
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	card.certificate += 1
+
+	return applet.CommandCompleted(card.Certificate(card.certificate)), nil
+}
+
+// putCertificate implements PUT DATA for the currently selected cardholder
+// certificate, empty data deletes it.
+func (card *Interface) putCertificate(data []byte) (rapdu *apdu.RAPDU) {
+	if len(data) > CERTIFICATE_MAX_LENGTH {
+		return applet.WrongData()
+	}
+
+	certificates := card.certificates
+	certificates[card.certificate] = data
+
+	if err := card.save(card.entry(STORE_CERTIFICATES), certificates); err != nil {
+		log.Printf("PUT DATA error, %v", err)
+		return UnrecoverableError()
+	}
+
+	card.certificates = certificates
+
+	return applet.CommandCompleted(nil)
+}
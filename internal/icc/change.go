@@ -0,0 +1,328 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+var errPW1NotVerified = errors.New("PW1 not verified")
+
+func (card *Interface) loadPW1() (err error) {
+	pw1 := &applet.PINVerifier{}
+
+	if err = card.load(card.entry(STORE_PW1), pw1); err != nil {
+		return
+	}
+
+	if len(pw1.Hash) == 0 {
+		return
+	}
+
+	card.pw1 = pw1
+
+	return
+}
+
+// verifyPW1 verifies a passphrase against the one protecting keys generated
+// or imported on card.
+func (card *Interface) verifyPW1(passphrase []byte) bool {
+	if card.pw1 == nil {
+		return subtle.ConstantTimeCompare(passphrase, []byte(DEFAULT_PW1)) == 1
+	}
+
+	return card.pw1.Verify(passphrase)
+}
+
+// retainPW1 keeps a verified passphrase, when it protects keys generated or
+// imported on card, so that further keys can be protected with it until the
+// next PW_LOCK.
+func (card *Interface) retainPW1(passphrase []byte) {
+	if card.pw1 != nil && len(passphrase) != 0 && card.pw1.Verify(passphrase) {
+		card.pw1Passphrase = bytes.Clone(passphrase)
+	}
+}
+
+// keyPassphrase returns the passphrase protecting keys generated or imported
+// on card, once changed with CHANGE REFERENCE DATA it is only available after
+// PW1 verification.
+func (card *Interface) keyPassphrase() ([]byte, error) {
+	switch {
+	case card.pw1 == nil:
+		return []byte(DEFAULT_PW1), nil
+	case card.pw1Passphrase == nil:
+		return nil, errPW1NotVerified
+	}
+
+	return card.pw1Passphrase, nil
+}
+
+// reencrypt returns a serialized private key packet, protected with the new
+// passphrase, from one protected with the old passphrase.
+func reencrypt(buf []byte, old []byte, passphrase []byte) (key []byte, encrypted *packet.PrivateKey, err error) {
+	if encrypted, err = readPrivateKey(buf); err != nil {
+		return
+	}
+
+	if encrypted.Encrypted {
+		if err = encrypted.Decrypt(old); err != nil {
+			return
+		}
+	}
+
+	if err = encrypted.Encrypt(passphrase); err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+
+	if err = encrypted.Serialize(&b); err != nil {
+		return
+	}
+
+	return b.Bytes(), encrypted, nil
+}
+
+// updateSubkey replaces the encrypted private key cache of a subkey, the
+// subkey itself is only replaced when locked.
+func updateSubkey(subkey *openpgp.Subkey, cache *packet.PrivateKey, encrypted *packet.PrivateKey) {
+	*cache = *encrypted
+
+	if subkey != nil && subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+		privateKey := *encrypted
+		subkey.PrivateKey = &privateKey
+	}
+}
+
+// onCardKeys returns whether keys generated or imported on card, including
+// retired ones, are present.
+func (card *Interface) onCardKeys() bool {
+	for _, slot := range card.slots {
+		if len(slot.Key) != 0 {
+			return true
+		}
+	}
+
+	for _, r := range card.retired {
+		if len(r.key) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changePW1 protects keys generated or imported on card, including retired
+// ones, with a new passphrase.
+func (card *Interface) changePW1(old []byte, passphrase []byte) (err error) {
+	var encrypted [3]*packet.PrivateKey
+
+	slots := card.slots
+
+	for i := range slots {
+		if len(slots[i].Key) == 0 {
+			continue
+		}
+
+		if slots[i].Key, encrypted[i], err = reencrypt(slots[i].Key, old, passphrase); err != nil {
+			return
+		}
+	}
+
+	var retired []*retiredKey
+	var keys [][]byte
+
+	for _, r := range card.retired {
+		if len(r.key) == 0 {
+			continue
+		}
+
+		key, encrypted, err := reencrypt(r.key, old, passphrase)
+
+		if err != nil {
+			return err
+		}
+
+		retired = append(retired, &retiredKey{subkey: r.subkey, encrypted: *encrypted, key: key})
+		keys = append(keys, key)
+	}
+
+	pw1, err := applet.NewPINVerifier(passphrase)
+
+	if err != nil {
+		return
+	}
+
+	if err = card.save(card.entry(STORE_KEYS), slots); err != nil {
+		return
+	}
+
+	if len(keys) > 0 {
+		if err = card.save(card.entry(STORE_RETIRED_KEYS), keys); err != nil {
+			return
+		}
+	}
+
+	if err = card.save(card.entry(STORE_PW1), pw1); err != nil {
+		return
+	}
+
+	card.slots = slots
+	card.pw1 = pw1
+	card.pw1Passphrase = bytes.Clone(passphrase)
+
+	for i, cache := range []*packet.PrivateKey{&card.sig, &card.dec, &card.aut} {
+		if encrypted[i] != nil {
+			updateSubkey(card.subkey(KEY_SIG+byte(i)), cache, encrypted[i])
+		}
+	}
+
+	for _, u := range retired {
+		for _, r := range card.retired {
+			if r.subkey == u.subkey {
+				r.key = u.key
+				updateSubkey(r.subkey, &r.encrypted, &u.encrypted)
+			}
+		}
+	}
+
+	return
+}
+
+// ChangeReferenceData implements
+// p53, 7.2.3 CHANGE REFERENCE DATA, OpenPGP application Version 3.4.
+//
+// As PW1 represents the actual private key passphrase, its change protects
+// keys generated or imported on card, initially protected with DEFAULT_PW1,
+// with the new passphrase. Bundled keys retain their own passphrase, therefore
+// the change is refused when no key generated or imported on card is present.
+//
+// The change is also refused when KDF is enabled, as the new passphrase cannot
+// be recovered from its derived hash.
+//
+// The change of the admin password (PW3) is only available when an admin PIN
+// has been configured through the management interface.
+func (card *Interface) ChangeReferenceData(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != 0x00 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	switch P2 {
+	case PW1_CDS:
+		return card.changeUser(data), nil
+	case PW3:
+		return card.changeAdmin(data), nil
+	}
+
+	return applet.IncorrectParameters(), nil
+}
+
+// changeUser implements CHANGE REFERENCE DATA for PW1, the old and new
+// passphrases are split according to the old passphrase length.
+func (card *Interface) changeUser(data []byte) (rapdu *apdu.RAPDU) {
+	switch {
+	case card.kdf != nil:
+		log.Printf("CHANGE REFERENCE DATA: PW1 change not supported with KDF")
+		return applet.ConditionsNotSatisfied()
+	case !card.onCardKeys():
+		log.Printf("CHANGE REFERENCE DATA: PW1 change requires keys generated or imported on card")
+		return applet.ConditionsNotSatisfied()
+	}
+
+	n := len(DEFAULT_PW1)
+
+	if card.pw1 != nil {
+		n = card.pw1.Length
+	}
+
+	if len(data) <= n {
+		return applet.WrongData()
+	}
+
+	old := data[:n]
+	passphrase := data[n:]
+
+	if len(passphrase) < PW1_MIN_LENGTH || len(passphrase) > PW1_MAX_LENGTH {
+		return applet.WrongData()
+	}
+
+	if card.errorCounterPW1 == 0 {
+		log.Printf("CHANGE REFERENCE DATA: PW1 error counter blocked")
+		return VerifyFail(card.errorCounterPW1)
+	}
+
+	// The counter is decreased, and saved, ahead of the verification
+	// attempt so that a power interruption cannot skip it.
+	if err := card.setCounter(&card.errorCounterPW1, card.errorCounterPW1-1); err != nil {
+		return UnrecoverableError()
+	}
+
+	if !card.verifyPW1(old) {
+		log.Printf("CHANGE REFERENCE DATA: PW1 error")
+		return VerifyFail(card.errorCounterPW1)
+	}
+
+	card.setCounter(&card.errorCounterPW1, DEFAULT_PW1_ERROR_COUNTER)
+
+	if err := card.changePW1(old, passphrase); err != nil {
+		log.Printf("CHANGE REFERENCE DATA: PW1 change error, %v", err)
+		return UnrecoverableError()
+	}
+
+	log.Printf("CHANGE REFERENCE DATA: PW1 changed")
+
+	return applet.CommandCompleted(nil)
+}
+
+// changeAdmin implements CHANGE REFERENCE DATA for PW3.
+func (card *Interface) changeAdmin(data []byte) (rapdu *apdu.RAPDU) {
+	if card.admin == nil {
+		return applet.CommandNotAllowed()
+	}
+
+	n := card.admin.Length
+	pin := data[min(n, len(data)):]
+
+	if len(data) <= n || (card.kdf == nil && (len(pin) < PW3_MIN_LENGTH || len(pin) > PW3_MAX_LENGTH)) {
+		return applet.WrongData()
+	}
+
+	if card.errorCounterPW3 == 0 {
+		log.Printf("CHANGE REFERENCE DATA: admin error counter blocked")
+		return VerifyFail(card.errorCounterPW3)
+	}
+
+	// The counter is decreased, and saved, ahead of the verification
+	// attempt so that a power interruption cannot skip it.
+	if err := card.setCounter(&card.errorCounterPW3, card.errorCounterPW3-1); err != nil {
+		return UnrecoverableError()
+	}
+
+	if !card.admin.Verify(data[:n]) {
+		log.Printf("CHANGE REFERENCE DATA: admin error")
+		return VerifyFail(card.errorCounterPW3)
+	}
+
+	if err := card.setAdminPIN(pin); err != nil {
+		log.Printf("CHANGE REFERENCE DATA: admin change error, %v", err)
+		return UnrecoverableError()
+	}
+
+	log.Printf("CHANGE REFERENCE DATA: admin changed")
+
+	return applet.CommandCompleted(nil)
+}
@@ -0,0 +1,141 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"errors"
+	"log"
+)
+
+// counters represents the PW retry counters and the digital signature
+// counter, kept on persistent storage to prevent reset by power cycling.
+type counters struct {
+	PW1              uint8
+	RC               uint8
+	PW3              uint8
+	DigitalSignature uint32
+
+	// monotonic counter value at the time of writing, for rollback
+	// detection
+	Sequence uint32
+}
+
+// loadCounters restores persistent counters, a mismatch against the
+// monotonic counter (if any) indicates a rollback of the storage entry, or its
+// deletion, and blocks PW1, RC and PW3.
+//
+// Counters written ahead of the monotonic counter increase are accepted, and
+// the increase completed, as the write might have been interrupted.
+func (card *Interface) loadCounters() (err error) {
+	var c *counters
+	var seq uint32
+
+	if err = card.load(STORE_COUNTERS, &c); err != nil {
+		return
+	}
+
+	if card.Counter != nil {
+		if seq, err = card.Counter.Read(); err != nil {
+			return
+		}
+	}
+
+	if c != nil && card.Counter != nil && c.Sequence == seq+1 {
+		if seq, err = card.Counter.Increment(); err != nil {
+			return
+		}
+	}
+
+	switch {
+	case c != nil && c.Sequence == seq:
+		card.errorCounterPW1 = c.PW1
+		card.errorCounterRC = c.RC
+		card.errorCounterPW3 = c.PW3
+		card.digitalSignatureCounter = c.DigitalSignature
+	case c == nil && seq == 0:
+		// no counters have ever been stored
+	default:
+		log.Printf("OpenPGP counters rollback detected, blocking PW1, RC and PW3")
+
+		if c != nil {
+			card.digitalSignatureCounter = c.DigitalSignature
+		}
+
+		card.errorCounterPW1 = 0
+		card.errorCounterRC = 0
+		card.errorCounterPW3 = 0
+
+		return card.saveCounters()
+	}
+
+	if card.rc == nil {
+		card.errorCounterRC = 0
+	}
+
+	if card.admin == nil {
+		card.errorCounterPW3 = 0
+	}
+
+	return
+}
+
+// saveCounters writes persistent counters, counters remain volatile when
+// persistent storage is not available.
+//
+// Counters are written with the next monotonic counter value, which is only
+// increased afterwards, so that neither an interrupted write nor an
+// interrupted increase is detected as rollback.
+func (card *Interface) saveCounters() (err error) {
+	if card.Storage == nil {
+		return
+	}
+
+	c := &counters{
+		PW1:              card.errorCounterPW1,
+		RC:               card.errorCounterRC,
+		PW3:              card.errorCounterPW3,
+		DigitalSignature: card.digitalSignatureCounter,
+	}
+
+	if card.Counter == nil {
+		return card.save(STORE_COUNTERS, c)
+	}
+
+	seq, err := card.Counter.Read()
+
+	if err != nil {
+		return
+	}
+
+	c.Sequence = seq + 1
+
+	if err = card.save(STORE_COUNTERS, c); err != nil {
+		return
+	}
+
+	if seq, err = card.Counter.Increment(); err == nil && seq != c.Sequence {
+		err = errors.New("unexpected monotonic counter value")
+	}
+
+	return
+}
+
+// setCounter updates and saves a retry counter.
+func (card *Interface) setCounter(counter *uint8, n uint8) (err error) {
+	if *counter == n {
+		return
+	}
+
+	*counter = n
+
+	if err = card.saveCounters(); err != nil {
+		log.Printf("OpenPGP counters error, %v", err)
+	}
+
+	return
+}
@@ -11,13 +11,27 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/aes"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"log"
 
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/ProtonMail/go-crypto/brainpool"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/ecdh"
 	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/ed448"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/ProtonMail/go-crypto/openpgp/x448"
+	circlx448 "github.com/cloudflare/circl/dh/x448"
 	"github.com/hsanjuan/go-nfctype4/apdu"
+	"golang.org/x/crypto/curve25519"
 )
 
 const (
@@ -26,6 +40,11 @@ const (
 	AES_PADDING = 0x02
 )
 
+var (
+	errKeyNotSupported = errors.New("card key not supported")
+	errWrongData       = errors.New("wrong data")
+)
+
 func padToKeySize(pub ecdsa.PublicKey, b []byte) []byte {
 	// RFC 4880 - OpenPGP Message Format:
 	// The size of an MPI is ((MPI.length + 7) / 8) + 2 octets.
@@ -40,11 +59,15 @@ func padToKeySize(pub ecdsa.PublicKey, b []byte) []byte {
 
 // ComputeDigitalSignature implements
 // p62, 7.2.10 PSO: COMPUTE DIGITAL SIGNATURE, OpenPGP application Version 3.4.
+//
+// For RSA keys the input must be a DigestInfo for SHA-1, SHA-2 or SHA-3
+// digests, unless raw PKCS#1 mode is enabled (see RawPKCS1) in which case
+// any other input is signed as-is with PKCS#1 v1.5 padding.
 func (card *Interface) ComputeDigitalSignature(data []byte) (rapdu *apdu.RAPDU, err error) {
 	var sig []byte
 
 	if len(data) == 0 {
-		return WrongData(), nil
+		return applet.WrongData(), nil
 	}
 
 	subkey := card.Sig
@@ -55,54 +78,46 @@ func (card *Interface) ComputeDigitalSignature(data []byte) (rapdu *apdu.RAPDU,
 	}
 
 	if subkey.PrivateKey.Encrypted {
-		return SecurityConditionNotSatisfied(), nil
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if !card.userPresence(KEY_SIG) {
+		return applet.SecurityConditionNotSatisfied(), nil
 	}
 
-	if PW1_CDS_MULTI == 0 {
+	// PW1 only valid for one PSO:CDS command unless changed with PUT DATA
+	if card.pw1Status == PW1_CDS_MULTI {
 		defer card.Verify(PW_LOCK, PW1_CDS, nil)
 	}
 
 	switch privKey := subkey.PrivateKey.PrivateKey.(type) {
 	case *rsa.PrivateKey:
-		var hash crypto.Hash
-
 		// p64, 7.2.10.2 DigestInfo for RSA, OpenPGP application Version 3.4
-
-		// 19 bytes of DigestInfo + at least 32 bytes for smallest hash
-		if len(data) < 19+32 {
-			return WrongData(), nil
-		}
-
-		digest := data[19:]
-
-		switch len(digest) {
-		case 32:
-			hash = crypto.SHA256
-		case 48:
-			hash = crypto.SHA384
-		case 64:
-			hash = crypto.SHA512
+		hash, digest, e := parseDigestInfo(data)
+
+		switch {
+		case e == nil:
+			sig, err = rsa.SignPKCS1v15(rand.Reader, privKey, hash, digest)
+		case card.RawPKCS1:
+			// as INTERNAL AUTHENTICATE the input must not exceed 40%
+			// of the modulus length
+			if len(data) > privKey.Size()*40/100 {
+				return applet.WrongData(), nil
+			}
+
+			sig, err = rsa.SignPKCS1v15(rand.Reader, privKey, crypto.Hash(0), data)
 		default:
-			return WrongData(), nil
+			log.Printf("PSO:COMPUTE DIGITAL SIGNATURE error, %v", e)
+			return applet.WrongData(), nil
 		}
-
-		sig, err = rsa.SignPKCS1v15(rand.Reader, privKey, hash, digest)
 	case *ecdsa.PrivateKey:
-		// OpenPGP uses ECDSA signatures in raw format
-		r, s, e := ecdsa.Sign(rand.Reader, privKey, data)
-
-		if e != nil {
-			err = e
-		} else {
-			// https://tools.ietf.org/html/rfc7518#section-3.4
-			//
-			// "...adds zero-valued high-order padding bits when
-			// needed to round the size up to a multiple of 8 bits;
-			// thus, each 521-bit integer is represented using 528
-			// bits in 66 octets."
-			sig = append(sig, padToKeySize(privKey.PublicKey, r.Bytes())...)
-			sig = append(sig, padToKeySize(privKey.PublicKey, s.Bytes())...)
-		}
+		sig, err = signECDSA(privKey, data)
+	case *eddsa.PrivateKey:
+		sig, err = signEdDSA(privKey, data)
+	case *ed25519.PrivateKey:
+		sig, err = ed25519.Sign(privKey, data)
+	case *ed448.PrivateKey:
+		sig, err = ed448.Sign(privKey, data)
 	default:
 		log.Printf("invalid private key for PSO:COMPUTE DIGITAL SIGNATURE")
 		return CardKeyNotSupported(), nil
@@ -113,73 +128,236 @@ func (card *Interface) ComputeDigitalSignature(data []byte) (rapdu *apdu.RAPDU,
 		return UnrecoverableError(), nil
 	}
 
-	log.Printf("PSO:CDS successful")
 	card.digitalSignatureCounter += 1
 
-	return CommandCompleted(sig), nil
+	if err = card.saveCounters(); err != nil {
+		log.Printf("PSO:COMPUTE DIGITAL SIGNATURE counter error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	log.Printf("PSO:CDS successful")
+
+	return applet.CommandCompleted(sig), nil
+}
+
+// InternalAuthenticate implements
+// p70, 7.2.13 INTERNAL AUTHENTICATE, OpenPGP application Version 3.4.
+//
+// For RSA keys the input is expected to be a DigestInfo, which is signed
+// as-is with PKCS#1 v1.5 padding, for ECDSA keys the input is the hash to be
+// signed. For EdDSA keys the input is the message to be signed.
+//
+// The authentication key is used unless the decryption key is selected with
+// MSE:SET.
+func (card *Interface) InternalAuthenticate(data []byte) (rapdu *apdu.RAPDU, err error) {
+	var sig []byte
+
+	if len(data) == 0 {
+		return applet.WrongData(), nil
+	}
+
+	key := card.authenticationKey()
+	subkey := card.subkey(key)
+
+	if subkey == nil || subkey.PrivateKey == nil {
+		log.Printf("missing private key for INTERNAL AUTHENTICATE")
+		return CardKeyNotSupported(), nil
+	}
+
+	if subkey.PrivateKey.Encrypted {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if !card.userPresence(key) {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	switch privKey := subkey.PrivateKey.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		// the input must not exceed 40% of the modulus length
+		if len(data) > privKey.Size()*40/100 {
+			return applet.WrongData(), nil
+		}
+
+		sig, err = rsa.SignPKCS1v15(rand.Reader, privKey, crypto.Hash(0), data)
+	case *ecdsa.PrivateKey:
+		sig, err = signECDSA(privKey, data)
+	case *eddsa.PrivateKey:
+		sig, err = signEdDSA(privKey, data)
+	case *ed25519.PrivateKey:
+		sig, err = ed25519.Sign(privKey, data)
+	case *ed448.PrivateKey:
+		sig, err = ed448.Sign(privKey, data)
+	default:
+		log.Printf("invalid private key for INTERNAL AUTHENTICATE")
+		return CardKeyNotSupported(), nil
+	}
+
+	if err != nil {
+		log.Printf("INTERNAL AUTHENTICATE error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	log.Printf("INTERNAL AUTHENTICATE successful")
+
+	return applet.CommandCompleted(sig), nil
 }
 
 // Decipher implements
 // p65, 7.2.11 PSO: DECIPHER, OpenPGP application Version 3.4.
+//
+// The decryption key is used unless the authentication key is selected with
+// MSE:SET. Retired decryption keys are also used, when the cryptogram does not
+// match the decryption key algorithm or curve, unless one of them is forced
+// (see SelectRetiredKey).
 func (card *Interface) Decipher(data []byte) (rapdu *apdu.RAPDU, err error) {
-	var plaintext []byte
+	var unlocked []*openpgp.Subkey
 
 	if len(data) < 1 {
-		return WrongData(), nil
+		return applet.WrongData(), nil
 	}
 
 	if data[0] == AES_PADDING {
 		return decipher(data[1:])
 	}
 
-	subkey := card.Dec
+	key := card.decipherKey()
+	subkeys := card.decipherSubkeys(key)
 
-	if subkey == nil || subkey.PrivateKey == nil {
+	if len(subkeys) == 0 {
 		log.Printf("missing private key for PSO:DEC")
 		return CardKeyNotSupported(), nil
 	}
 
-	if subkey.PrivateKey.Encrypted {
-		return SecurityConditionNotSatisfied(), nil
+	for _, subkey := range subkeys {
+		if !subkey.PrivateKey.Encrypted {
+			unlocked = append(unlocked, subkey)
+		}
 	}
 
-	switch privKey := subkey.PrivateKey.PrivateKey.(type) {
+	if len(unlocked) == 0 {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if !card.userPresence(key) {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	for i, subkey := range unlocked {
+		plaintext, e := decrypt(subkey.PrivateKey.PrivateKey, data)
+
+		if e == nil {
+			if subkey != card.subkey(key) {
+				log.Printf("PSO:DEC with retired key % X", subkey.PublicKey.Fingerprint)
+			}
+
+			log.Printf("PSO:DEC successful")
+			return applet.CommandCompleted(plaintext), nil
+		}
+
+		// the first subkey error is reported
+		if i == 0 {
+			err = e
+		}
+	}
+
+	// a locked subkey might have matched
+	if len(unlocked) < len(subkeys) {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	switch {
+	case errors.Is(err, errKeyNotSupported):
+		log.Printf("invalid private key for PSO:DEC")
+		return CardKeyNotSupported(), nil
+	case errors.Is(err, errWrongData):
+		return applet.WrongData(), nil
+	}
+
+	log.Printf("PSO:DEC error, %v", err)
+
+	return UnrecoverableError(), nil
+}
+
+// decrypt performs PSO:DEC with a private key, errKeyNotSupported is returned
+// when the cryptogram does not match the key algorithm while errWrongData is
+// returned when it does not match the key size or curve.
+func decrypt(privateKey any, data []byte) (plaintext []byte, err error) {
+	switch privKey := privateKey.(type) {
 	case *rsa.PrivateKey:
 		if data[0] != RSA_PADDING {
-			log.Printf("invalid private key for PSO:DEC")
-			return CardKeyNotSupported(), nil
+			return nil, errKeyNotSupported
 		}
 
-		plaintext, err = privKey.Decrypt(rand.Reader, data[1:], nil)
+		return privKey.Decrypt(rand.Reader, data[1:], nil)
 	case *ecdh.PrivateKey:
 		if data[0] != DO_CIPHER {
-			log.Printf("invalid private key for PSO:DEC")
-			return CardKeyNotSupported(), nil
+			return nil, errKeyNotSupported
 		}
 
 		// p66, 7.2.11 PSO: DECIPHER, OpenPGP application Version 3.4
-		pubKey := v(v(v(data, DO_CIPHER), DO_PUB_KEY), DO_EXT_PUB_KEY)
+		pubKey, err := bertlv.Find(data, DO_CIPHER, DO_PUB_KEY, DO_EXT_PUB_KEY)
+
+		if err != nil {
+			return nil, errWrongData
+		}
+
+		name := privKey.GetCurve().GetCurveName()
+
+		if size := nativePointSize(name); size > 0 {
+			if pubKey = nativePoint(pubKey, size); pubKey == nil {
+				return nil, errWrongData
+			}
+
+			return privKey.GetCurve().Decaps(pubKey, privKey.D)
+		}
+
 		expectedSize := (len(pubKey) - 1) / 2
 
-		if len(pubKey) < 1 || pubKey[0] != 0x04 || expectedSize*2 != len(pubKey)-1 {
-			return WrongData(), nil
+		if len(pubKey) < 1 || pubKey[0] != 0x04 || expectedSize*2 != len(pubKey)-1 || !validPoint(name, pubKey) {
+			return nil, errWrongData
 		}
 
-		plaintext, err = privKey.GetCurve().Decaps(pubKey, privKey.D)
-		plaintext = append(make([]byte, expectedSize-len(plaintext)), plaintext...)
-	default:
-		log.Printf("invalid private key for PSO:DEC")
-		return CardKeyNotSupported(), nil
-	}
+		if plaintext, err = privKey.GetCurve().Decaps(pubKey, privKey.D); err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		log.Printf("PSO:DEC error, %v", err)
-		return UnrecoverableError(), nil
-	}
+		return append(make([]byte, expectedSize-len(plaintext)), plaintext...), nil
+	case *x25519.PrivateKey:
+		if data[0] != DO_CIPHER {
+			return nil, errKeyNotSupported
+		}
+
+		pubKey, err := bertlv.Find(data, DO_CIPHER, DO_PUB_KEY, DO_EXT_PUB_KEY)
+
+		if err != nil {
+			return nil, errWrongData
+		}
 
-	log.Printf("PSO:DEC successful")
+		if pubKey = nativePoint(pubKey, x25519.KeySize); pubKey == nil {
+			return nil, errWrongData
+		}
+
+		return curve25519.X25519(privKey.Secret, pubKey)
+	case *x448.PrivateKey:
+		if data[0] != DO_CIPHER {
+			return nil, errKeyNotSupported
+		}
+
+		pubKey, err := bertlv.Find(data, DO_CIPHER, DO_PUB_KEY, DO_EXT_PUB_KEY)
+
+		if err != nil {
+			return nil, errWrongData
+		}
+
+		if pubKey = nativePoint(pubKey, x448.KeySize); pubKey == nil {
+			return nil, errWrongData
+		}
 
-	return CommandCompleted(plaintext), nil
+		return sharedX448(privKey.Secret, pubKey)
+	}
+
+	return nil, errKeyNotSupported
 }
 
 // Encipher implements
@@ -190,7 +368,7 @@ func (card *Interface) Encipher(data []byte) (rapdu *apdu.RAPDU, err error) {
 	subkey := card.Dec
 
 	if subkey.PrivateKey.Encrypted {
-		return SecurityConditionNotSatisfied(), nil
+		return applet.SecurityConditionNotSatisfied(), nil
 	}
 
 	if rapdu, err = encipher(data); err == nil {
@@ -200,6 +378,95 @@ func (card *Interface) Encipher(data []byte) (rapdu *apdu.RAPDU, err error) {
 	return
 }
 
+// signECDSA returns an ECDSA signature in the raw format used by OpenPGP
+// cards (r || s).
+func signECDSA(privKey *ecdsa.PrivateKey, hash []byte) (sig []byte, err error) {
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash)
+
+	if err != nil {
+		return
+	}
+
+	// https://tools.ietf.org/html/rfc7518#section-3.4
+	//
+	// "...adds zero-valued high-order padding bits when needed to round
+	// the size up to a multiple of 8 bits; thus, each 521-bit integer is
+	// represented using 528 bits in 66 octets."
+	sig = append(sig, padToKeySize(privKey.PublicKey, r.Bytes())...)
+	sig = append(sig, padToKeySize(privKey.PublicKey, s.Bytes())...)
+
+	return
+}
+
+// signEdDSA returns an EdDSA signature in the native format used by OpenPGP
+// cards (R || S).
+func signEdDSA(privKey *eddsa.PrivateKey, message []byte) (sig []byte, err error) {
+	r, s, err := eddsa.Sign(privKey, message)
+
+	if err != nil {
+		return
+	}
+
+	sig = append(sig, r...)
+	sig = append(sig, s...)
+
+	return
+}
+
+// nativePoint returns a Curve25519/Curve448 public key in native format, the
+// 0x40 prefix used within OpenPGP messages is tolerated.
+func nativePoint(point []byte, size int) []byte {
+	if len(point) == size+1 && point[0] == 0x40 {
+		point = point[1:]
+	}
+
+	if len(point) != size {
+		return nil
+	}
+
+	return point
+}
+
+// validPoint returns whether an SEC1 encoded point lies on a curve.
+func validPoint(name string, point []byte) bool {
+	var curve elliptic.Curve
+
+	switch name {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	case "brainpoolP256r1":
+		curve = brainpool.P256r1()
+	case "brainpoolP384r1":
+		curve = brainpool.P384r1()
+	case "brainpoolP512r1":
+		curve = brainpool.P512r1()
+	default:
+		return false
+	}
+
+	x, _ := elliptic.Unmarshal(curve, point)
+
+	return x != nil
+}
+
+// sharedX448 computes the X448 shared secret (RFC 7748).
+func sharedX448(secret []byte, pubKey []byte) ([]byte, error) {
+	var sk, pk, shared circlx448.Key
+
+	copy(sk[:], secret)
+	copy(pk[:], pubKey)
+
+	if !circlx448.Shared(&shared, &sk, &pk) {
+		return nil, errors.New("invalid public key")
+	}
+
+	return shared[:], nil
+}
+
 // GetChallenge implements
 // p74, 7.2.15 GET CHALLENGE, OpenPGP application Version 3.4.
 func (card *Interface) GetChallenge(n int) (rapdu *apdu.RAPDU, err error) {
@@ -210,7 +477,7 @@ func (card *Interface) GetChallenge(n int) (rapdu *apdu.RAPDU, err error) {
 		return UnrecoverableError(), err
 	}
 
-	return CommandCompleted(buf), nil
+	return applet.CommandCompleted(buf), nil
 }
 
 // Pad implements PKCS7 compliant padding for symmetric AES operation.
@@ -13,6 +13,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 
+	"github.com/usbarmory/GoKey/internal/applet"
+
 	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
 
 	"github.com/hsanjuan/go-nfctype4/apdu"
@@ -28,18 +30,18 @@ func decipher(data []byte) (rapdu *apdu.RAPDU, err error) {
 
 func aesCBC(data []byte, decrypt bool) (rapdu *apdu.RAPDU, err error) {
 	if !imx6ul.SNVS.Available() {
-		return CommandNotAllowed(), nil
+		return applet.CommandNotAllowed(), nil
 	}
 
 	iv := make([]byte, aes.BlockSize)
 	key, err := imx6ul.DCP.DeriveKey(RID, iv, -1)
 
 	if err != nil {
-		return CommandNotAllowed(), nil
+		return applet.CommandNotAllowed(), nil
 	}
 
 	if len(data)%aes.BlockSize != 0 {
-		return WrongData(), nil
+		return applet.WrongData(), nil
 	}
 
 	block, err := aes.NewCipher(key)
@@ -58,5 +60,5 @@ func aesCBC(data []byte, decrypt bool) (rapdu *apdu.RAPDU, err error) {
 
 	mode.CryptBlocks(data, data)
 
-	return CommandCompleted(data), nil
+	return applet.CommandCompleted(data), nil
 }
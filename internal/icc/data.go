@@ -14,9 +14,18 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/ecdh"
 	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/ed448"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/ProtonMail/go-crypto/openpgp/x448"
 	"github.com/hsanjuan/go-nfctype4/apdu"
 )
 
@@ -29,11 +38,12 @@ const (
 	DO_CARDHOLDER_RELATED_DATA     = 0x65
 	DO_APPLICATION_RELATED_DATA    = 0x6e
 	DO_SECURITY_SUPPORT_TEMPLATE   = 0x7a
-	DO_CARDHOLDER_CERTIFICATE      = 0x7f21 // TODO
+	DO_CARDHOLDER_CERTIFICATE      = 0x7f21
 	DO_EXTENDED_LENGTH_INFORMATION = 0x7f66
 	DO_PW_STATUS_BYTES             = 0xc4
 	DO_KEY_INFORMATION             = 0xde
 	DO_ALGORITHM_INFORMATION       = 0xfa
+	DO_KDF                         = 0xf9
 
 	// DOs not directly accessible
 	DO_NAME                       = 0x5b
@@ -48,6 +58,22 @@ const (
 	DO_CA_FINGERPRINTS            = 0xc6
 	DO_GENERATION_EPOCHS          = 0xcd
 	DO_DIGITAL_SIGNATURE_COUNTER  = 0x93
+	DO_GENERAL_FEATURE_MANAGEMENT = 0x7f74
+
+	// p25, 4.4.2 DOs for PUT DATA, OpenPGP application Version 3.4
+	DO_FINGERPRINT_SIG      = 0xc7
+	DO_FINGERPRINT_DEC      = 0xc8
+	DO_FINGERPRINT_AUT      = 0xc9
+	DO_CA_FINGERPRINT_1     = 0xca
+	DO_CA_FINGERPRINT_2     = 0xcb
+	DO_CA_FINGERPRINT_3     = 0xcc
+	DO_GENERATION_EPOCH_SIG = 0xce
+	DO_GENERATION_EPOCH_DEC = 0xcf
+	DO_GENERATION_EPOCH_AUT = 0xd0
+	DO_RESETTING_CODE       = 0xd3
+	DO_UIF_SIG              = 0xd6
+	DO_UIF_DEC              = 0xd7
+	DO_UIF_AUT              = 0xd8
 
 	// p65, 7.2.11 PSO: DECIPHER, OpenPGP application Version 3.4
 	DO_CIPHER = 0xa6
@@ -75,21 +101,29 @@ const (
 	PW1_MAX_LENGTH = 127
 	RC_MAX_LENGTH  = 127
 	PW3_MAX_LENGTH = 127
+
+	// maximum length of command and response APDU data, see
+	// EXTENDED_LENGTH.
+	MAX_APDU_LENGTH = applet.MAX_CHAIN_LENGTH
+
+	// p30, 4.4.3.3 Name, OpenPGP application Version 3.4
+	NAME_MAX_LENGTH = 39
+	// p30, 4.4.3.4 Language preferences, OpenPGP application Version 3.4
+	LANGUAGE_MAX_LENGTH = 8
 )
 
 var (
-	ATR                   []byte
-	HISTORICAL_BYTES      []byte
-	EXTENDED_CAPABILITIES []byte
-	EXTENDED_LENGTH       []byte
+	ATR                        []byte
+	HISTORICAL_BYTES           []byte
+	EXTENDED_CAPABILITIES      []byte
+	EXTENDED_LENGTH            []byte
+	GENERAL_FEATURE_MANAGEMENT []byte
 
 	// p15, 4.2.1 Application Identifier (AID), OpenPGP application Version 3.4
 	RID = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01}
 )
 
 func init() {
-	var tck byte
-
 	// Initialize ATR according to ISO/IEC 7816-4,
 	// https://en.wikipedia.org/wiki/Answer_to_reset.
 	ATR = []byte{
@@ -137,53 +171,58 @@ func init() {
 		//   - Value 'FF' for the first byte of BER-TLV tag fields: valid
 		//   - Data unit in quartets: 1
 		0x01,
-		// Command chaining, length fields and logical channels: 128
+		// Command chaining, length fields and logical channels: 219
 		//   - Command chaining
-		//   - Logical channel number assignment: No logical channel
-		//   - Maximum number of logical channels: 1
-		0x40,
+		//   - Extended Lc and Le fields
+		//   - Logical channel number assignment: by the card and by the
+		//     interface device (see applet.Dispatcher)
+		//   - Maximum number of logical channels: 4
+		0xd8 | (applet.MAX_CHANNELS - 1),
 		// Mandatory status indicator (3 last bytes)
-		//   LCS (life card cycle): 0 (No information given)
+		//   LCS (life card cycle): 5 (Operational state), updated at
+		//   runtime (see LifeCycleStatus)
 		//   SW: 90 00 ()
-		0x00,
+		LCS_OPERATIONAL,
 		0x90,
 		0x00,
 	}
 
 	ATR = append(ATR, HISTORICAL_BYTES...)
-
-	// compute ATR checksum
-	for _, b := range ATR[1:] {
-		tck = tck ^ b
-	}
-
 	// TCK - Checksum
-	ATR = append(ATR, tck)
+	ATR = append(ATR, checksum(ATR))
 
 	// p32, 4.4.3.7 Extended Capabilities, OpenPGP application Version 3.4
 	EXTENDED_CAPABILITIES = []byte{
-		// support GET CHALLENGE, PSO:DEC/ENC with AES
-		0x42,
+		// support GET CHALLENGE, key import, PW1 status change,
+		// algorithm attributes change, private use DOs, PSO:DEC/ENC with
+		// AES, KDF-DO
+		0x7f,
 		// no support for Secure Messaging
 		0x00,
 		// maximum length of GET CHALLENGE
 		0xff, 0xff,
 		// maximum length of Cardholder Certificate
-		0xff, 0xff,
+		byte(CERTIFICATE_MAX_LENGTH >> 8), byte(CERTIFICATE_MAX_LENGTH & 0xff),
 		// maximum length of special DOs
 		0xff, 0xff,
 		// PIN block 2 format not supported
 		0x00,
-		// MSE command for key numbers 2 (DEC) and 3 (AUT) not supported
-		0x00,
+		// MSE command for key numbers 2 (DEC) and 3 (AUT) supported
+		0x01,
 	}
 
 	// p14, 4.1.3.1 Extended length information, OpenPGP application Version 3.4
 	EXTENDED_LENGTH = []byte{
 		// Maximum number of bytes in a command APDU
-		0x02, 0x02, 0x0b, 0xfe,
+		0x02, 0x02, byte(MAX_APDU_LENGTH >> 8), byte(MAX_APDU_LENGTH & 0xff),
 		// Maximum number of bytes in a response APDU
-		0x02, 0x02, 0x0b, 0xfe,
+		0x02, 0x02, byte(MAX_APDU_LENGTH >> 8), byte(MAX_APDU_LENGTH & 0xff),
+	}
+
+	// p15, 4.1.3.2 General Feature Management, OpenPGP application Version 3.4
+	GENERAL_FEATURE_MANAGEMENT = []byte{
+		// Tag: 81, Len: 1 (button)
+		0x81, 0x01, FEATURE_BUTTON,
 	}
 }
 
@@ -203,34 +242,59 @@ func (card *Interface) AID() (aid []byte) {
 	return
 }
 
+// checksum computes the ATR check character (TCK).
+func checksum(atr []byte) (tck byte) {
+	for _, b := range atr[1:] {
+		tck = tck ^ b
+	}
+
+	return
+}
+
 // ATR returns the Answer to reset (ATR) according to ISO/IEC 7816-4.
 func (card *Interface) ATR() (atr []byte) {
-	return ATR
+	atr = bytes.Clone(ATR[:len(ATR)-len(HISTORICAL_BYTES)-1])
+	atr = append(atr, card.HistoricalBytes()...)
+
+	return append(atr, checksum(atr))
+}
+
+// HistoricalBytes returns the historical bytes, with the current life cycle
+// status, according to
+// p44, 6 Historical Byte, OpenPGP application Version 3.4.
+func (card *Interface) HistoricalBytes() (hb []byte) {
+	hb = bytes.Clone(HISTORICAL_BYTES)
+	hb[len(hb)-3] = card.LifeCycleStatus()
+
+	return
 }
 
 // CardholderRelatedData builds and returns Data Object 0x65.
 func (card *Interface) CardholderRelatedData() []byte {
 	data := new(bytes.Buffer)
 
-	data.Write(tlv(DO_NAME, []byte(card.Name)))
-	data.Write(tlv(DO_LANGUAGE, []byte(card.Language)))
-	data.Write(tlv(DO_SEX, []byte(card.Sex)))
+	data.Write(bertlv.Encode(DO_NAME, []byte(card.Name)))
+	data.Write(bertlv.Encode(DO_LANGUAGE, []byte(card.Language)))
+	data.Write(bertlv.Encode(DO_SEX, []byte(card.Sex)))
 
-	return tlv(DO_CARDHOLDER_RELATED_DATA, data.Bytes())
+	return bertlv.Encode(DO_CARDHOLDER_RELATED_DATA, data.Bytes())
 }
 
 // DiscretionaryData builds and returns Data Object 0x73.
 func (card *Interface) DiscretionaryData() []byte {
 	data := new(bytes.Buffer)
 
-	data.Write(tlv(DO_EXTENDED_CAPABILITIES, EXTENDED_CAPABILITIES))
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_SIG, card.AlgorithmAttributes(card.Sig)))
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_DEC, card.AlgorithmAttributes(card.Dec)))
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_AUT, card.AlgorithmAttributes(card.Aut)))
-	data.Write(tlv(DO_PW_STATUS_BYTES, card.PWStatusBytes()))
-	data.Write(tlv(DO_FINGERPRINTS, card.Fingerprints()))
-	data.Write(tlv(DO_CA_FINGERPRINTS, card.CAFingerprints()))
-	data.Write(tlv(DO_GENERATION_EPOCHS, card.GenerationEpochs()))
+	data.Write(bertlv.Encode(DO_EXTENDED_CAPABILITIES, EXTENDED_CAPABILITIES))
+	data.Write(bertlv.Encode(DO_ALGORITHM_ATTRIBUTES_SIG, card.attributes(KEY_SIG)))
+	data.Write(bertlv.Encode(DO_ALGORITHM_ATTRIBUTES_DEC, card.attributes(KEY_DEC)))
+	data.Write(bertlv.Encode(DO_ALGORITHM_ATTRIBUTES_AUT, card.attributes(KEY_AUT)))
+	data.Write(bertlv.Encode(DO_PW_STATUS_BYTES, card.PWStatusBytes()))
+	data.Write(bertlv.Encode(DO_FINGERPRINTS, card.Fingerprints()))
+	data.Write(bertlv.Encode(DO_CA_FINGERPRINTS, card.CAFingerprints()))
+	data.Write(bertlv.Encode(DO_GENERATION_EPOCHS, card.GenerationEpochs()))
+	data.Write(bertlv.Encode(DO_UIF_SIG, card.UIF(KEY_SIG)))
+	data.Write(bertlv.Encode(DO_UIF_DEC, card.UIF(KEY_DEC)))
+	data.Write(bertlv.Encode(DO_UIF_AUT, card.UIF(KEY_AUT)))
 
 	return data.Bytes()
 }
@@ -260,6 +324,28 @@ func (card *Interface) AlgorithmAttributes(subkey *openpgp.Subkey) (data []byte)
 		data = []byte{byte(subkey.PublicKey.PubKeyAlgo)}
 		data = append(data, getOID(pubKey.GetCurve().GetCurveName())...)
 		data = append(data, IMPORT_FORMAT_STANDARD)
+	case *eddsa.PublicKey:
+		data = []byte{byte(subkey.PublicKey.PubKeyAlgo)}
+		data = append(data, getOID(pubKey.GetCurve().GetCurveName())...)
+		data = append(data, IMPORT_FORMAT_STANDARD)
+	// RFC 9580 native key types are reported with their equivalent
+	// legacy algorithm identifiers, understood by card clients.
+	case *ed25519.PublicKey:
+		data = []byte{byte(packet.PubKeyAlgoEdDSA)}
+		data = append(data, getOID(ED25519)...)
+		data = append(data, IMPORT_FORMAT_STANDARD)
+	case *ed448.PublicKey:
+		data = []byte{byte(packet.PubKeyAlgoEdDSA)}
+		data = append(data, getOID(ED448)...)
+		data = append(data, IMPORT_FORMAT_STANDARD)
+	case *x25519.PublicKey:
+		data = []byte{byte(packet.PubKeyAlgoECDH)}
+		data = append(data, getOID(CURVE25519)...)
+		data = append(data, IMPORT_FORMAT_STANDARD)
+	case *x448.PublicKey:
+		data = []byte{byte(packet.PubKeyAlgoECDH)}
+		data = append(data, getOID(X448)...)
+		data = append(data, IMPORT_FORMAT_STANDARD)
 	default:
 		log.Printf("unexpected public key type in DO_ALGORITHM_ATTRIBUTES %T", pubKey)
 	}
@@ -271,8 +357,8 @@ func (card *Interface) AlgorithmAttributes(subkey *openpgp.Subkey) (data []byte)
 func (card *Interface) PWStatusBytes() []byte {
 	status := new(bytes.Buffer)
 
-	// PW1 only valid for one PSO:CDS command
-	status.WriteByte(PW1_CDS_MULTI)
+	// PW1 validity for PSO:CDS commands
+	status.WriteByte(card.pw1Status)
 	// max. length of PW1 (user), UTF-8 or derived password
 	status.WriteByte((PW1_MAX_LENGTH << 1) & 0b11111110)
 	// max. length of Resetting Code (RC) for PW1
@@ -291,53 +377,63 @@ func (card *Interface) PWStatusBytes() []byte {
 }
 
 // Fingerprints collects card OpenPGP subkey fingerprints and returns them in
-// Data Object 0xC5.
+// Data Object 0xC5, version 6 key fingerprints are truncated to their leftmost
+// 20 bytes. Fingerprints set with PUT DATA take precedence.
 func (card *Interface) Fingerprints() (fingerprints []byte) {
-	fingerprints = make([]byte, 60)
+	fingerprints = make([]byte, 3*FINGERPRINT_SIZE)
 	subkeys := []*openpgp.Subkey{card.Sig, card.Dec, card.Aut}
 
 	for i, subkey := range subkeys {
+		if fp := card.slots[i].Fingerprint; len(fp) > 0 {
+			copy(fingerprints[i*FINGERPRINT_SIZE:], fp)
+			continue
+		}
+
 		if subkey == nil {
 			continue
 		}
 
-		copy(fingerprints[i*20:], subkey.PublicKey.Fingerprint[:])
+		copy(fingerprints[i*FINGERPRINT_SIZE:], truncateFingerprint(subkey.PublicKey.Fingerprint))
 	}
 
 	return
 }
 
 // CAFingerprints collects card OpenPGP CA fingerprints and returns them in
-// Data Object 0xC6. Currently unused (always empty).
+// Data Object 0xC6, fingerprints set with PUT DATA take precedence.
 func (card *Interface) CAFingerprints() (fingerprints []byte) {
-	fingerprints = make([]byte, 60)
+	fingerprints = make([]byte, 3*FINGERPRINT_SIZE)
+
+	if len(card.caFingerprints) > 0 {
+		copy(fingerprints, card.caFingerprints)
+		return
+	}
 
 	for i, ca := range card.CA {
-		if ca == nil {
+		if ca == nil || i > 2 {
 			continue
 		}
 
-		copy(fingerprints[i*20:], ca.PrimaryKey.Fingerprint[:])
+		copy(fingerprints[i*FINGERPRINT_SIZE:], truncateFingerprint(ca.PrimaryKey.Fingerprint))
 	}
 
 	return
 }
 
 // GenerationEpochs collects card OpenPGP creation times and returns them in
-// Data Object 0xCD.
+// Data Object 0xCD, generation times set with PUT DATA take precedence.
 func (card *Interface) GenerationEpochs() (epochs []byte) {
 	epochs = make([]byte, 12)
+	subkeys := []*openpgp.Subkey{card.Sig, card.Dec, card.Aut}
 
-	if card.Sig != nil {
-		binary.BigEndian.PutUint32(epochs, uint32(card.Sig.PublicKey.CreationTime.Unix()))
-	}
+	for i, subkey := range subkeys {
+		epoch := card.slots[i].Epoch
 
-	if card.Dec != nil {
-		binary.BigEndian.PutUint32(epochs[4:], uint32(card.Dec.PublicKey.CreationTime.Unix()))
-	}
+		if epoch == 0 && subkey != nil {
+			epoch = uint32(subkey.PublicKey.CreationTime.Unix())
+		}
 
-	if card.Aut != nil {
-		binary.BigEndian.PutUint32(epochs[8:], uint32(card.Aut.PublicKey.CreationTime.Unix()))
+		binary.BigEndian.PutUint32(epochs[i*4:], epoch)
 	}
 
 	return
@@ -346,33 +442,34 @@ func (card *Interface) GenerationEpochs() (epochs []byte) {
 // KeyInformation implements
 // p33, 4.4.3.8 Key Information, OpenPGP application Version 3.4.
 //
-// This information is required for Yubico OpenPGP attestation, this
-// implementation doesn't (yet) support this feature as its usefulness is
-// questionable. Therefore we just flag all keys as imported (which also
-// happens to be the only allowed mechanism for now).
-func (card *Interface) KeyInformation() []byte {
-	return []byte{
-		KEY_SIG, KEY_IMPORTED,
-		KEY_DEC, KEY_IMPORTED,
-		KEY_AUT, KEY_IMPORTED,
+// Keys generated on card are flagged as such, while bundled keys are flagged
+// as imported.
+func (card *Interface) KeyInformation() (info []byte) {
+	for _, key := range []byte{KEY_SIG, KEY_DEC, KEY_AUT} {
+		status := card.slot(key).Status
+
+		if status == KEY_NOT_PRESENT && card.subkey(key) != nil {
+			status = KEY_IMPORTED
+		}
+
+		info = append(info, key, status)
 	}
+
+	return
 }
 
 // AlgorithmInformation implements
 // p37, 4.4.3.11 Algorithm Information, OpenPGP application Version 3.4.
 //
-// The standard is ambiguous on whether this DO needs to be present if
-// algorithm attributes cannot be changed, the DO table suggests this
-// is mandatory but the DO description suggests otherwise.
-//
-// Given that this implementation does not allow changes, the imported key
-// attributes are returned.
+// The algorithm attributes supported for key generation are returned.
 func (card *Interface) AlgorithmInformation() []byte {
 	data := new(bytes.Buffer)
 
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_SIG, card.AlgorithmAttributes(card.Sig)))
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_DEC, card.AlgorithmAttributes(card.Dec)))
-	data.Write(tlv(DO_ALGORITHM_ATTRIBUTES_AUT, card.AlgorithmAttributes(card.Aut)))
+	for i, key := range []byte{KEY_SIG, KEY_DEC, KEY_AUT} {
+		for _, attributes := range supportedAttributes(key) {
+			data.Write(bertlv.Encode(bertlv.Tag(DO_ALGORITHM_ATTRIBUTES_SIG+i), attributes))
+		}
+	}
 
 	return data.Bytes()
 }
@@ -390,8 +487,8 @@ func (card *Interface) DigitalSignatureCounter() []byte {
 
 // SecuritySupportTemplate builds and returns Data Object 0x7A.
 func (card *Interface) SecuritySupportTemplate() []byte {
-	data := tlv(DO_DIGITAL_SIGNATURE_COUNTER, card.DigitalSignatureCounter())
-	return tlv(DO_SECURITY_SUPPORT_TEMPLATE, data)
+	data := bertlv.Encode(DO_DIGITAL_SIGNATURE_COUNTER, card.DigitalSignatureCounter())
+	return bertlv.Encode(DO_SECURITY_SUPPORT_TEMPLATE, data)
 }
 
 // ApplicationRelatedData implements
@@ -399,18 +496,19 @@ func (card *Interface) SecuritySupportTemplate() []byte {
 func (card *Interface) ApplicationRelatedData() []byte {
 	data := new(bytes.Buffer)
 
-	data.Write(tlv(DO_APPLICATION_IDENTIFIER, card.AID()))
-	data.Write(tlv(DO_HISTORICAL_BYTES, HISTORICAL_BYTES))
-	data.Write(tlv(DO_EXTENDED_LENGTH_INFORMATION, EXTENDED_LENGTH))
-	data.Write(tlv(DO_DISCRETIONARY_DATA_OBJECTS, card.DiscretionaryData()))
+	data.Write(bertlv.Encode(DO_APPLICATION_IDENTIFIER, card.AID()))
+	data.Write(bertlv.Encode(DO_HISTORICAL_BYTES, card.HistoricalBytes()))
+	data.Write(bertlv.Encode(DO_EXTENDED_LENGTH_INFORMATION, EXTENDED_LENGTH))
+	data.Write(bertlv.Encode(DO_GENERAL_FEATURE_MANAGEMENT, GENERAL_FEATURE_MANAGEMENT))
+	data.Write(bertlv.Encode(DO_DISCRETIONARY_DATA_OBJECTS, card.DiscretionaryData()))
 
-	return tlv(DO_APPLICATION_RELATED_DATA, data.Bytes())
+	return bertlv.Encode(DO_APPLICATION_RELATED_DATA, data.Bytes())
 }
 
 // GetData implements
 // p57, 7.2.6 GET DATA, OpenPGP application Version 3.4.
 func (card *Interface) GetData(tag uint16) (rapdu *apdu.RAPDU, err error) {
-	rapdu = CommandCompleted(nil)
+	rapdu = applet.CommandCompleted(nil)
 
 	// p22, 4.4.1 DOs for GET DATA, OpenPGP application Version 3.4
 	switch tag {
@@ -421,7 +519,7 @@ func (card *Interface) GetData(tag uint16) (rapdu *apdu.RAPDU, err error) {
 	case DO_URL:
 		rapdu.ResponseBody = []byte(card.URL)
 	case DO_HISTORICAL_BYTES:
-		rapdu.ResponseBody = HISTORICAL_BYTES
+		rapdu.ResponseBody = card.HistoricalBytes()
 	case DO_CARDHOLDER_RELATED_DATA:
 		rapdu.ResponseBody = card.CardholderRelatedData()
 	case DO_APPLICATION_RELATED_DATA:
@@ -430,15 +528,28 @@ func (card *Interface) GetData(tag uint16) (rapdu *apdu.RAPDU, err error) {
 		rapdu.ResponseBody = card.SecuritySupportTemplate()
 	case DO_EXTENDED_LENGTH_INFORMATION:
 		rapdu.ResponseBody = EXTENDED_LENGTH
+	case DO_GENERAL_FEATURE_MANAGEMENT:
+		rapdu.ResponseBody = GENERAL_FEATURE_MANAGEMENT
+	case DO_UIF_SIG, DO_UIF_DEC, DO_UIF_AUT:
+		rapdu.ResponseBody = card.UIF(byte(tag-DO_UIF_SIG) + KEY_SIG)
 	case DO_PW_STATUS_BYTES:
 		rapdu.ResponseBody = card.PWStatusBytes()
 	case DO_KEY_INFORMATION:
 		rapdu.ResponseBody = card.KeyInformation()
 	case DO_ALGORITHM_INFORMATION:
 		rapdu.ResponseBody = card.AlgorithmInformation()
+	case DO_KDF:
+		rapdu.ResponseBody = card.KDF()
+	case DO_ATTESTATION_CERTIFICATE:
+		if rapdu.ResponseBody = card.AttestationCertificate(); rapdu.ResponseBody == nil {
+			rapdu = applet.ReferencedDataNotFound()
+		}
+	case DO_PRIVATE_USE_1, DO_PRIVATE_USE_2, DO_PRIVATE_USE_3, DO_PRIVATE_USE_4:
+		rapdu = card.PrivateData(tag)
+	case DO_CARDHOLDER_CERTIFICATE:
+		rapdu.ResponseBody = card.Certificate(card.certificate)
 	default:
-		rapdu.SW1 = 0x6a
-		rapdu.SW1 = 0x88
+		rapdu = applet.ReferencedDataNotFound()
 		log.Printf("unsupported DO tag %x", tag)
 	}
 
@@ -448,58 +559,164 @@ func (card *Interface) GetData(tag uint16) (rapdu *apdu.RAPDU, err error) {
 // PutData implements
 // p60, 7.2.8 PUT DATA, OpenPGP application Version 3.4.
 //
-// This is not implemented (always returns command not allowed) as card
-// personalization is managed outside OpenPGP specifications and the PW3 PIN
-// (required for this command) is not supported.
-func (card *Interface) PutData(tag uint16) (rapdu *apdu.RAPDU, err error) {
-	return CommandNotAllowed(), nil
+// Only cardholder related Data Objects, cardholder certificates, key
+// attributes, fingerprints, generation times and User Interaction Flags, CA
+// fingerprints, the resetting code and the PW1 status byte can be changed,
+// after verification of the admin PIN (PW3). Changes are kept on persistent
+// storage, with the exception of the PW1 status byte.
+//
+// Private use Data Objects are subject to their own access conditions (see
+// putPrivateData).
+func (card *Interface) PutData(tag uint16, data []byte) (rapdu *apdu.RAPDU, err error) {
+	switch tag {
+	case DO_PRIVATE_USE_1, DO_PRIVATE_USE_2, DO_PRIVATE_USE_3, DO_PRIVATE_USE_4:
+		return card.putPrivateData(tag, data), nil
+	}
+
+	if !card.adminVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	switch tag {
+	case DO_CARDHOLDER_CERTIFICATE:
+		return card.putCertificate(data), nil
+	case DO_RESETTING_CODE:
+		return card.putResettingCode(data), nil
+	case DO_KDF:
+		// KDF requires the key passphrase and is therefore only
+		// configured over the management interface (see SetKDF), the
+		// KDF-DO is nonetheless advertised in Extended Capabilities as
+		// hosts only read it, to hash PINs, when present.
+		log.Printf("PUT DATA: KDF can only be configured over SSH")
+		return applet.ConditionsNotSatisfied(), nil
+	case DO_PW_STATUS_BYTES:
+		if len(data) != 1 || data[0] > 0x01 {
+			return applet.WrongData(), nil
+		}
+
+		card.pw1Status = data[0]
+
+		return applet.CommandCompleted(nil), nil
+	case DO_ALGORITHM_ATTRIBUTES_SIG, DO_ALGORITHM_ATTRIBUTES_DEC, DO_ALGORITHM_ATTRIBUTES_AUT,
+		DO_FINGERPRINT_SIG, DO_FINGERPRINT_DEC, DO_FINGERPRINT_AUT,
+		DO_GENERATION_EPOCH_SIG, DO_GENERATION_EPOCH_DEC, DO_GENERATION_EPOCH_AUT,
+		DO_UIF_SIG, DO_UIF_DEC, DO_UIF_AUT:
+		return card.putKeyData(tag, data), nil
+	}
+
+	cd := card.cardholderData()
+
+	// p25, 4.4.2 DOs for PUT DATA, OpenPGP application Version 3.4
+	switch tag {
+	case DO_NAME:
+		if len(data) > NAME_MAX_LENGTH {
+			return applet.WrongData(), nil
+		}
+
+		cd.Name = string(data)
+	case DO_LANGUAGE:
+		if len(data) > LANGUAGE_MAX_LENGTH {
+			return applet.WrongData(), nil
+		}
+
+		cd.Language = string(data)
+	case DO_SEX:
+		if len(data) > 1 {
+			return applet.WrongData(), nil
+		}
+
+		cd.Sex = string(data)
+	case DO_URL:
+		cd.URL = string(data)
+	case DO_LOGIN_DATA:
+		cd.LoginData = data
+	case DO_CA_FINGERPRINTS:
+		if len(data) != 3*FINGERPRINT_SIZE {
+			return applet.WrongData(), nil
+		}
+
+		cd.CAFingerprints = data
+	case DO_CA_FINGERPRINT_1, DO_CA_FINGERPRINT_2, DO_CA_FINGERPRINT_3:
+		if len(data) != FINGERPRINT_SIZE {
+			return applet.WrongData(), nil
+		}
+
+		fingerprints := card.CAFingerprints()
+		copy(fingerprints[int(tag-DO_CA_FINGERPRINT_1)*FINGERPRINT_SIZE:], data)
+		cd.CAFingerprints = fingerprints
+	default:
+		log.Printf("unsupported PUT DATA tag %x", tag)
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	if err = card.save(STORE_CARDHOLDER, cd); err != nil {
+		log.Printf("PUT DATA error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.setCardholderData(cd)
+
+	return applet.CommandCompleted(nil), nil
 }
 
 // GenerateAsymmetricKeyPair implements
 // p72, 7.2.14 GENERATE ASYMMETRIC KEY PAIR, OpenPGP application Version 3.4.
 //
-// Generation of key pair is not implemented as card personalization is managed
-// outside OpenPGP specifications and the PW3 PIN (required for this mode) is
-// not  supported.
-//
-// Therefore this command can only be used to read public key templates.
+// Generation of key pair requires verification of the admin PIN (PW3), the
+// generated key replaces any bundled one, it is kept on persistent storage
+// and protected with DEFAULT_PW1, or with the PW1 set with CHANGE REFERENCE
+// DATA which must then also be verified.
 func (card *Interface) GenerateAsymmetricKeyPair(params uint16, crt []byte) (rapdu *apdu.RAPDU, err error) {
-	var subkey *openpgp.Subkey
+	var key byte
 
-	rapdu = CommandNotAllowed()
-
-	switch params {
-	case 0x8000:
-		// Generation of key pair.
-		//
-		// Not implemented as card personalization is managed outside
-		// OpenPGP specifications and therefore PW3 PIN is not
-		// supported.
-		return
-	case 0x8100:
-		// Reading of actual public key template.
-	default:
-		log.Printf("unsupported GENERATE parameters %x", params)
-		return
-	}
+	rapdu = applet.CommandNotAllowed()
 
 	switch {
 	case bytes.Equal(crt, []byte{0xb6, 0x00}), bytes.Equal(crt, []byte{0xb6, 0x03, 0x84, 0x01, 0x01}):
 		// Digital signature
-		subkey = card.Sig
+		key = KEY_SIG
 	case bytes.Equal(crt, []byte{0xb8, 0x00}), bytes.Equal(crt, []byte{0xb8, 0x03, 0x84, 0x01, 0x02}):
 		// Confidentiality
-		subkey = card.Dec
+		key = KEY_DEC
 	case bytes.Equal(crt, []byte{0xa4, 0x00}), bytes.Equal(crt, []byte{0xa4, 0x03, 0x84, 0x01, 0x03}):
 		// Authentication
-		subkey = card.Aut
+		key = KEY_AUT
 	default:
 		log.Printf("unsupported GENERATE CRT %x", crt)
 		return
 	}
 
+	switch params {
+	case 0x8000:
+		// Generation of key pair.
+		if !card.adminVerified {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		if _, err = card.keyPassphrase(); err != nil {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		LED("white", true)
+		defer LED("white", false)
+
+		if err = card.generate(key); err != nil {
+			log.Printf("GENERATE error, %v", err)
+			return UnrecoverableError(), nil
+		}
+
+		card.signalVerificationStatus()
+	case 0x8100:
+		// Reading of actual public key template.
+	default:
+		log.Printf("unsupported GENERATE parameters %x", params)
+		return
+	}
+
+	subkey := card.subkey(key)
+
 	if subkey == nil {
-		return ReferencedDataNotFound(), nil
+		return applet.ReferencedDataNotFound(), nil
 	}
 
 	data := new(bytes.Buffer)
@@ -510,18 +727,35 @@ func (card *Interface) GenerateAsymmetricKeyPair(params uint16, crt []byte) (rap
 		exp := make([]byte, 4)
 		binary.BigEndian.PutUint32(exp, uint32(pubKey.E))
 
-		data.Write(tlv(DO_RSA_MOD, mod))
-		data.Write(tlv(DO_RSA_EXP, exp))
+		data.Write(bertlv.Encode(DO_RSA_MOD, mod))
+		data.Write(bertlv.Encode(DO_RSA_EXP, exp))
 	case *ecdsa.PublicKey:
 		pp := pubKey.MarshalPoint()
-		data.Write(tlv(DO_EXT_PUB_KEY, pp))
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pp))
 	case *ecdh.PublicKey:
 		pp := pubKey.MarshalPoint()
-		data.Write(tlv(DO_EXT_PUB_KEY, pp))
+
+		// Curve25519/Curve448 points are returned in native format
+		if nativePointSize(pubKey.GetCurve().GetCurveName()) > 0 {
+			pp = pubKey.Point
+		}
+
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pp))
+	case *eddsa.PublicKey:
+		// Ed25519 points are returned in native format
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pubKey.X))
+	case *ed25519.PublicKey:
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pubKey.Point))
+	case *ed448.PublicKey:
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pubKey.Point))
+	case *x25519.PublicKey:
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pubKey.Point))
+	case *x448.PublicKey:
+		data.Write(bertlv.Encode(DO_EXT_PUB_KEY, pubKey.Point))
 	default:
 		err = fmt.Errorf("unexpected public key type in GENERATE %T", pubKey)
 		return
 	}
 
-	return CommandCompleted(tlv(DO_PUB_KEY, data.Bytes())), nil
+	return applet.CommandCompleted(bertlv.Encode(DO_PUB_KEY, data.Bytes())), nil
 }
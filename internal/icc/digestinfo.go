@@ -0,0 +1,77 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// RFC8017 - A.2.4 Signature Scheme with Appendix, hash algorithm identifiers
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, crypto.SHA1},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 4}, crypto.SHA224},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 5}, crypto.SHA512_224},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 6}, crypto.SHA512_256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 7}, crypto.SHA3_224},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 8}, crypto.SHA3_256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 9}, crypto.SHA3_384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 10}, crypto.SHA3_512},
+}
+
+// digestInfo represents the DigestInfo structure of RSASSA-PKCS1-v1_5
+// signatures (RFC8017 - 9.2 EMSA-PKCS1-v1_5).
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// parseDigestInfo parses a DER encoded DigestInfo and returns the digest and
+// its hash algorithm, the algorithm must match the digest length.
+func parseDigestInfo(data []byte) (hash crypto.Hash, digest []byte, err error) {
+	var di digestInfo
+
+	rest, err := asn1.Unmarshal(data, &di)
+
+	if err != nil {
+		return
+	}
+
+	if len(rest) != 0 {
+		return 0, nil, errors.New("trailing data after DigestInfo")
+	}
+
+	// parameters must be absent or NULL
+	if params := di.Algorithm.Parameters.FullBytes; len(params) != 0 && !bytes.Equal(params, asn1.NullBytes) {
+		return 0, nil, errors.New("invalid DigestInfo parameters")
+	}
+
+	for _, alg := range digestAlgorithms {
+		if !alg.oid.Equal(di.Algorithm.Algorithm) {
+			continue
+		}
+
+		if len(di.Digest) != alg.hash.Size() {
+			return 0, nil, fmt.Errorf("invalid %s digest length", alg.hash)
+		}
+
+		return alg.hash, di.Digest, nil
+	}
+
+	return 0, nil, fmt.Errorf("unsupported DigestInfo algorithm %s", di.Algorithm.Algorithm)
+}
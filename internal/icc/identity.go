@@ -0,0 +1,237 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// MAX_IDENTITIES is the number of OpenPGP identities, either bundled or
+// imported on card, which can be selected at runtime.
+const MAX_IDENTITIES = 4
+
+// identity represents an OpenPGP identity, its keys are exposed by the card
+// while the identity is active.
+type identity struct {
+	// Secret key
+	Key *openpgp.Entity
+	// Signature subkey
+	Sig *openpgp.Subkey
+	// Decryption subkey
+	Dec *openpgp.Subkey
+	// Authentication subkey
+	Aut *openpgp.Subkey
+
+	// encrypted private key caches for PW_LOCK
+	sig packet.PrivateKey
+	dec packet.PrivateKey
+	aut packet.PrivateKey
+	// subkeys unlocked with VERIFY commands, locked on deselection
+	verified []*openpgp.Subkey
+
+	// persistent state of signature, decryption and authentication keys
+	slots [3]keySlot
+	// verifier of the passphrase protecting keys generated or imported on
+	// card, nil when DEFAULT_PW1, and the passphrase itself once verified
+	pw1           *applet.PINVerifier
+	pw1Passphrase []byte
+	// cardholder certificates (AUT, DEC, SIG)
+	certificates [3][]byte
+
+	// retired decryption subkeys and the one forced for PSO:DEC, if any
+	// (numbered from 1)
+	retired         []*retiredKey
+	retiredOverride int
+}
+
+// identitySelection represents the persistent selection of the active
+// identity.
+type identitySelection struct {
+	Active int
+}
+
+// identityEntry returns the persistent storage entry name for data of an
+// identity, the first identity uses the plain entry name.
+func identityEntry(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%s-%d", name, n)
+}
+
+// entry returns the persistent storage entry name for data of the active
+// identity.
+func (card *Interface) entry(name string) string {
+	return identityEntry(name, card.active)
+}
+
+// armoredKey returns the bundled secret key of an identity, if any.
+func (card *Interface) armoredKey(n int) []byte {
+	switch {
+	case n == 0:
+		return card.ArmoredKey
+	case n <= len(card.ArmoredKeys):
+		return card.ArmoredKeys[n-1]
+	}
+
+	return nil
+}
+
+// bundledKeys returns whether any identity has a bundled secret key.
+func (card *Interface) bundledKeys() bool {
+	for n := range card.identities {
+		if len(card.armoredKey(n)) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// switchIdentity makes an identity active, the state of the previously active
+// one (including its passphrase lock state) is retained.
+func (card *Interface) switchIdentity(n int) {
+	card.identities[card.active] = card.identity
+	card.identity = card.identities[n]
+	card.active = n
+}
+
+// loadIdentities loads bundled keys and persistent key state of all
+// identities, the selected identity is then made active.
+func (card *Interface) loadIdentities() (err error) {
+	if len(card.ArmoredKeys) >= MAX_IDENTITIES {
+		return fmt.Errorf("too many bundled keys (max %d)", MAX_IDENTITIES)
+	}
+
+	for n := range card.identities {
+		card.switchIdentity(n)
+
+		// bundled keys are optional when generated on card
+		if armoredKey := card.armoredKey(n); len(armoredKey) > 0 {
+			if err = card.decodeKey(armoredKey); err != nil {
+				return
+			}
+		}
+
+		if err = card.loadKeys(); err != nil {
+			return fmt.Errorf("OpenPGP key loading failed (identity %d), %v", n, err)
+		}
+
+		if err = card.loadPW1(); err != nil {
+			return fmt.Errorf("OpenPGP PW1 loading failed (identity %d), %v", n, err)
+		}
+
+		if err = card.loadRetiredKeys(); err != nil {
+			return fmt.Errorf("OpenPGP retired key loading failed (identity %d), %v", n, err)
+		}
+
+		if err = card.loadCertificates(); err != nil {
+			return fmt.Errorf("OpenPGP certificate loading failed (identity %d), %v", n, err)
+		}
+	}
+
+	selection := &identitySelection{}
+
+	if err = card.load(STORE_IDENTITY, selection); err != nil {
+		return fmt.Errorf("OpenPGP identity loading failed, %v", err)
+	}
+
+	if selection.Active < 0 || selection.Active >= MAX_IDENTITIES {
+		return fmt.Errorf("invalid identity %d", selection.Active)
+	}
+
+	card.switchIdentity(selection.Active)
+
+	return
+}
+
+// SelectIdentity makes an identity active, card keys, fingerprints, algorithm
+// attributes, cardholder certificates and PKCS#11 objects follow the active
+// identity.
+//
+// The passphrase lock state is tracked for each identity, therefore switching
+// identity does not lock or unlock any key. The selection is retained on
+// persistent storage when available.
+func (card *Interface) SelectIdentity(n int) (err error) {
+	if !card.initialized {
+		return errors.New("card not initialized")
+	}
+
+	if card.terminated {
+		return errors.New("card terminated")
+	}
+
+	if n < 0 || n >= MAX_IDENTITIES {
+		return fmt.Errorf("invalid identity, must be between 0 and %d", MAX_IDENTITIES-1)
+	}
+
+	if card.Storage != nil {
+		if err = card.save(STORE_IDENTITY, &identitySelection{Active: n}); err != nil {
+			return
+		}
+	}
+
+	card.switchIdentity(n)
+
+	card.certificate = CERTIFICATE_AUT
+	card.defaultVerified = false
+	card.resetSecurityEnvironment()
+	card.signalVerificationStatus()
+
+	log.Printf("OpenPGP identity %d selected", n)
+
+	return
+}
+
+// Identities returns the available identities in textual format.
+func (card *Interface) Identities() string {
+	var status bytes.Buffer
+
+	r := regexp.MustCompile(`([[:xdigit:]]{4})`)
+
+	fmt.Fprintf(&status, "--------------------------------------------------- OpenPGP identities ----\n")
+
+	for n := range card.identities {
+		id := &card.identities[n]
+
+		if n == card.active {
+			id = &card.identity
+		}
+
+		var desc string
+
+		switch {
+		case id.Key != nil:
+			fp := fmt.Sprintf("%X", id.Key.PrimaryKey.Fingerprint)
+			desc = strings.TrimSpace(r.ReplaceAllString(fp, "$1 "))
+		case len(presentSubkeys([]*openpgp.Subkey{id.Sig, id.Dec, id.Aut})) > 0:
+			desc = "keys on card"
+		default:
+			desc = "empty"
+		}
+
+		if n == card.active {
+			desc += " (active)"
+		}
+
+		fmt.Fprintf(&status, "Identity %d .............: %s\n", n, desc)
+	}
+
+	return status.String()
+}
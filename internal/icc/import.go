@@ -0,0 +1,408 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	stded25519 "crypto/ed25519"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/ed448"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/ProtonMail/go-crypto/openpgp/x448"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+	"golang.org/x/crypto/curve25519"
+
+	circlx448 "github.com/cloudflare/circl/dh/x448"
+	circled448 "github.com/cloudflare/circl/sign/ed448"
+)
+
+const (
+	// p38, 4.4.3.12 Private Key Template, OpenPGP application Version 3.4
+	DO_EXTENDED_HEADER_LIST       = 0x4d
+	DO_PRIVATE_KEY_TEMPLATE       = 0x7f48
+	DO_PRIVATE_KEY_DATA           = 0x5f48
+	DO_RSA_PUBLIC_EXPONENT        = 0x91
+	DO_RSA_PRIME_P                = 0x92
+	DO_RSA_PRIME_Q                = 0x93
+	DO_ECC_PRIVATE_KEY            = 0x92
+	DO_ECC_PUBLIC_KEY             = 0x99
+	PUT_DATA_EXTENDED_HEADER_LIST = 0x3fff
+)
+
+// parseExtendedHeaderList parses the Extended Header list (DO 0x4D) returning
+// the addressed key and a map of key components.
+func parseExtendedHeaderList(data []byte) (key byte, components map[bertlv.Tag][]byte, err error) {
+	t, ehl, _, err := bertlv.Next(data)
+
+	if err != nil {
+		return
+	}
+
+	if t != DO_EXTENDED_HEADER_LIST {
+		return 0, nil, fmt.Errorf("unexpected tag %x", t)
+	}
+
+	// Control Reference Template
+	t, crt, ehl, err := bertlv.Next(ehl)
+
+	if err != nil {
+		return
+	}
+
+	switch {
+	case t == 0xb6 && (len(crt) == 0 || bytes.Equal(crt, []byte{0x84, 0x01, 0x01})):
+		key = KEY_SIG
+	case t == 0xb8 && (len(crt) == 0 || bytes.Equal(crt, []byte{0x84, 0x01, 0x02})):
+		key = KEY_DEC
+	case t == 0xa4 && (len(crt) == 0 || bytes.Equal(crt, []byte{0x84, 0x01, 0x03})):
+		key = KEY_AUT
+	default:
+		return 0, nil, fmt.Errorf("unsupported CRT %x %x", t, crt)
+	}
+
+	t, template, ehl, err := bertlv.Next(ehl)
+
+	if err != nil {
+		return
+	}
+
+	if t != DO_PRIVATE_KEY_TEMPLATE {
+		return 0, nil, fmt.Errorf("unexpected tag %x", t)
+	}
+
+	t, keyData, _, err := bertlv.Next(ehl)
+
+	if err != nil {
+		return
+	}
+
+	if t != DO_PRIVATE_KEY_DATA {
+		return 0, nil, fmt.Errorf("unexpected tag %x", t)
+	}
+
+	components = make(map[bertlv.Tag][]byte)
+
+	// the template lists tag and length of each component, whose values
+	// are concatenated in the key data
+	for len(template) > 0 {
+		t, l, off, err := bertlv.Header(template)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if len(keyData) < l {
+			return 0, nil, errors.New("key data too short")
+		}
+
+		components[t] = keyData[:l]
+		keyData = keyData[l:]
+		template = template[off:]
+	}
+
+	return
+}
+
+// leftPad returns a big-endian integer of the given size.
+func leftPad(buf []byte, size int) []byte {
+	if len(buf) >= size {
+		return buf
+	}
+
+	return append(make([]byte, size-len(buf)), buf...)
+}
+
+func reverse(buf []byte) (r []byte) {
+	r = make([]byte, len(buf))
+
+	for i, b := range buf {
+		r[len(buf)-1-i] = b
+	}
+
+	return
+}
+
+// mpi returns the OpenPGP Multiprecision Integer encoding of a big-endian
+// integer.
+func mpi(buf []byte) []byte {
+	n := new(big.Int).SetBytes(buf)
+	b := n.Bytes()
+
+	return append([]byte{byte(n.BitLen() >> 8), byte(n.BitLen())}, b...)
+}
+
+// importRSA builds an RSA private key from its public exponent and primes
+// (standard import format).
+func importRSA(components map[bertlv.Tag][]byte) (priv *rsa.PrivateKey, err error) {
+	e := new(big.Int).SetBytes(components[DO_RSA_PUBLIC_EXPONENT])
+	p := new(big.Int).SetBytes(components[DO_RSA_PRIME_P])
+	q := new(big.Int).SetBytes(components[DO_RSA_PRIME_Q])
+
+	if !e.IsInt64() || e.Sign() <= 0 || p.Sign() <= 0 || q.Sign() <= 0 {
+		return nil, errors.New("invalid RSA components")
+	}
+
+	one := big.NewInt(1)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+
+	priv = &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: new(big.Int).Mul(p, q),
+			E: int(e.Int64()),
+		},
+		D:      new(big.Int).ModInverse(e, phi),
+		Primes: []*big.Int{p, q},
+	}
+
+	if priv.D == nil {
+		return nil, errors.New("invalid RSA exponent")
+	}
+
+	if err = priv.Validate(); err != nil {
+		return
+	}
+
+	priv.Precompute()
+
+	return
+}
+
+// importSEC1 builds an ECDSA or ECDH private key, for SEC1 encoded curves, by
+// parsing an unencrypted OpenPGP secret key packet as ProtonMail go-crypto
+// does not allow their direct instantiation.
+func importSEC1(algo packet.PublicKeyAlgorithm, name string, d []byte, point []byte, creationTime time.Time) (privateKey *packet.PrivateKey, err error) {
+	if len(point) == 0 {
+		var curve ecdh.Curve
+		var size int
+
+		switch name {
+		case "P-256":
+			curve, size = ecdh.P256(), 32
+		case "P-384":
+			curve, size = ecdh.P384(), 48
+		case "P-521":
+			curve, size = ecdh.P521(), 66
+		default:
+			return nil, fmt.Errorf("missing public key for %s", name)
+		}
+
+		priv, err := curve.NewPrivateKey(leftPad(d, size))
+
+		if err != nil {
+			return nil, err
+		}
+
+		point = priv.PublicKey().Bytes()
+	}
+
+	body := new(bytes.Buffer)
+
+	// RFC 4880 - 5.5.2. Public-Key Packet Formats
+	body.WriteByte(4)
+	_ = binary.Write(body, binary.BigEndian, uint32(creationTime.Unix()))
+	body.WriteByte(byte(algo))
+	body.WriteByte(byte(len(getOID(name))))
+	body.Write(getOID(name))
+	body.Write(mpi(point))
+
+	if algo == packet.PubKeyAlgoECDH {
+		// RFC 6637 - 9. Algorithm-Specific Fields for ECDH Keys
+		// KDF parameters (SHA256, AES128), unused on card.
+		body.Write([]byte{0x03, 0x01, 0x08, 0x07})
+	}
+
+	// RFC 4880 - 5.5.3. Secret-Key Packet Formats
+	var checksum uint16
+	secret := mpi(d)
+
+	for _, b := range secret {
+		checksum += uint16(b)
+	}
+
+	// unencrypted secret key material
+	body.WriteByte(0x00)
+	body.Write(secret)
+	_ = binary.Write(body, binary.BigEndian, checksum)
+
+	// RFC 4880 - 4.2.2.3. Five-Octet Lengths, Secret-Key Packet (tag 5)
+	buf := []byte{0xc5, 0xff}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(body.Len()))
+	buf = append(buf, body.Bytes()...)
+
+	p, err := packet.Read(bytes.NewReader(buf))
+
+	if err != nil {
+		return
+	}
+
+	privateKey, ok := p.(*packet.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("unexpected packet %T", p)
+	}
+
+	return
+}
+
+// importECC builds an elliptic curve private key, matching the key algorithm
+// attributes, from its private (and optional public) key.
+func importECC(key byte, attributes []byte, components map[bertlv.Tag][]byte, creationTime time.Time) (privateKey *packet.PrivateKey, err error) {
+	d := components[DO_ECC_PRIVATE_KEY]
+	point := components[DO_ECC_PUBLIC_KEY]
+
+	if len(d) == 0 {
+		return nil, errors.New("missing private key")
+	}
+
+	algo := packet.PublicKeyAlgorithm(attributes[0])
+	name := attributesCurve(attributes)
+
+	switch name {
+	case ED25519:
+		seed := leftPad(d, stded25519.SeedSize)
+		k := stded25519.NewKeyFromSeed(seed)
+
+		priv := &ed25519.PrivateKey{
+			PublicKey: ed25519.PublicKey{Point: k[stded25519.SeedSize:]},
+			Key:       k,
+		}
+
+		return newPrivateKey(key, priv, creationTime), nil
+	case ED448:
+		seed := leftPad(d, circled448.SeedSize)
+		k := circled448.NewKeyFromSeed(seed)
+
+		priv := &ed448.PrivateKey{
+			PublicKey: ed448.PublicKey{Point: k[circled448.SeedSize:]},
+			Key:       k,
+		}
+
+		return newPrivateKey(key, priv, creationTime), nil
+	case CURVE25519:
+		secret := montgomerySecret(d, nativePoint(point, x25519.KeySize), x25519.KeySize, x25519Public)
+
+		priv := &x25519.PrivateKey{
+			PublicKey: x25519.PublicKey{Point: x25519Public(secret)},
+			Secret:    secret,
+		}
+
+		return newPrivateKey(key, priv, creationTime), nil
+	case X448:
+		secret := montgomerySecret(d, nativePoint(point, x448.KeySize), x448.KeySize, x448Public)
+
+		priv := &x448.PrivateKey{
+			PublicKey: x448.PublicKey{Point: x448Public(secret)},
+			Secret:    secret,
+		}
+
+		return newPrivateKey(key, priv, creationTime), nil
+	case "":
+		return nil, fmt.Errorf("unsupported curve")
+	}
+
+	return importSEC1(algo, name, d, point, creationTime)
+}
+
+// montgomerySecret returns the native (little-endian) X25519/X448 secret, the
+// secret is expected as an OpenPGP MPI (big-endian) unless the public key,
+// when present, reveals native order.
+func montgomerySecret(d []byte, point []byte, size int, public func([]byte) []byte) (secret []byte) {
+	secret = reverse(leftPad(d, size))
+
+	if len(point) > 0 && !bytes.Equal(point, public(secret)) {
+		secret = leftPad(d, size)
+	}
+
+	return
+}
+
+func x25519Public(secret []byte) []byte {
+	point, _ := curve25519.X25519(secret, curve25519.Basepoint)
+	return point
+}
+
+func x448Public(secret []byte) []byte {
+	var sk, pk circlx448.Key
+
+	copy(sk[:], secret)
+	circlx448.KeyGen(&pk, &sk)
+
+	return pk[:]
+}
+
+// ImportKey implements PUT DATA (odd INS) with the Extended Header list, as
+// specified at
+// p38, 4.4.3.12 Private Key Template, OpenPGP application Version 3.4.
+//
+// Only the standard import format is supported for RSA keys (public exponent
+// and primes). Imported keys replace any bundled one, they are kept on
+// persistent storage and protected with DEFAULT_PW1, or with the PW1 set with
+// CHANGE REFERENCE DATA which must then also be verified.
+func (card *Interface) ImportKey(data []byte) (rapdu *apdu.RAPDU, err error) {
+	var privateKey *packet.PrivateKey
+
+	if !card.adminVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if _, err = card.keyPassphrase(); err != nil {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	key, components, err := parseExtendedHeaderList(data)
+
+	if err != nil {
+		log.Printf("PUT DATA invalid Extended Header list, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	attributes := card.attributes(key)
+	creationTime := time.Now()
+
+	if !validAttributes(key, attributes) {
+		log.Printf("PUT DATA unsupported algorithm attributes %x", attributes)
+		return applet.WrongData(), nil
+	}
+
+	if attributes[0] == RSA {
+		var priv *rsa.PrivateKey
+
+		if priv, err = importRSA(components); err == nil {
+			privateKey = newPrivateKey(key, priv, creationTime)
+		}
+	} else {
+		privateKey, err = importECC(key, attributes, components, creationTime)
+	}
+
+	if err != nil {
+		log.Printf("PUT DATA invalid key, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	if err = card.storeKey(key, privateKey, KEY_IMPORTED, nil); err != nil {
+		log.Printf("PUT DATA error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.signalVerificationStatus()
+
+	return applet.CommandCompleted(nil), nil
+}
@@ -9,6 +9,8 @@ package icc
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -16,7 +18,9 @@ import (
 	"regexp"
 	"sync"
 
+	"github.com/usbarmory/GoKey/internal/applet"
 	"github.com/usbarmory/GoKey/internal/snvs"
+	"github.com/usbarmory/GoKey/internal/storage"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
@@ -27,6 +31,10 @@ import (
 // Diversifier for hardware key derivation (OpenPGP secret key wrapping).
 const DiversifierPGP = "GoKeySNVSOpenPGP"
 
+// Diversifier for hardware key derivation (private use Data Objects
+// encryption).
+const DiversifierPrivateDO = "GoKeySNVSPrivDO "
+
 const (
 	// p48, 7.1 Usage of ISO Standard Commands, OpenPGP application Version 3.4.
 	SELECT                       = 0xa4
@@ -37,17 +45,15 @@ const (
 	GENERATE_ASYMMETRIC_KEY_PAIR = 0x47
 	GET_CHALLENGE                = 0x84
 	PERFORM_SECURITY_OPERATION   = 0x2a
-
-	// Not implemented:
-	//   SELECT DATA
-	//   GET NEXT DATA
-	//   CHANGE REFERENCE DATA
-	//   RESET RETRY COUNTER
-	//   INTERNAL AUTHENTICATE
-	//   GET RESPONSE
-	//   TERMINATE DF
-	//   ACTIVATE FILE
-	//   MANAGE SECURITY ENVIRONMENT
+	INTERNAL_AUTHENTICATE        = 0x88
+	SELECT_DATA                  = 0xa5
+	GET_NEXT_DATA                = 0xcc
+	GET_RESPONSE                 = 0xc0
+	RESET_RETRY_COUNTER          = 0x2c
+	TERMINATE_DF                 = 0xe6
+	ACTIVATE_FILE                = 0x44
+	MANAGE_SECURITY_ENVIRONMENT  = 0x22
+	CHANGE_REFERENCE_DATA        = 0x24
 
 	// Security Operations
 	COMPUTE_DIGITAL_SIGNATURE = 0x9e9a
@@ -77,42 +83,84 @@ type Interface struct {
 	Debug bool
 	// enable device unique hardware encryption for bundled private keys
 	SNVS bool
+	// RawPKCS1 enables signing of RSA PSO:CDS inputs which are not a
+	// DigestInfo as-is with PKCS#1 v1.5 padding, as with INTERNAL
+	// AUTHENTICATE.
+	RawPKCS1 bool
+	// Presence is a channel used to signal user presence, required by
+	// keys with the User Interaction Flag enabled.
+	Presence chan bool
+	// persistent storage for card personalization (optional)
+	Storage storage.Storage
+	// monotonic counter for rollback detection of persistent counters
+	// (optional)
+	Counter storage.Counter
+	// AttestationKey signs key attestation statements (optional)
+	AttestationKey crypto.Signer
 
 	// Armored secret key
 	ArmoredKey []byte
-	// Secret key
-	Key *openpgp.Entity
-	// Signature subkey
-	Sig *openpgp.Subkey
-	// Decryption subkey
-	Dec *openpgp.Subkey
-	// Authentication subkey
-	Aut *openpgp.Subkey
-
-	// encrypted private key caches for PW_LOCK
-	sig packet.PrivateKey
-	dec packet.PrivateKey
-	aut packet.PrivateKey
+	// Additional armored secret keys, each bundled as a further identity
+	ArmoredKeys [][]byte
+
+	// active identity (secret key and subkeys)
+	identity
+	// inactive identities and active identity index
+	identities [MAX_IDENTITIES]identity
+	active     int
 
 	// currently unused
 	CA []*openpgp.Entity
-
-	// volatile (TODO: make it permanent)
+	// CA fingerprints set with PUT DATA, override CA when present
+	caFingerprints []byte
+
+	// admin PIN (PW3) verifier, nil when PW3 is disabled
+	admin *applet.PINVerifier
+	// resetting code (RC) verifier, nil when RC is disabled
+	rc *applet.PINVerifier
+	// key derived format (KDF) parameters, nil when KDF is disabled
+	kdf *kdfData
+	// selected cardholder certificate occurrence
+	certificate int
+	// private use Data Objects (0101, 0102, 0103, 0104)
+	privateData [4][]byte
+
+	// key references set with MSE:SET, 0x00 for the default ones
+	decipherKeyRef       byte
+	authenticationKeyRef byte
+
+	// command chaining and GET RESPONSE state
+	chaining applet.Chaining
+
+	// volatile, PW1 status byte set with PUT DATA
+	pw1Status byte
+	// persistent when storage is available
 	errorCounterPW1 uint8
-	// no reset functionality, unused and fixed to 0x00
+	// persistent when storage is available, fixed to 0x00 when RC is
+	// disabled
 	errorCounterRC uint8
-	// PW3 PIN is not supported, unused and fixed to 0x00
+	// persistent when storage is available, fixed to 0x00 when PW3 is
+	// disabled
 	errorCounterPW3 uint8
-	// volatile (TODO: make it permanent)
+	// persistent when storage is available
 	digitalSignatureCounter uint32
 
 	// PKCS#11 RPC handler
 	rpc *p11kit.Handler
 
+	// firmware cardholder data, restored on activation
+	factory *cardholderData
+	// device attestation certificate
+	attestation *x509.Certificate
+
 	// internal state flags
-	selected    bool
-	initialized bool
-	awake       bool
+	terminated    bool
+	selected      bool
+	initialized   bool
+	awake         bool
+	adminVerified bool
+	// default PW1 verified, when no key is present
+	defaultVerified bool
 }
 
 // Init initializes the OpenPGP card instance, using passed amored secret key
@@ -121,26 +169,101 @@ type Interface struct {
 // The SNVS argument indicates whether private keys (which are already
 // encrypted with the passphrase unless the user created them without one) are
 // to be stored encrypted at rest with a device specific hardware derived key.
+//
+// The armored secret key can be omitted when keys are generated on card.
 func (card *Interface) Init() (err error) {
 	if card.initialized {
 		return errors.New("card already initialized")
 	}
 
+	if err = card.loadLifeCycle(); err != nil {
+		return fmt.Errorf("OpenPGP life cycle loading failed, %v", err)
+	}
+
+	if err = card.loadAdmin(); err != nil {
+		return fmt.Errorf("OpenPGP admin PIN loading failed, %v", err)
+	}
+
+	if err = card.loadKDF(); err != nil {
+		return fmt.Errorf("OpenPGP KDF loading failed, %v", err)
+	}
+
+	if err = card.initAttestation(); err != nil {
+		return fmt.Errorf("OpenPGP attestation initialization failed, %v", err)
+	}
+
+	// firmware defaults, restored on activation after termination
+	if card.factory == nil {
+		card.factory = card.cardholderData()
+	}
+
+	if card.terminated {
+		log.Printf("OpenPGP card terminated, ACTIVATE FILE required")
+	} else if err = card.loadState(); err != nil {
+		return
+	}
+
+	card.initialized = true
+
+	log.Printf("OpenPGP card initialized")
+	log.Print(card.Status())
+
+	LED("white", false)
+	LED("blue", false)
+
+	card.signalVerificationStatus()
+
+	return
+}
+
+// loadState loads bundled keys and persistent card data, with the exception of
+// the admin PIN verifier and KDF parameters which are retained across
+// termination.
+func (card *Interface) loadState() (err error) {
+	if err = card.loadIdentities(); err != nil {
+		return
+	}
+
+	if err = card.loadCardholderData(); err != nil {
+		return fmt.Errorf("OpenPGP cardholder data loading failed, %v", err)
+	}
+
+	if err = card.loadResettingCode(); err != nil {
+		return fmt.Errorf("OpenPGP resetting code loading failed, %v", err)
+	}
+
+	if err = card.loadPrivateData(); err != nil {
+		return fmt.Errorf("OpenPGP private data loading failed, %v", err)
+	}
+
+	card.errorCounterPW1 = DEFAULT_PW1_ERROR_COUNTER
+
+	if err = card.loadCounters(); err != nil {
+		return fmt.Errorf("OpenPGP counter loading failed, %v", err)
+	}
+
+	return
+}
+
+// decodeKey decodes a bundled secret key for the active identity.
+func (card *Interface) decodeKey(armoredKey []byte) (err error) {
+	var retired []*openpgp.Subkey
+
 	if card.SNVS {
-		card.ArmoredKey, err = snvs.Decrypt(card.ArmoredKey, []byte(DiversifierPGP))
+		armoredKey, err = snvs.Decrypt(armoredKey, []byte(DiversifierPGP))
 	}
 
 	if err != nil {
 		return fmt.Errorf("OpenPGP key decryption failed, %v", err)
 	}
 
-	card.Key, err = decodeArmoredKey([]byte(card.ArmoredKey))
+	card.Key, err = decodeArmoredKey(armoredKey)
 
 	if err != nil {
 		return fmt.Errorf("OpenPGP key decoding failed, %v", err)
 	}
 
-	card.Sig, card.Dec, card.Aut = decodeSubkeys(card.Key)
+	card.Sig, card.Dec, card.Aut, retired = decodeSubkeys(card.Key)
 
 	// cache encrypted private keys for PW_LOCK
 	if card.Sig != nil && card.Sig.PrivateKey != nil {
@@ -153,16 +276,12 @@ func (card *Interface) Init() (err error) {
 		card.aut = *card.Aut.PrivateKey
 	}
 
-	card.errorCounterPW1 = DEFAULT_PW1_ERROR_COUNTER
-	card.initialized = true
-
-	log.Printf("OpenPGP card initialized")
-	log.Print(card.Status())
-
-	LED("white", false)
-	LED("blue", false)
-
-	card.signalVerificationStatus()
+	// previous decryption subkeys are retired
+	for _, subkey := range retired {
+		if subkey.PrivateKey != nil {
+			card.retire(&retiredKey{subkey: subkey, encrypted: *subkey.PrivateKey})
+		}
+	}
 
 	return
 }
@@ -172,14 +291,20 @@ func (card *Interface) Initialized() bool {
 	return card.initialized
 }
 
-// Restore overwrites decrypted subkeys with their encrypted version, imported
-// at card initialization.
+// Restore overwrites decrypted subkeys, including retired decryption subkeys,
+// with their encrypted version, imported at card initialization.
 func (card *Interface) Restore(subkey *openpgp.Subkey) *packet.PrivateKey {
 	if subkey == nil || subkey.PrivateKey == nil {
 		return nil
 	}
 
-	for _, privateKey := range []packet.PrivateKey{card.sig, card.dec, card.aut} {
+	privateKeys := []packet.PrivateKey{card.sig, card.dec, card.aut}
+
+	for _, r := range card.retired {
+		privateKeys = append(privateKeys, r.encrypted)
+	}
+
+	for _, privateKey := range privateKeys {
 		if bytes.Equal(privateKey.Fingerprint, subkey.PrivateKey.Fingerprint) {
 			return &privateKey
 		}
@@ -191,23 +316,46 @@ func (card *Interface) Restore(subkey *openpgp.Subkey) *packet.PrivateKey {
 // Select implements
 // p50, 7.2.1 SELECT, OpenPGP application Version 3.4.
 func (card *Interface) Select(file []byte) (rapdu *apdu.RAPDU, _ error) {
-	rapdu = FileNotFound()
+	rapdu = applet.FileNotFound()
 
 	if bytes.Equal(file, RID) || bytes.Equal(file, card.AID()) {
-		rapdu = CommandCompleted(nil)
+		rapdu = applet.CommandCompleted(nil)
 		card.selected = true
+		card.certificate = CERTIFICATE_AUT
+		card.resetSecurityEnvironment()
+
+		if card.terminated {
+			rapdu = TerminationState()
+		}
 	} else if card.selected {
-		// A SELECT for a different application sets the status to 'not
-		// verified' for all PWs.
-		_, _ = card.Verify(PW_LOCK, PW1_CDS, nil)
-		_, _ = card.Verify(PW_LOCK, PW1, nil)
-		_, _ = card.Verify(PW_LOCK, PW3, nil)
-		card.selected = false
+		card.Deselect()
 	}
 
 	return
 }
 
+// Deselect is invoked on selection of a different application (see
+// applet.Dispatcher), which sets the status to 'not verified' for all PWs.
+//
+// Only subkeys unlocked with VERIFY commands are locked, subkeys unlocked
+// through the management interface remain available (e.g. to the PIV applet).
+func (card *Interface) Deselect() {
+	verified := card.verified
+	card.verified = nil
+
+	for _, subkey := range verified {
+		card.lock(subkey)
+	}
+
+	card.defaultVerified = false
+	card.pw1Passphrase = nil
+
+	_, _ = card.Verify(PW_LOCK, PW3, nil)
+	card.selected = false
+
+	card.signalVerificationStatus()
+}
+
 // RawCommand parses a buffer representing an APDU command and redirects it to
 // the relevant handler. A buffer representing the APDU response is returned.
 func (card *Interface) RawCommand(buf []byte) ([]byte, error) {
@@ -230,16 +378,28 @@ func (card *Interface) RawCommand(buf []byte) ([]byte, error) {
 // Command parses an APDU command and redirects it to the relevant handler. An
 // APDU response is returned.
 func (card *Interface) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error) {
-	rapdu = CommandNotAllowed()
+	rapdu = applet.CommandNotAllowed()
 
 	if card.Debug {
 		log.Printf("<< %+v", capdu)
 	}
 
-	if capdu.CLA != 0x00 {
+	switch cla := capdu.CLA &^ applet.CLA_CHAINING; {
+	case cla == 0x00:
+	case cla == CLA_PROPRIETARY && capdu.INS == ATTEST:
+	default:
+		return
+	}
+
+	if capdu, rapdu = card.chaining.Command(capdu); capdu == nil {
 		return
 	}
 
+	// p75, 7.2.16 TERMINATE DF, OpenPGP application Version 3.4
+	if card.terminated && capdu.INS != SELECT && capdu.INS != ACTIVATE_FILE {
+		return TerminationState(), nil
+	}
+
 	params := binary.BigEndian.Uint16([]byte{capdu.P1, capdu.P2})
 
 	// p48, 7.1 Usage of ISO Standard Commands, OpenPGP application Version 3.4
@@ -248,14 +408,39 @@ func (card *Interface) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error)
 		rapdu, err = card.Select(capdu.Data)
 	case GET_DATA:
 		rapdu, err = card.GetData(params)
+	case SELECT_DATA:
+		rapdu, err = card.SelectData(capdu.P1, capdu.P2, capdu.Data)
+	case GET_NEXT_DATA:
+		rapdu, err = card.GetNextData(params)
 	case VERIFY:
-		rapdu, err = card.Verify(capdu.P1, capdu.P2, capdu.Data)
-	case PUT_DATA_1, PUT_DATA_2:
-		rapdu, err = card.PutData(params)
+		switch capdu.P2 {
+		case PW1_CDS, PW1, PW3:
+			rapdu, err = card.verifyCommand(capdu.P1, capdu.P2, capdu.Data)
+		}
+	case RESET_RETRY_COUNTER:
+		rapdu, err = card.ResetRetryCounter(capdu.P1, capdu.P2, capdu.Data)
+	case CHANGE_REFERENCE_DATA:
+		rapdu, err = card.ChangeReferenceData(capdu.P1, capdu.P2, capdu.Data)
+	case TERMINATE_DF:
+		rapdu, err = card.TerminateDF(capdu.P1, capdu.P2)
+	case ACTIVATE_FILE:
+		rapdu, err = card.ActivateFile(capdu.P1, capdu.P2)
+	case PUT_DATA_1:
+		rapdu, err = card.PutData(params, capdu.Data)
+	case PUT_DATA_2:
+		if params == PUT_DATA_EXTENDED_HEADER_LIST {
+			rapdu, err = card.ImportKey(capdu.Data)
+		}
 	case GENERATE_ASYMMETRIC_KEY_PAIR:
 		rapdu, err = card.GenerateAsymmetricKeyPair(params, capdu.Data)
 	case GET_CHALLENGE:
 		rapdu, err = card.GetChallenge(int(capdu.GetLe()))
+	case ATTEST:
+		rapdu, err = card.Attest(capdu.P1, capdu.P2)
+	case MANAGE_SECURITY_ENVIRONMENT:
+		rapdu, err = card.ManageSecurityEnvironment(capdu.P1, capdu.P2, capdu.Data)
+	case GET_RESPONSE:
+		rapdu, err = card.GetResponse(capdu.P1, capdu.P2, int(capdu.GetLe()))
 	case PERFORM_SECURITY_OPERATION:
 		LED("white", true)
 		defer LED("white", false)
@@ -270,12 +455,21 @@ func (card *Interface) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error)
 		default:
 			log.Printf("unsupported PSO %x", params)
 		}
+	case INTERNAL_AUTHENTICATE:
+		LED("white", true)
+		defer LED("white", false)
+
+		rapdu, err = card.InternalAuthenticate(capdu.Data)
 	default:
 		log.Printf("unsupported INS %x", capdu.INS)
 	}
 
 	if rapdu == nil {
-		rapdu = CommandNotAllowed()
+		rapdu = applet.CommandNotAllowed()
+	}
+
+	if capdu.INS != GET_RESPONSE {
+		rapdu = card.chaining.Response(capdu, rapdu)
 	}
 
 	if card.Debug {
@@ -285,6 +479,12 @@ func (card *Interface) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error)
 	return
 }
 
+// GetResponse implements
+// p61, 7.2.9 GET RESPONSE, OpenPGP application Version 3.4.
+func (card *Interface) GetResponse(P1 byte, P2 byte, le int) (rapdu *apdu.RAPDU, _ error) {
+	return card.chaining.GetResponse(P1, P2, le), nil
+}
+
 // Status returns card key fingerprints and encryption status in textual
 // format.
 func (card *Interface) Status() string {
@@ -295,6 +495,7 @@ func (card *Interface) Status() string {
 	fmt.Fprintf(&status, "Secure storage .........: %v\n", card.SNVS)
 	fmt.Fprintf(&status, "Serial number ..........: %X\n", card.Serial)
 	fmt.Fprintf(&status, "Digital signature count.: %v\n", card.digitalSignatureCounter)
+	fmt.Fprintf(&status, "Identity ...............: %d\n", card.active)
 	fmt.Fprintf(&status, "Secret key .............: ")
 
 	r := regexp.MustCompile(`([[:xdigit:]]{4})`)
@@ -323,5 +524,17 @@ func (card *Interface) Status() string {
 		}
 	}
 
+	for i, k := range card.retired {
+		fmt.Fprintf(&status, "Retired subkey %d .......: ", i+1)
+
+		fp := fmt.Sprintf("%X\n", k.subkey.PublicKey.Fingerprint)
+		status.WriteString(r.ReplaceAllString(fp, "$1 "))
+		fmt.Fprintf(&status, "               encrypted: %v\n", k.subkey.PrivateKey.Encrypted)
+
+		if card.retiredOverride == i+1 {
+			fmt.Fprintf(&status, "      forced for PSO:DEC: true\n")
+		}
+	}
+
 	return status.String()
 }
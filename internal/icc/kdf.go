@@ -0,0 +1,318 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// p19, 4.3.2 Key derived format, OpenPGP application Version 3.4
+	KDF_NONE           = 0x00
+	KDF_ITERSALTED_S2K = 0x03
+	KDF_HASH_SHA256    = 0x08
+	KDF_SALT_SIZE      = 8
+	// number of bytes hashed for each derivation
+	KDF_ITERATIONS = 0x02000000
+
+	// sealed passphrase key derivation info
+	kdfSealInfo = "GoKey KDF PW1"
+)
+
+// kdfData represents the key derived format (KDF) parameters, along with the
+// PW1 verifier and the key passphrase sealed at provisioning.
+type kdfData struct {
+	Iterations uint32
+	SaltPW1    []byte
+	SaltRC     []byte
+	SaltPW3    []byte
+	// derived hashes of the default PW1 and PW3
+	InitialPW1 []byte
+	InitialPW3 []byte
+
+	// PW1 derived hash verifier
+	Verifier *applet.PINVerifier
+	// key passphrase, encrypted with a key derived from the PW1 hash
+	Passphrase []byte
+}
+
+// s2k implements the iterated and salted S2K function with SHA256
+// (RFC4880 3.7.1.3).
+func s2k(salt []byte, pin []byte, count int) []byte {
+	h := sha256.New()
+	buf := append(append([]byte{}, salt...), pin...)
+
+	if count < len(buf) {
+		count = len(buf)
+	}
+
+	for count > len(buf) {
+		h.Write(buf)
+		count -= len(buf)
+	}
+
+	h.Write(buf[:count])
+
+	return h.Sum(nil)
+}
+
+func newKDF() (k *kdfData, err error) {
+	k = &kdfData{
+		Iterations: KDF_ITERATIONS,
+	}
+
+	for _, salt := range []*[]byte{&k.SaltPW1, &k.SaltRC, &k.SaltPW3} {
+		*salt = make([]byte, KDF_SALT_SIZE)
+
+		if _, err = rand.Read(*salt); err != nil {
+			return
+		}
+	}
+
+	k.InitialPW1 = k.derive(k.SaltPW1, []byte(DEFAULT_PW1))
+	k.InitialPW3 = k.derive(k.SaltPW3, []byte(DEFAULT_PW3))
+
+	return
+}
+
+func (k *kdfData) derive(salt []byte, pin []byte) []byte {
+	return s2k(salt, pin, int(k.Iterations))
+}
+
+func (k *kdfData) cipher(hash []byte) (aead cipher.AEAD, err error) {
+	key, err := hkdf.Key(sha256.New, hash, k.Verifier.Salt, kdfSealInfo, 32)
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal stores the PW1 verifier and the key passphrase, encrypted with a key
+// derived from the PW1 hash.
+func (k *kdfData) seal(hash []byte, passphrase []byte) (err error) {
+	if k.Verifier, err = applet.NewPINVerifier(hash); err != nil {
+		return
+	}
+
+	aead, err := k.cipher(hash)
+
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	k.Passphrase = aead.Seal(nonce, nonce, passphrase, nil)
+
+	return
+}
+
+// unseal returns the key passphrase for a PW1 hash matching the verifier.
+func (k *kdfData) unseal(hash []byte) (passphrase []byte, err error) {
+	if k.Verifier == nil || !k.Verifier.Verify(hash) {
+		return nil, errors.New("invalid PW1 hash")
+	}
+
+	aead, err := k.cipher(hash)
+
+	if err != nil {
+		return
+	}
+
+	if len(k.Passphrase) < aead.NonceSize() {
+		return nil, errors.New("invalid sealed passphrase")
+	}
+
+	nonce := k.Passphrase[:aead.NonceSize()]
+
+	return aead.Open(nil, nonce, k.Passphrase[aead.NonceSize():], nil)
+}
+
+func (card *Interface) loadKDF() (err error) {
+	k := &kdfData{}
+
+	if err = card.load(STORE_KDF, k); err != nil {
+		return
+	}
+
+	if k.Verifier == nil {
+		return
+	}
+
+	card.kdf = k
+
+	return
+}
+
+// KDF returns the key derived format Data Object (F9).
+func (card *Interface) KDF() []byte {
+	var data bytes.Buffer
+
+	if card.kdf == nil {
+		data.Write(bertlv.Encode(0x81, []byte{KDF_NONE}))
+		return data.Bytes()
+	}
+
+	iterations := make([]byte, 4)
+	binary.BigEndian.PutUint32(iterations, card.kdf.Iterations)
+
+	data.Write(bertlv.Encode(0x81, []byte{KDF_ITERSALTED_S2K}))
+	data.Write(bertlv.Encode(0x82, []byte{KDF_HASH_SHA256}))
+	data.Write(bertlv.Encode(0x83, iterations))
+	data.Write(bertlv.Encode(0x84, card.kdf.SaltPW1))
+	data.Write(bertlv.Encode(0x85, card.kdf.SaltRC))
+	data.Write(bertlv.Encode(0x86, card.kdf.SaltPW3))
+	data.Write(bertlv.Encode(0x87, card.kdf.InitialPW1))
+	data.Write(bertlv.Encode(0x88, card.kdf.InitialPW3))
+
+	return data.Bytes()
+}
+
+// checkPassphrase verifies that a passphrase decrypts at least one of the
+// encrypted subkeys, without unlocking them.
+func (card *Interface) checkPassphrase(passphrase []byte) bool {
+	var locked int
+
+	for _, subkey := range presentSubkeys([]*openpgp.Subkey{card.Sig, card.Dec, card.Aut}) {
+		privateKey := card.Restore(subkey)
+
+		if privateKey == nil || !privateKey.Encrypted {
+			continue
+		}
+
+		locked += 1
+
+		if privateKey.Decrypt(passphrase) == nil {
+			return true
+		}
+	}
+
+	return locked == 0
+}
+
+// SetKDF enables the key derived format (KDF) with the key passphrase, so that
+// VERIFY receives a PW1 hash rather than the passphrase itself, an empty
+// passphrase disables KDF.
+//
+// The PW1 hash is checked against a salted verifier, the passphrase is sealed
+// with a key derived from the PW1 hash and kept on persistent storage,
+// encrypted when SNVS is enabled.
+//
+// As PW3 and RC are also hashed by the host with KDF, both are disabled and
+// need to be set again.
+func (card *Interface) SetKDF(passphrase []byte) (err error) {
+	if !card.initialized {
+		return errors.New("card not initialized")
+	}
+
+	k := &kdfData{}
+
+	if len(passphrase) != 0 {
+		if len(passphrase) < PW1_MIN_LENGTH || len(passphrase) > PW1_MAX_LENGTH {
+			return errors.New("invalid passphrase length")
+		}
+
+		if !card.checkPassphrase(passphrase) {
+			return errors.New("invalid passphrase")
+		}
+
+		if k, err = newKDF(); err != nil {
+			return
+		}
+
+		if err = k.seal(k.derive(k.SaltPW1, passphrase), passphrase); err != nil {
+			return
+		}
+	}
+
+	if err = card.save(STORE_KDF, k); err != nil {
+		return
+	}
+
+	if len(passphrase) == 0 {
+		card.kdf = nil
+		log.Printf("OpenPGP KDF disabled")
+	} else {
+		card.kdf = k
+		log.Printf("OpenPGP KDF enabled")
+	}
+
+	if card.admin != nil {
+		if err = card.setAdminPIN(nil); err != nil {
+			return
+		}
+	}
+
+	if card.rc != nil {
+		if err = card.setResettingCode(nil); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// kdfPIN returns the derived hash of a PIN (PW3 or RC) entered over the
+// management interface, when KDF is enabled.
+func (card *Interface) kdfPIN(tag int, pin []byte) []byte {
+	if card.kdf == nil || len(pin) == 0 {
+		return pin
+	}
+
+	salt := card.kdf.SaltPW3
+
+	if tag == DO_RESETTING_CODE {
+		salt = card.kdf.SaltRC
+	}
+
+	return card.kdf.derive(salt, pin)
+}
+
+// kdfPassphrase returns the key passphrase for a PW1 hash received with
+// VERIFY, when KDF is enabled, any other value is returned unchanged.
+func (card *Interface) kdfPassphrase(pin []byte) []byte {
+	if card.kdf == nil || len(pin) == 0 {
+		return pin
+	}
+
+	if subtle.ConstantTimeCompare(pin, card.kdf.InitialPW1) == 1 {
+		return []byte(DEFAULT_PW1)
+	}
+
+	if passphrase, err := card.kdf.unseal(pin); err == nil {
+		return passphrase
+	}
+
+	return pin
+}
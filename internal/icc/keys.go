@@ -0,0 +1,488 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/ed448"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/ProtonMail/go-crypto/openpgp/x448"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// DEFAULT_PW1 is the user PIN protecting keys generated on card, it is also
+// verified for PW1 when no key is present (e.g. before key generation).
+const DEFAULT_PW1 = "123456"
+
+// keySlot represents the persistent state of a card key (signature,
+// decryption or authentication).
+type keySlot struct {
+	// Key is the serialized private key packet, encrypted with PW1, of a
+	// key generated on card.
+	Key []byte
+	// Status is the key status as reported in Key Information (0xDE).
+	Status byte
+	// Attributes are the algorithm attributes set with PUT DATA.
+	Attributes []byte
+	// Fingerprint and Epoch are the key fingerprint and generation time
+	// set with PUT DATA.
+	Fingerprint []byte
+	Epoch       uint32
+	// UIF is the User Interaction Flag set with PUT DATA.
+	UIF byte
+}
+
+// supportedAttributes returns the algorithm attributes supported for key
+// generation on the signature, decryption or authentication slot.
+func supportedAttributes(key byte) (attributes [][]byte) {
+	names := []string{"P-256", "P-384", "P-521", "brainpoolP256r1", "brainpoolP384r1", "brainpoolP512r1"}
+
+	for _, bits := range []uint16{2048, 3072, 4096} {
+		data := make([]byte, 6)
+		data[0] = RSA
+		binary.BigEndian.PutUint16(data[1:], bits)
+		binary.BigEndian.PutUint16(data[3:], uint16(RSA_EXPONENT_SIZE))
+		data[5] = IMPORT_FORMAT_STANDARD
+
+		attributes = append(attributes, data)
+	}
+
+	if key == KEY_DEC {
+		names = append(names, CURVE25519, X448)
+	} else {
+		names = append(names, ED25519, ED448)
+	}
+
+	for _, name := range names {
+		var algo packet.PublicKeyAlgorithm
+
+		switch {
+		case key == KEY_DEC:
+			algo = packet.PubKeyAlgoECDH
+		case name == ED25519, name == ED448:
+			algo = packet.PubKeyAlgoEdDSA
+		default:
+			algo = packet.PubKeyAlgoECDSA
+		}
+
+		data := []byte{byte(algo)}
+		data = append(data, getOID(name)...)
+
+		attributes = append(attributes, data)
+	}
+
+	return
+}
+
+// validAttributes verifies whether algorithm attributes are supported for key
+// generation, the optional import format byte is ignored.
+func validAttributes(key byte, attributes []byte) bool {
+	if len(attributes) < 2 {
+		return false
+	}
+
+	for _, supported := range supportedAttributes(key) {
+		if bytes.Equal(attributes, supported) {
+			return true
+		}
+
+		if attributes[0] != RSA && len(attributes) == len(supported)+1 && bytes.HasPrefix(attributes, supported) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attributesCurve returns the curve name of elliptic curve algorithm
+// attributes, with or without the import format byte.
+func attributesCurve(attributes []byte) (name string) {
+	if len(attributes) < 2 {
+		return
+	}
+
+	if name = getCurveName(attributes[1:]); name == "" {
+		name = getCurveName(attributes[1 : len(attributes)-1])
+	}
+
+	return
+}
+
+// generateKey creates a new private key, with the given algorithm attributes,
+// for the signature, decryption or authentication slot.
+func generateKey(key byte, attributes []byte, creationTime time.Time) (priv any, err error) {
+	if !validAttributes(key, attributes) {
+		return nil, errors.New("unsupported algorithm attributes")
+	}
+
+	if attributes[0] == RSA {
+		bits := binary.BigEndian.Uint16(attributes[1:3])
+		return rsa.GenerateKey(rand.Reader, int(bits))
+	}
+
+	name := attributesCurve(attributes)
+
+	switch name {
+	case ED25519:
+		return ed25519.GenerateKey(rand.Reader)
+	case ED448:
+		return ed448.GenerateKey(rand.Reader)
+	case CURVE25519:
+		return x25519.GenerateKey(rand.Reader)
+	case X448:
+		return x448.GenerateKey(rand.Reader)
+	}
+
+	// ProtonMail go-crypto does not expose ECDSA/ECDH key generation for
+	// SEC1 curves other than through entity creation, whose primary key
+	// is an ECDSA key and encryption subkey an ECDH one.
+	config := &packet.Config{
+		Algorithm: packet.PubKeyAlgoECDSA,
+		Curve:     getPacketCurve(name),
+		Time:      func() time.Time { return creationTime },
+	}
+
+	entity, err := openpgp.NewEntity("GoKey", "", "", config)
+
+	if err != nil {
+		return
+	}
+
+	if key != KEY_DEC {
+		return entity.PrivateKey.PrivateKey, nil
+	}
+
+	if len(entity.Subkeys) == 0 {
+		return nil, errors.New("missing encryption subkey")
+	}
+
+	return entity.Subkeys[0].PrivateKey.PrivateKey, nil
+}
+
+// newPrivateKey wraps a private key in its OpenPGP packet representation.
+func newPrivateKey(key byte, priv any, creationTime time.Time) *packet.PrivateKey {
+	if key == KEY_DEC {
+		return packet.NewDecrypterPrivateKey(creationTime, priv)
+	}
+
+	return packet.NewSignerPrivateKey(creationTime, priv)
+}
+
+func (card *Interface) subkey(key byte) *openpgp.Subkey {
+	switch key {
+	case KEY_SIG:
+		return card.Sig
+	case KEY_DEC:
+		return card.Dec
+	case KEY_AUT:
+		return card.Aut
+	}
+
+	return nil
+}
+
+// setSubkey replaces a card subkey, the passed private key is used as is
+// while its encrypted version is cached for PW_LOCK.
+func (card *Interface) setSubkey(key byte, privateKey *packet.PrivateKey, encrypted *packet.PrivateKey) {
+	subkey := &openpgp.Subkey{
+		PublicKey:  &privateKey.PublicKey,
+		PrivateKey: privateKey,
+	}
+
+	switch key {
+	case KEY_SIG:
+		card.Sig = subkey
+		card.sig = *encrypted
+	case KEY_DEC:
+		card.Dec = subkey
+		card.dec = *encrypted
+	case KEY_AUT:
+		card.Aut = subkey
+		card.aut = *encrypted
+	}
+}
+
+// slot returns the persistent state of the signature, decryption or
+// authentication key.
+func (card *Interface) slot(key byte) *keySlot {
+	return &card.slots[key-KEY_SIG]
+}
+
+// loadKeys restores keys generated on card from persistent storage, these
+// take precedence over bundled ones.
+func (card *Interface) loadKeys() (err error) {
+	if err = card.load(card.entry(STORE_KEYS), &card.slots); err != nil {
+		return
+	}
+
+	for _, key := range []byte{KEY_SIG, KEY_DEC, KEY_AUT} {
+		slot := card.slot(key)
+
+		if len(slot.Key) == 0 {
+			continue
+		}
+
+		privateKey, err := readPrivateKey(slot.Key)
+
+		if err != nil {
+			return fmt.Errorf("invalid key %d, %v", key, err)
+		}
+
+		// a bundled decryption key replaced on card is retired
+		if key == KEY_DEC && card.Dec != nil && !bytes.Equal(card.Dec.PublicKey.Fingerprint, privateKey.Fingerprint) {
+			card.retire(&retiredKey{subkey: card.Dec, encrypted: card.dec})
+		}
+
+		encrypted := *privateKey
+		card.setSubkey(key, privateKey, &encrypted)
+	}
+
+	return
+}
+
+// readPrivateKey parses a serialized private key packet.
+func readPrivateKey(buf []byte) (*packet.PrivateKey, error) {
+	p, err := packet.Read(bytes.NewReader(buf))
+
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := p.(*packet.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("unexpected packet %T", p)
+	}
+
+	return privateKey, nil
+}
+
+// saveSlot updates the persistent state of a key, the change is only applied
+// if successfully saved.
+func (card *Interface) saveSlot(key byte, slot keySlot) (err error) {
+	slots := card.slots
+	slots[key-KEY_SIG] = slot
+
+	if err = card.save(card.entry(STORE_KEYS), slots); err != nil {
+		return
+	}
+
+	card.slots = slots
+
+	return
+}
+
+// attributes returns the algorithm attributes of the signature, decryption or
+// authentication key, attributes set with PUT DATA take precedence.
+func (card *Interface) attributes(key byte) []byte {
+	if attributes := card.slot(key).Attributes; len(attributes) > 0 {
+		return attributes
+	}
+
+	return card.AlgorithmAttributes(card.subkey(key))
+}
+
+// putKeyData implements PUT DATA for key related Data Objects.
+func (card *Interface) putKeyData(tag uint16, data []byte) (rapdu *apdu.RAPDU) {
+	var key byte
+
+	switch tag {
+	case DO_ALGORITHM_ATTRIBUTES_SIG, DO_ALGORITHM_ATTRIBUTES_DEC, DO_ALGORITHM_ATTRIBUTES_AUT:
+		key = byte(tag-DO_ALGORITHM_ATTRIBUTES_SIG) + KEY_SIG
+	case DO_FINGERPRINT_SIG, DO_FINGERPRINT_DEC, DO_FINGERPRINT_AUT:
+		key = byte(tag-DO_FINGERPRINT_SIG) + KEY_SIG
+	case DO_GENERATION_EPOCH_SIG, DO_GENERATION_EPOCH_DEC, DO_GENERATION_EPOCH_AUT:
+		key = byte(tag-DO_GENERATION_EPOCH_SIG) + KEY_SIG
+	case DO_UIF_SIG, DO_UIF_DEC, DO_UIF_AUT:
+		key = byte(tag-DO_UIF_SIG) + KEY_SIG
+	default:
+		return applet.ReferencedDataNotFound()
+	}
+
+	slot := *card.slot(key)
+
+	switch tag {
+	case DO_ALGORITHM_ATTRIBUTES_SIG, DO_ALGORITHM_ATTRIBUTES_DEC, DO_ALGORITHM_ATTRIBUTES_AUT:
+		if len(data) == 0 || !validAttributes(key, data) {
+			return applet.WrongData()
+		}
+
+		slot.Attributes = data
+	case DO_FINGERPRINT_SIG, DO_FINGERPRINT_DEC, DO_FINGERPRINT_AUT:
+		if len(data) != FINGERPRINT_SIZE {
+			return applet.WrongData()
+		}
+
+		slot.Fingerprint = data
+	case DO_GENERATION_EPOCH_SIG, DO_GENERATION_EPOCH_DEC, DO_GENERATION_EPOCH_AUT:
+		if len(data) != 4 {
+			return applet.WrongData()
+		}
+
+		slot.Epoch = binary.BigEndian.Uint32(data)
+	case DO_UIF_SIG, DO_UIF_DEC, DO_UIF_AUT:
+		if len(data) == 0 || len(data) > 2 || data[0] > UIF_FIXED {
+			return applet.WrongData()
+		}
+
+		if slot.UIF == UIF_FIXED {
+			return applet.SecurityConditionNotSatisfied()
+		}
+
+		slot.UIF = data[0]
+	}
+
+	if err := card.saveSlot(key, slot); err != nil {
+		log.Printf("PUT DATA error, %v", err)
+		return UnrecoverableError()
+	}
+
+	return applet.CommandCompleted(nil)
+}
+
+// storeKey saves a new key for the signature, decryption or authentication
+// slot, the key is protected on storage with DEFAULT_PW1, or the PW1 set with
+// CHANGE REFERENCE DATA, but left unlocked until the next PW_LOCK.
+func (card *Interface) storeKey(key byte, privateKey *packet.PrivateKey, status byte, attributes []byte) (err error) {
+	passphrase, err := card.keyPassphrase()
+
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err = privateKey.Serialize(buf); err != nil {
+		return
+	}
+
+	p, err := packet.Read(buf)
+
+	if err != nil {
+		return
+	}
+
+	encrypted, ok := p.(*packet.PrivateKey)
+
+	if !ok {
+		return fmt.Errorf("unexpected packet %T", p)
+	}
+
+	if err = encrypted.Encrypt(passphrase); err != nil {
+		return
+	}
+
+	buf.Reset()
+
+	if err = encrypted.Serialize(buf); err != nil {
+		return
+	}
+
+	// a replaced decryption key is retired rather than discarded
+	if key == KEY_DEC && card.Dec != nil && !bytes.Equal(card.Dec.PublicKey.Fingerprint, privateKey.Fingerprint) {
+		if err = card.retireDecryptionKey(); err != nil {
+			return
+		}
+	}
+
+	slot := keySlot{
+		Key:        buf.Bytes(),
+		Status:     status,
+		Attributes: attributes,
+		UIF:        card.slot(key).UIF,
+	}
+
+	if err = card.saveSlot(key, slot); err != nil {
+		return
+	}
+
+	card.setSubkey(key, privateKey, encrypted)
+
+	if key == KEY_SIG {
+		card.digitalSignatureCounter = 0
+
+		if err = card.saveCounters(); err != nil {
+			return
+		}
+	}
+
+	log.Printf("key %d % X stored", key, privateKey.Fingerprint)
+
+	return
+}
+
+// generate creates and stores a new key for the signature, decryption or
+// authentication slot.
+func (card *Interface) generate(key byte) (err error) {
+	creationTime := time.Now()
+	attributes := card.attributes(key)
+
+	log.Printf("GENERATE: key %d attributes %x", key, attributes)
+
+	priv, err := generateKey(key, attributes, creationTime)
+
+	if err != nil {
+		return
+	}
+
+	return card.storeKey(key, newPrivateKey(key, priv, creationTime), KEY_GENERATED, attributes)
+}
+
+// verifyDefault implements VERIFY for PW1 when no key is present, against
+// DEFAULT_PW1.
+func (card *Interface) verifyDefault(P1 byte, passphrase []byte) (rapdu *apdu.RAPDU) {
+	switch P1 {
+	case PW_VERIFY:
+		switch {
+		case len(passphrase) == 0:
+			rapdu = VerifyFail(card.errorCounterPW1)
+		case card.errorCounterPW1 == 0:
+			rapdu = VerifyFail(card.errorCounterPW1)
+		default:
+			if err := card.setCounter(&card.errorCounterPW1, card.errorCounterPW1-1); err != nil {
+				return UnrecoverableError()
+			}
+
+			card.defaultVerified = false
+
+			if card.verifyPW1(passphrase) {
+				card.setCounter(&card.errorCounterPW1, DEFAULT_PW1_ERROR_COUNTER)
+				card.retainPW1(passphrase)
+				card.defaultVerified = true
+				log.Printf("VERIFY: default PW1 verified (no key present)")
+			} else {
+				log.Printf("VERIFY: default PW1 error (no key present)")
+				rapdu = VerifyFail(card.errorCounterPW1)
+			}
+		}
+	case PW_LOCK:
+		card.defaultVerified = false
+		card.pw1Passphrase = nil
+	default:
+		return applet.CommandNotAllowed()
+	}
+
+	if rapdu == nil {
+		rapdu = applet.CommandCompleted(nil)
+	}
+
+	return
+}
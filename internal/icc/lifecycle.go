@@ -0,0 +1,189 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// p44, 6 Historical Byte, OpenPGP application Version 3.4
+	LCS_INITIALISATION = 0x03
+	LCS_OPERATIONAL    = 0x05
+)
+
+// lifeCycle represents the persistent life cycle status of the OpenPGP
+// application.
+type lifeCycle struct {
+	Terminated bool
+}
+
+func (card *Interface) loadLifeCycle() (err error) {
+	lc := &lifeCycle{}
+
+	if err = card.load(STORE_LIFECYCLE, lc); err != nil {
+		return
+	}
+
+	card.terminated = lc.Terminated
+
+	return
+}
+
+func (card *Interface) saveLifeCycle() (err error) {
+	if card.Storage == nil {
+		return
+	}
+
+	return card.save(STORE_LIFECYCLE, &lifeCycle{Terminated: card.terminated})
+}
+
+// LifeCycleStatus returns the life cycle status (LCS) of the OpenPGP
+// application.
+func (card *Interface) LifeCycleStatus() byte {
+	if card.terminated {
+		return LCS_INITIALISATION
+	}
+
+	return LCS_OPERATIONAL
+}
+
+// wipe erases keys generated or imported on card (including retired ones) and
+// cardholder certificates for all identities, the identity selection,
+// cardholder data, private use Data Objects and the resetting code from
+// persistent storage and resets all counters.
+//
+// The PW1 error counter is retained when bundled keys are present, as these
+// are restored on activation with their passphrase unchanged, so that a
+// factory reset cannot grant further PW1 attempts against them.
+//
+// The admin PIN verifier and KDF parameters are retained as they are managed
+// out of band (see SetAdminPIN and SetKDF).
+func (card *Interface) wipe() (err error) {
+	card.identity = identity{}
+	card.identities = [MAX_IDENTITIES]identity{}
+	card.active = 0
+
+	card.certificate = CERTIFICATE_AUT
+	card.privateData = [4][]byte{}
+	card.rc = nil
+	card.resetSecurityEnvironment()
+	card.pw1Status = 0x00
+	card.adminVerified = false
+	card.defaultVerified = false
+
+	if card.factory != nil {
+		card.setCardholderData(card.factory)
+	}
+
+	if !card.bundledKeys() {
+		card.errorCounterPW1 = DEFAULT_PW1_ERROR_COUNTER
+	}
+
+	card.errorCounterRC = 0
+	card.errorCounterPW3 = 0
+	card.digitalSignatureCounter = 0
+
+	if card.admin != nil {
+		card.errorCounterPW3 = DEFAULT_PW3_ERROR_COUNTER
+	}
+
+	if card.Storage == nil {
+		return
+	}
+
+	names := []string{STORE_CARDHOLDER, STORE_IDENTITY, STORE_RESETTING_CODE, STORE_PRIVATE_DATA}
+
+	for n := range card.identities {
+		names = append(names, identityEntry(STORE_KEYS, n), identityEntry(STORE_RETIRED_KEYS, n), identityEntry(STORE_PW1, n), identityEntry(STORE_CERTIFICATES, n))
+	}
+
+	for _, name := range names {
+		if err = card.Storage.Delete(name); err != nil {
+			return
+		}
+	}
+
+	return card.saveCounters()
+}
+
+// TerminateDF implements
+// p75, 7.2.16 TERMINATE DF, OpenPGP application Version 3.4.
+//
+// Termination is only possible after PW3 verification or when PW3 is blocked,
+// which is always the case when no admin PIN has been configured through the
+// management interface.
+func (card *Interface) TerminateDF(P1 byte, P2 byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != 0x00 || P2 != 0x00 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if !card.adminVerified && card.errorCounterPW3 != 0 {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	card.terminated = true
+
+	if err = card.saveLifeCycle(); err != nil {
+		log.Printf("TERMINATE DF error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	if err = card.wipe(); err != nil {
+		log.Printf("TERMINATE DF error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.signalVerificationStatus()
+
+	log.Printf("OpenPGP card terminated")
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// ActivateFile implements
+// p75, 7.2.17 ACTIVATE FILE, OpenPGP application Version 3.4.
+//
+// Activation of a terminated card completes the wiping of persistent data and
+// loads the card again, bundled keys are therefore restored.
+func (card *Interface) ActivateFile(P1 byte, P2 byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != 0x00 || P2 != 0x00 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if !card.terminated {
+		return applet.CommandCompleted(nil), nil
+	}
+
+	if err = card.wipe(); err != nil {
+		log.Printf("ACTIVATE FILE error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	if err = card.loadState(); err != nil {
+		log.Printf("ACTIVATE FILE error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.terminated = false
+
+	if err = card.saveLifeCycle(); err != nil {
+		log.Printf("ACTIVATE FILE error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	card.signalVerificationStatus()
+
+	log.Printf("OpenPGP card activated")
+
+	return applet.CommandCompleted(nil), nil
+}
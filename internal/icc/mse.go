@@ -0,0 +1,84 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// p81, 7.2.18 MANAGE SECURITY ENVIRONMENT, OpenPGP application Version 3.4
+	MSE_SET             = 0x41
+	CRT_AUTHENTICATION  = 0xa4
+	CRT_CONFIDENTIALITY = 0xb8
+	DO_KEY_REFERENCE    = 0x83
+)
+
+// ManageSecurityEnvironment implements
+// p81, 7.2.18 MANAGE SECURITY ENVIRONMENT, OpenPGP application Version 3.4.
+//
+// Only MSE:SET for key references 2 (DEC) and 3 (AUT) is supported, which
+// assigns either key to PSO:DEC (CT) or INTERNAL AUTHENTICATE (AT) until the
+// next SELECT.
+func (card *Interface) ManageSecurityEnvironment(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != MSE_SET {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(data) != 3 || data[0] != DO_KEY_REFERENCE || data[1] != 0x01 {
+		return applet.WrongData(), nil
+	}
+
+	key := data[2]
+
+	if key != KEY_DEC && key != KEY_AUT {
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	switch P2 {
+	case CRT_CONFIDENTIALITY:
+		card.decipherKeyRef = key
+		log.Printf("MSE:SET %s key for PSO:DEC", keyNames[key])
+	case CRT_AUTHENTICATION:
+		card.authenticationKeyRef = key
+		log.Printf("MSE:SET %s key for INTERNAL AUTHENTICATE", keyNames[key])
+	default:
+		return applet.IncorrectParameters(), nil
+	}
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// decipherKey returns the key reference used for PSO:DEC.
+func (card *Interface) decipherKey() byte {
+	if card.decipherKeyRef == 0 {
+		return KEY_DEC
+	}
+
+	return card.decipherKeyRef
+}
+
+// authenticationKey returns the key reference used for INTERNAL
+// AUTHENTICATE.
+func (card *Interface) authenticationKey() byte {
+	if card.authenticationKeyRef == 0 {
+		return KEY_AUT
+	}
+
+	return card.authenticationKeyRef
+}
+
+// resetSecurityEnvironment restores the default key references.
+func (card *Interface) resetSecurityEnvironment() {
+	card.decipherKeyRef = 0
+	card.authenticationKeyRef = 0
+}
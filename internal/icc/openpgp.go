@@ -15,6 +15,8 @@ import (
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
+// decodeArmoredKey parses an armored secret key, version 4 (RFC 4880) as well
+// as version 6 (RFC 9580) keys are supported.
 func decodeArmoredKey(key []byte) (entity *openpgp.Entity, err error) {
 	k := bytes.NewBuffer(key)
 	keyBlock, err := armor.Decode(k)
@@ -29,7 +31,10 @@ func decodeArmoredKey(key []byte) (entity *openpgp.Entity, err error) {
 	return
 }
 
-func decodeSubkeys(entity *openpgp.Entity) (sig *openpgp.Subkey, dec *openpgp.Subkey, aut *openpgp.Subkey) {
+// decodeSubkeys returns the signature, decryption and authentication subkeys,
+// the last one flagged for each usage is used. Previous decryption subkeys are
+// returned as retired ones.
+func decodeSubkeys(entity *openpgp.Entity) (sig *openpgp.Subkey, dec *openpgp.Subkey, aut *openpgp.Subkey, retired []*openpgp.Subkey) {
 	for i, subkey := range entity.Subkeys {
 		if subkey.Sig == nil || !subkey.Sig.FlagsValid {
 			continue
@@ -40,14 +45,95 @@ func decodeSubkeys(entity *openpgp.Entity) (sig *openpgp.Subkey, dec *openpgp.Su
 		}
 
 		if subkey.Sig.FlagEncryptStorage && subkey.Sig.FlagEncryptCommunications {
+			if dec != nil {
+				retired = append(retired, dec)
+			}
+
 			dec = &entity.Subkeys[i]
 		}
 
 		if subkey.Sig.FlagAuthenticate {
-			aut = &subkey
+			aut = &entity.Subkeys[i]
+		}
+	}
+
+	return
+}
+
+// Curve names as reported by ProtonMail go-crypto, also used to identify
+// native RFC 9580 key types.
+const (
+	CURVE25519 = "curve25519"
+	ED25519    = "ed25519"
+	X448       = "x448"
+	ED448      = "ed448"
+)
+
+// RFC 9580 - OpenPGP, fingerprints of version 6 keys are 32 bytes long while
+// OpenPGP card DOs only allocate 20 bytes for each key fingerprint. Following
+// GnuPG convention the leftmost 20 bytes are used.
+const FINGERPRINT_SIZE = 20
+
+// nativePointSize returns the size of public keys for curves using native
+// point encoding, or 0 for curves using SEC1 encoding.
+func nativePointSize(name string) int {
+	switch name {
+	case CURVE25519, ED25519:
+		return 32
+	case X448:
+		return 56
+	case ED448:
+		return 57
+	}
+
+	return 0
+}
+
+func truncateFingerprint(fp []byte) []byte {
+	if len(fp) > FINGERPRINT_SIZE {
+		return fp[:FINGERPRINT_SIZE]
+	}
+
+	return fp
+}
+
+// curves lists the elliptic curves which can be identified by their OID.
+var curves = []string{
+	"P-256", "P-384", "P-521",
+	"brainpoolP256r1", "brainpoolP384r1", "brainpoolP512r1",
+	CURVE25519, ED25519, X448, ED448,
+}
+
+// getCurveName returns the curve name matching an OID, or an empty string if
+// not supported.
+func getCurveName(oid []byte) string {
+	for _, name := range curves {
+		if bytes.Equal(oid, getOID(name)) {
+			return name
 		}
 	}
 
+	return ""
+}
+
+// getPacketCurve returns the ProtonMail go-crypto key generation curve
+// matching an SEC1 encoded curve name.
+func getPacketCurve(name string) (curve packet.Curve) {
+	switch name {
+	case "P-256":
+		curve = packet.CurveNistP256
+	case "P-384":
+		curve = packet.CurveNistP384
+	case "P-521":
+		curve = packet.CurveNistP521
+	case "brainpoolP256r1":
+		curve = packet.CurveBrainpoolP256
+	case "brainpoolP384r1":
+		curve = packet.CurveBrainpoolP384
+	case "brainpoolP512r1":
+		curve = packet.CurveBrainpoolP512
+	}
+
 	return
 }
 
@@ -66,6 +152,14 @@ func getOID(name string) (oid []byte) {
 		oid = []byte{0x2B, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0B}
 	case "brainpoolP512r1":
 		oid = []byte{0x2B, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0D}
+	case CURVE25519:
+		oid = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+	case ED25519:
+		oid = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0xDA, 0x47, 0x0F, 0x01}
+	case X448:
+		oid = []byte{0x2B, 0x65, 0x6F}
+	case ED448:
+		oid = []byte{0x2B, 0x65, 0x71}
 	default:
 		oid = []byte{0x2B, 0x81, 0x04, 0x00, 0x23}
 	}
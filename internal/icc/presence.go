@@ -0,0 +1,99 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+const (
+	// User Interaction Flag
+	UIF_DISABLED = 0x00
+	UIF_ENABLED  = 0x01
+	UIF_FIXED    = 0x02
+
+	// General Feature Management, button (or keypad button)
+	FEATURE_BUTTON = 0x20
+
+	// user presence timeout in seconds
+	PRESENCE_TIMEOUT = 10
+)
+
+var keyNames = map[byte]string{
+	KEY_SIG: "signature",
+	KEY_DEC: "decryption",
+	KEY_AUT: "authentication",
+}
+
+// UIF returns the User Interaction Flag Data Object (0xD6, 0xD7, 0xD8) for the
+// signature, decryption or authentication key.
+func (card *Interface) UIF(key byte) []byte {
+	return []byte{card.slot(key).UIF, FEATURE_BUTTON}
+}
+
+// userPresence verifies the user presence, through the Presence channel, when
+// required by the User Interaction Flag of the signature, decryption or
+// authentication key.
+func (card *Interface) userPresence(key byte) (present bool) {
+	if card.slot(key).UIF == UIF_DISABLED {
+		return true
+	}
+
+	if card.Presence == nil {
+		log.Printf("OpenPGP user presence required for %s key, but not available", keyNames[key])
+		return false
+	}
+
+	var done = make(chan bool)
+	go blink(done)
+
+	log.Printf("OpenPGP user presence request for %s key, type `p` within %ds to confirm", keyNames[key], PRESENCE_TIMEOUT)
+
+	select {
+	case <-card.Presence:
+		present = true
+	case <-time.After(PRESENCE_TIMEOUT * time.Second):
+		log.Printf("OpenPGP user presence request timed out")
+	}
+
+	done <- true
+
+	if present {
+		log.Printf("OpenPGP user presence confirmed")
+	}
+
+	return
+}
+
+// UserPresence verifies the user presence as required by the User Interaction
+// Flag of the signature, decryption or authentication key, for use of OpenPGP
+// keys by other card applications.
+func (card *Interface) UserPresence(key byte) bool {
+	return card.userPresence(key)
+}
+
+func blink(done chan bool) {
+	var on bool
+
+	for {
+		select {
+		case <-done:
+			LED("white", false)
+			return
+		default:
+		}
+
+		on = !on
+		LED("white", on)
+
+		runtime.Gosched()
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// p22, 4.4.1 DOs for GET DATA, OpenPGP application Version 3.4
+	DO_PRIVATE_USE_1 = 0x0101
+	DO_PRIVATE_USE_2 = 0x0102
+	DO_PRIVATE_USE_3 = 0x0103
+	DO_PRIVATE_USE_4 = 0x0104
+)
+
+func (card *Interface) loadPrivateData() (err error) {
+	return card.loadDiversified(STORE_PRIVATE_DATA, DiversifierPrivateDO, &card.privateData)
+}
+
+// pw1Verified returns whether PW1 (82) is verified, which matches the presence
+// of a decrypted decryption or authentication subkey or, when neither is
+// present, the verification of the default PW1.
+func (card *Interface) pw1Verified() bool {
+	subkeys := presentSubkeys([]*openpgp.Subkey{card.Dec, card.Aut})
+
+	if len(subkeys) == 0 {
+		return card.defaultVerified
+	}
+
+	for _, subkey := range subkeys {
+		if !subkey.PrivateKey.Encrypted {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrivateData implements GET DATA for the private use Data Objects (0101,
+// 0102, 0103, 0104), 0103 requires PW1 (82) verification while 0104 requires
+// PW3 verification.
+func (card *Interface) PrivateData(tag uint16) (rapdu *apdu.RAPDU) {
+	switch {
+	case tag == DO_PRIVATE_USE_3 && !card.pw1Verified():
+		return applet.SecurityConditionNotSatisfied()
+	case tag == DO_PRIVATE_USE_4 && !card.adminVerified:
+		return applet.SecurityConditionNotSatisfied()
+	}
+
+	return applet.CommandCompleted(card.privateData[tag-DO_PRIVATE_USE_1])
+}
+
+// putPrivateData implements PUT DATA for the private use Data Objects, 0101
+// and 0103 require PW1 (82) verification while 0102 and 0104 require PW3
+// verification.
+//
+// The Data Objects are kept on persistent storage, encrypted with a dedicated
+// diversifier when SNVS is enabled.
+func (card *Interface) putPrivateData(tag uint16, data []byte) (rapdu *apdu.RAPDU) {
+	switch tag {
+	case DO_PRIVATE_USE_1, DO_PRIVATE_USE_3:
+		if !card.pw1Verified() {
+			return applet.SecurityConditionNotSatisfied()
+		}
+	case DO_PRIVATE_USE_2, DO_PRIVATE_USE_4:
+		if !card.adminVerified {
+			return applet.SecurityConditionNotSatisfied()
+		}
+	}
+
+	privateData := card.privateData
+	privateData[tag-DO_PRIVATE_USE_1] = data
+
+	if err := card.saveDiversified(STORE_PRIVATE_DATA, DiversifierPrivateDO, privateData); err != nil {
+		log.Printf("PUT DATA error, %v", err)
+		return UnrecoverableError()
+	}
+
+	card.privateData = privateData
+
+	return applet.CommandCompleted(nil)
+}
@@ -0,0 +1,198 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"errors"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	DEFAULT_RC_ERROR_COUNTER = 3
+	RC_MIN_LENGTH            = 8
+	PW1_MIN_LENGTH           = 6
+
+	// p54, 7.2.4 RESET RETRY COUNTER, OpenPGP application Version 3.4
+	RESET_WITH_RC  = 0x00
+	RESET_WITH_PW3 = 0x02
+	RESET_PW1      = 0x81
+)
+
+func (card *Interface) loadResettingCode() (err error) {
+	rc := &applet.PINVerifier{}
+
+	if err = card.load(STORE_RESETTING_CODE, rc); err != nil {
+		return
+	}
+
+	if len(rc.Hash) == 0 {
+		return
+	}
+
+	card.rc = rc
+	card.errorCounterRC = DEFAULT_RC_ERROR_COUNTER
+
+	return
+}
+
+// SetResettingCode configures the resetting code (RC), which allows to reset
+// the PW1 retry counter with RESET RETRY COUNTER, an empty code disables RC.
+//
+// The code verifier is kept on persistent storage, encrypted when SNVS is
+// enabled. When KDF is enabled the verifier is computed on the code derived
+// hash, as sent by the host.
+func (card *Interface) SetResettingCode(code []byte) (err error) {
+	if len(code) != 0 && (len(code) < RC_MIN_LENGTH || len(code) > RC_MAX_LENGTH) {
+		return errors.New("invalid resetting code length")
+	}
+
+	return card.setResettingCode(card.kdfPIN(DO_RESETTING_CODE, code))
+}
+
+func (card *Interface) setResettingCode(code []byte) (err error) {
+	rc, err := applet.NewPINVerifier(code)
+
+	if err != nil {
+		return
+	}
+
+	if err = card.save(STORE_RESETTING_CODE, rc); err != nil {
+		return
+	}
+
+	if len(code) == 0 {
+		card.rc = nil
+		card.errorCounterRC = 0
+		log.Printf("OpenPGP resetting code disabled")
+	} else {
+		card.rc = rc
+		card.errorCounterRC = DEFAULT_RC_ERROR_COUNTER
+		log.Printf("OpenPGP resetting code set")
+	}
+
+	if card.initialized {
+		err = card.saveCounters()
+	}
+
+	return
+}
+
+// putResettingCode implements PUT DATA for the resetting code (D3).
+func (card *Interface) putResettingCode(data []byte) *apdu.RAPDU {
+	if len(data) != 0 && (len(data) < RC_MIN_LENGTH || len(data) > RC_MAX_LENGTH) {
+		return applet.WrongData()
+	}
+
+	if err := card.setResettingCode(data); err != nil {
+		log.Printf("PUT DATA: resetting code error, %v", err)
+		return UnrecoverableError()
+	}
+
+	return applet.CommandCompleted(nil)
+}
+
+// UnblockPW1 resets the PW1 retry counter, it is meant for use by the
+// management interface.
+func (card *Interface) UnblockPW1() (err error) {
+	if !card.initialized {
+		return errors.New("card not initialized")
+	}
+
+	if err = card.setCounter(&card.errorCounterPW1, DEFAULT_PW1_ERROR_COUNTER); err != nil {
+		return
+	}
+
+	log.Printf("OpenPGP PW1 retry counter reset")
+
+	return
+}
+
+// ResetRetryCounter implements
+// p54, 7.2.4 RESET RETRY COUNTER, OpenPGP application Version 3.4.
+//
+// As PW1 represents the actual private key passphrase, the new PW1 value
+// protects keys generated or imported on card, as with CHANGE REFERENCE DATA,
+// and the retry counter is reset.
+//
+// The command is refused when the current passphrase of such keys is not
+// known to the card, that is when it has been changed and not verified since
+// selection, when no such key is present (bundled keys retain their own
+// passphrase) or when KDF is enabled. The management interface `unblock`
+// command can be used instead (see UnblockPW1).
+func (card *Interface) ResetRetryCounter(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	var pw1 []byte
+
+	if P2 != RESET_PW1 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	old, err := card.keyPassphrase()
+
+	if err != nil || card.kdf != nil || !card.onCardKeys() {
+		log.Printf("RESET RETRY COUNTER: new PW1 cannot be applied")
+		return applet.CommandNotAllowed(), nil
+	}
+
+	switch P1 {
+	case RESET_WITH_RC:
+		if card.rc == nil {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		if card.errorCounterRC == 0 {
+			log.Printf("RESET RETRY COUNTER: resetting code error counter blocked")
+			return VerifyFail(card.errorCounterRC), nil
+		}
+
+		if len(data) < card.rc.Length {
+			return applet.WrongData(), nil
+		}
+
+		// The counter is decreased, and saved, ahead of the
+		// verification attempt so that a power interruption cannot
+		// skip it.
+		if err = card.setCounter(&card.errorCounterRC, card.errorCounterRC-1); err != nil {
+			return UnrecoverableError(), nil
+		}
+
+		if !card.rc.Verify(data[:card.rc.Length]) {
+			log.Printf("RESET RETRY COUNTER: resetting code error")
+			return VerifyFail(card.errorCounterRC), nil
+		}
+
+		card.setCounter(&card.errorCounterRC, DEFAULT_RC_ERROR_COUNTER)
+		pw1 = data[card.rc.Length:]
+	case RESET_WITH_PW3:
+		if !card.adminVerified {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		pw1 = data
+	default:
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(pw1) < PW1_MIN_LENGTH || len(pw1) > PW1_MAX_LENGTH {
+		return applet.WrongData(), nil
+	}
+
+	if err = card.changePW1(old, pw1); err != nil {
+		log.Printf("RESET RETRY COUNTER: PW1 change error, %v", err)
+		return UnrecoverableError(), nil
+	}
+
+	if err = card.UnblockPW1(); err != nil {
+		return UnrecoverableError(), nil
+	}
+
+	return applet.CommandCompleted(nil), nil
+}
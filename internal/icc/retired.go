@@ -0,0 +1,185 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// retiredKey represents a retired decryption subkey, kept to decrypt data
+// encrypted to it before key rotation.
+type retiredKey struct {
+	subkey *openpgp.Subkey
+	// encrypted private key cache for PW_LOCK
+	encrypted packet.PrivateKey
+	// serialized private key packet, encrypted with PW1, of a key
+	// generated or imported on card (nil for bundled keys)
+	key []byte
+}
+
+// retire adds a decryption subkey to the retired ones, unless already present
+// or missing its secret part, it returns whether the subkey has been added.
+func (id *identity) retire(r *retiredKey) bool {
+	if pk := r.subkey.PrivateKey; pk == nil || pk.Dummy() {
+		return false
+	}
+
+	for _, k := range id.retired {
+		if bytes.Equal(k.subkey.PublicKey.Fingerprint, r.subkey.PublicKey.Fingerprint) {
+			return false
+		}
+	}
+
+	id.retired = append(id.retired, r)
+
+	return true
+}
+
+// retireDecryptionKey retires the decryption subkey, before its replacement,
+// keys generated or imported on card are retained on persistent storage.
+func (card *Interface) retireDecryptionKey() (err error) {
+	retired := card.retired
+
+	r := &retiredKey{
+		subkey:    card.Dec,
+		encrypted: card.dec,
+		key:       card.slot(KEY_DEC).Key,
+	}
+
+	if !card.retire(r) || len(r.key) == 0 {
+		return
+	}
+
+	var keys [][]byte
+
+	for _, k := range card.retired {
+		if len(k.key) > 0 {
+			keys = append(keys, k.key)
+		}
+	}
+
+	if err = card.save(card.entry(STORE_RETIRED_KEYS), keys); err != nil {
+		card.retired = retired
+		return
+	}
+
+	log.Printf("key %d % X retired", KEY_DEC, r.subkey.PublicKey.Fingerprint)
+
+	return
+}
+
+// loadRetiredKeys restores retired keys generated or imported on card from
+// persistent storage.
+func (card *Interface) loadRetiredKeys() (err error) {
+	var keys [][]byte
+
+	if err = card.load(card.entry(STORE_RETIRED_KEYS), &keys); err != nil {
+		return
+	}
+
+	for i, buf := range keys {
+		privateKey, err := readPrivateKey(buf)
+
+		if err != nil {
+			return fmt.Errorf("invalid retired key %d, %v", i, err)
+		}
+
+		// the key might have been restored before its replacement
+		if card.Dec != nil && bytes.Equal(card.Dec.PublicKey.Fingerprint, privateKey.Fingerprint) {
+			continue
+		}
+
+		card.retire(&retiredKey{
+			subkey: &openpgp.Subkey{
+				PublicKey:  &privateKey.PublicKey,
+				PrivateKey: privateKey,
+			},
+			encrypted: *privateKey,
+			key:       buf,
+		})
+	}
+
+	return
+}
+
+// decipherSubkeys returns the subkeys candidate for PSO:DEC, the decryption
+// subkey is followed by retired ones unless one of them is forced (see
+// SelectRetiredKey).
+func (card *Interface) decipherSubkeys(key byte) []*openpgp.Subkey {
+	if key != KEY_DEC {
+		return presentSubkeys([]*openpgp.Subkey{card.subkey(key)})
+	}
+
+	if n := card.retiredOverride; n > 0 {
+		return []*openpgp.Subkey{card.retired[n-1].subkey}
+	}
+
+	subkeys := []*openpgp.Subkey{card.Dec}
+
+	for _, r := range card.retired {
+		subkeys = append(subkeys, r.subkey)
+	}
+
+	return presentSubkeys(subkeys)
+}
+
+// unlockRetired decrypts retired subkeys with the PW1 passphrase, retired
+// subkeys protected with a different passphrase must be unlocked over SSH.
+func (card *Interface) unlockRetired(passphrase []byte) {
+	if len(passphrase) == 0 {
+		return
+	}
+
+	for _, r := range card.retired {
+		if pk := r.subkey.PrivateKey; pk.Encrypted && pk.Decrypt(passphrase) == nil {
+			logVerify([]*openpgp.Subkey{r.subkey}, "unlocked (retired)")
+		}
+	}
+}
+
+// lockRetired overwrites decrypted retired subkeys with their encrypted
+// version (see Restore).
+func (card *Interface) lockRetired() {
+	for _, r := range card.retired {
+		if !r.subkey.PrivateKey.Encrypted {
+			card.lock(r.subkey)
+		}
+	}
+}
+
+// SelectRetiredKey forces the use of a retired decryption subkey for PSO:DEC,
+// numbered from 1 as reported by Status, 0 restores automatic selection.
+//
+// Automatic selection uses the decryption subkey, or the first retired one
+// matching the cryptogram algorithm, size and curve. Forcing a retired subkey
+// is required when more than one subkey matches (e.g. on the same curve).
+func (card *Interface) SelectRetiredKey(n int) (err error) {
+	if !card.initialized {
+		return errors.New("card not initialized")
+	}
+
+	if n < 0 || n > len(card.retired) {
+		return fmt.Errorf("invalid retired key, must be between 0 and %d", len(card.retired))
+	}
+
+	card.retiredOverride = n
+
+	if n == 0 {
+		log.Printf("PSO:DEC automatic key selection")
+	} else {
+		log.Printf("PSO:DEC forced to retired key % X", card.retired[n-1].subkey.PublicKey.Fingerprint)
+	}
+
+	return
+}
@@ -36,7 +36,7 @@ func (card *Interface) getObjects() (objs []p11kit.Object, err error) {
 		return nil, errors.New("security condition not satisfied")
 	}
 
-	if PW1_CDS_MULTI == 0 {
+	if card.pw1Status == PW1_CDS_MULTI {
 		defer card.Verify(PW_LOCK, PW1_CDS, nil)
 	}
 
@@ -60,16 +60,20 @@ func (card *Interface) getObjects() (objs []p11kit.Object, err error) {
 
 	switch privKey := subkey.PrivateKey.PrivateKey.(type) {
 	case *rsa.PrivateKey:
-		der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &privKey.PublicKey, privKey)
+		// a cardholder certificate matching the signature key takes
+		// precedence over a self-signed one
+		cert, err := x509.ParseCertificate(card.Certificate(CERTIFICATE_SIG))
 
-		if err != nil {
-			return nil, err
-		}
+		if err != nil || !privKey.PublicKey.Equal(cert.PublicKey) {
+			der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &privKey.PublicKey, privKey)
 
-		cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
 
-		if err != nil {
-			return nil, err
+			if cert, err = x509.ParseCertificate(der); err != nil {
+				return nil, err
+			}
 		}
 
 		obj, err := p11kit.NewX509CertificateObject(cert)
@@ -0,0 +1,93 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package icc
+
+import (
+	"github.com/usbarmory/GoKey/internal/storage"
+)
+
+// Persistent storage entry names.
+const (
+	STORE_CARDHOLDER     = "openpgp-cardholder"
+	STORE_ADMIN          = "openpgp-admin"
+	STORE_RESETTING_CODE = "openpgp-resetting-code"
+	STORE_KEYS           = "openpgp-keys"
+	STORE_RETIRED_KEYS   = "openpgp-retired-keys"
+	STORE_PW1            = "openpgp-pw1"
+	STORE_CERTIFICATES   = "openpgp-certificates"
+	STORE_COUNTERS       = "openpgp-counters"
+	STORE_LIFECYCLE      = "openpgp-lifecycle"
+	STORE_KDF            = "openpgp-kdf"
+	STORE_PRIVATE_DATA   = "openpgp-private-data"
+	STORE_IDENTITY       = "openpgp-identity"
+)
+
+// cardholderData represents the cardholder related Data Objects which can be
+// changed with PUT DATA.
+type cardholderData struct {
+	Name           string
+	Language       string
+	Sex            string
+	URL            string
+	LoginData      []byte
+	CAFingerprints []byte
+}
+
+// load reads a persistent storage entry, decrypting it when SNVS is enabled.
+// A missing entry (or storage) is not an error and leaves the value
+// unchanged.
+func (card *Interface) load(name string, v any) (err error) {
+	return card.loadDiversified(name, DiversifierPGP, v)
+}
+
+// loadDiversified is like load but with a specific SNVS diversifier.
+func (card *Interface) loadDiversified(name string, diversifier string, v any) (err error) {
+	return storage.Load(card.Storage, name, diversifier, card.SNVS, v)
+}
+
+// save writes a persistent storage entry, encrypting it when SNVS is enabled.
+func (card *Interface) save(name string, v any) (err error) {
+	return card.saveDiversified(name, DiversifierPGP, v)
+}
+
+// saveDiversified is like save but with a specific SNVS diversifier.
+func (card *Interface) saveDiversified(name string, diversifier string, v any) (err error) {
+	return storage.Save(card.Storage, name, diversifier, card.SNVS, v)
+}
+
+func (card *Interface) cardholderData() *cardholderData {
+	return &cardholderData{
+		Name:           card.Name,
+		Language:       card.Language,
+		Sex:            card.Sex,
+		URL:            card.URL,
+		LoginData:      card.LoginData,
+		CAFingerprints: card.caFingerprints,
+	}
+}
+
+func (card *Interface) setCardholderData(data *cardholderData) {
+	card.Name = data.Name
+	card.Language = data.Language
+	card.Sex = data.Sex
+	card.URL = data.URL
+	card.LoginData = data.LoginData
+	card.caFingerprints = data.CAFingerprints
+}
+
+func (card *Interface) loadCardholderData() (err error) {
+	data := card.cardholderData()
+
+	if err = card.load(STORE_CARDHOLDER, data); err != nil {
+		return
+	}
+
+	card.setCardholderData(data)
+
+	return
+}
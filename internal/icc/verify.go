@@ -9,6 +9,9 @@ package icc
 
 import (
 	"log"
+	"slices"
+
+	"github.com/usbarmory/GoKey/internal/applet"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/hsanjuan/go-nfctype4/apdu"
@@ -24,6 +27,11 @@ const (
 	PW1_CDS = 0x81
 	PW1     = 0x82
 	PW3     = 0x83
+
+	// Internal references, not accepted over VERIFY, which allow the
+	// management console to address the PW1 subkeys individually.
+	PW1_DEC = 0x02
+	PW1_AUT = 0x03
 )
 
 // Verify implements
@@ -36,101 +44,247 @@ const (
 // Therefore the passphrase/PIN verification status matches the presence of a
 // decrypted subkey in memory.
 //
-// Verification of the admin password (PW3) is not supported as, in this
-// implementation, card personalization is managed outside OpenPGP
-// specifications.
+// PW1 (82) covers both the decryption and authentication subkeys (PSO:DEC,
+// PSO:ENC and INTERNAL AUTHENTICATE), each tracked with its own verification
+// state. The passphrase is considered verified, and the error counter reset,
+// if it unlocks at least one of them.
+//
+// When the key derived format (KDF) is enabled PW1 is received as derived
+// hash, which unseals the key passphrase stored at provisioning (see SetKDF).
+//
+// Verification of the admin password (PW3) is only available when an admin
+// PIN has been configured through the management interface, its verification
+// status is independent from any subkey.
 func (card *Interface) Verify(P1 byte, P2 byte, passphrase []byte) (rapdu *apdu.RAPDU, err error) {
-	var subkey *openpgp.Subkey
+	var subkeys []*openpgp.Subkey
 
 	defer card.signalVerificationStatus()
 
 	switch P2 {
 	case PW1_CDS:
-		subkey = card.Sig
+		subkeys = []*openpgp.Subkey{card.Sig}
 	case PW1:
-		// Used for PSO:DEC and PSO:ENC, the latter operation does not
-		// use any OpenPGP key but we still use the same subkey for
-		// cardholder authentication.
-		subkey = card.Dec
+		// Used for PSO:DEC, PSO:ENC and INTERNAL AUTHENTICATE, PSO:ENC
+		// does not use any OpenPGP key but we still use the decryption
+		// subkey for cardholder authentication.
+		subkeys = []*openpgp.Subkey{card.Dec, card.Aut}
+	case PW1_DEC:
+		subkeys = []*openpgp.Subkey{card.Dec}
+	case PW1_AUT:
+		subkeys = []*openpgp.Subkey{card.Aut}
 	case PW3:
-		// PW3 is not implemented as card personalization is managed
-		// outside OpenPGP specifications.
-		return CommandNotAllowed(), nil
+		return card.verifyAdmin(P1, passphrase), nil
 	}
 
-	if subkey == nil || subkey.PrivateKey == nil {
-		log.Printf("missing key for VERIFY")
-		return CommandNotAllowed(), nil
+	if P2 == PW1_CDS || P2 == PW1 {
+		// with KDF the host sends the PW1 derived hash
+		passphrase = card.kdfPassphrase(passphrase)
 	}
 
-	var msg string
+	subkeys = presentSubkeys(subkeys)
+
+	if len(subkeys) == 0 {
+		return card.verifyDefault(P1, passphrase), nil
+	}
+
+	// retired decryption subkeys follow the decryption subkey
+	retired := P2 == PW1 || P2 == PW1_DEC
 
 	switch P1 {
 	case PW_VERIFY:
-		switch {
-		case len(passphrase) == 0:
-			// return access status when PW empty
-			if !subkey.PrivateKey.Encrypted {
-				rapdu = CommandCompleted(nil)
-			} else {
-				rapdu = VerifyFail(card.errorCounterPW1)
-			}
-		case !subkey.PrivateKey.Encrypted:
-			// To support the out-of-band `unlock` management
-			// command over SSH we deviate from specifications.
-			//
-			// If the key is already decrypted then we return
-			// success rather than re-verifying the passphrase.
-			//
-			// This prevents plaintext transmission of the passphrase
-			// (which can be a dummy if already unlocked).
-			msg = "already unlocked"
-		case card.errorCounterPW1 == 0:
-			// for now this counter is volatile across reboots
-			msg = "error counter blocked, cannot unlock"
-			rapdu = VerifyFail(card.errorCounterPW1)
-		case subkey.PrivateKey.Decrypt(passphrase) == nil:
-			// correct verification sets resets counter to default value
-			card.errorCounterPW1 = DEFAULT_PW1_ERROR_COUNTER
-			msg = "unlocked"
-		default:
-			// The standard is not clear on the specific conditions
-			// that decrese the counter as "incorrect usage" is
-			// mentioned. This implementation only cares to prevent
-			// passphrase brute forcing.
-			card.errorCounterPW1 -= 1
-			msg = "unlock error"
-			rapdu = VerifyFail(card.errorCounterPW1)
+		if rapdu = card.verify(subkeys, passphrase); rapdu == nil && retired {
+			card.unlockRetired(passphrase)
+		}
+
+		if rapdu == nil && (P2 == PW1_CDS || P2 == PW1) {
+			card.retainPW1(passphrase)
 		}
 	case PW_LOCK:
-		if subkey.PrivateKey.Encrypted {
-			msg = "already locked"
-		} else {
-			subkey.PrivateKey = card.Restore(subkey)
+		if P2 == PW1_CDS || P2 == PW1 {
+			card.pw1Passphrase = nil
+		}
+
+		for _, subkey := range subkeys {
+			card.lock(subkey)
+		}
 
-			if subkey.PrivateKey.Encrypted {
-				msg = "locked"
-			} else {
-				msg = "remains unlocked (no passphrase)"
-			}
+		if retired {
+			card.lockRetired()
 		}
 	default:
-		return CommandNotAllowed(), nil
+		return applet.CommandNotAllowed(), nil
 	}
 
-	if msg != "" {
-		log.Printf("VERIFY: % X %s", subkey.PrivateKey.Fingerprint, msg)
+	if rapdu == nil {
+		rapdu = applet.CommandCompleted(nil)
 	}
 
-	if rapdu == nil {
-		rapdu = CommandCompleted(nil)
+	return
+}
+
+// verifyCommand implements VERIFY received as APDU command, the subkeys it
+// unlocks are tracked so that they can be locked on deselection (see
+// Deselect).
+func (card *Interface) verifyCommand(P1 byte, P2 byte, passphrase []byte) (rapdu *apdu.RAPDU, err error) {
+	unlocked := card.unlockedSubkeys()
+
+	if rapdu, err = card.Verify(P1, P2, passphrase); err != nil {
+		return
+	}
+
+	for _, subkey := range card.unlockedSubkeys() {
+		if !slices.Contains(unlocked, subkey) {
+			card.verified = append(card.verified, subkey)
+		}
+	}
+
+	return
+}
+
+// unlockedSubkeys returns the subkeys, including retired ones, whose private
+// key is decrypted.
+func (card *Interface) unlockedSubkeys() (unlocked []*openpgp.Subkey) {
+	subkeys := []*openpgp.Subkey{card.Sig, card.Dec, card.Aut}
+
+	for _, r := range card.retired {
+		subkeys = append(subkeys, r.subkey)
+	}
+
+	for _, subkey := range subkeys {
+		if subkey == nil || subkey.PrivateKey == nil || subkey.PrivateKey.Encrypted {
+			continue
+		}
+
+		if !slices.Contains(unlocked, subkey) {
+			unlocked = append(unlocked, subkey)
+		}
 	}
 
 	return
 }
 
+// presentSubkeys filters out missing subkeys, as well as duplicates (e.g. a
+// subkey flagged for both decryption and authentication).
+func presentSubkeys(subkeys []*openpgp.Subkey) (present []*openpgp.Subkey) {
+	for _, subkey := range subkeys {
+		if subkey == nil || subkey.PrivateKey == nil {
+			continue
+		}
+
+		if slices.Contains(present, subkey) {
+			continue
+		}
+
+		present = append(present, subkey)
+	}
+
+	return
+}
+
+func (card *Interface) verify(subkeys []*openpgp.Subkey, passphrase []byte) (rapdu *apdu.RAPDU) {
+	var locked int
+	var unlocked int
+
+	for _, subkey := range subkeys {
+		if subkey.PrivateKey.Encrypted {
+			locked += 1
+		}
+	}
+
+	switch {
+	case len(passphrase) == 0:
+		// return access status when PW empty
+		if locked != 0 {
+			rapdu = VerifyFail(card.errorCounterPW1)
+		}
+
+		return
+	case locked == 0:
+		// To support the out-of-band `unlock` management command over
+		// SSH we deviate from specifications.
+		//
+		// If the keys are already decrypted then we return success
+		// rather than re-verifying the passphrase.
+		//
+		// This prevents plaintext transmission of the passphrase
+		// (which can be a dummy if already unlocked).
+		logVerify(subkeys, "already unlocked")
+		return
+	case card.errorCounterPW1 == 0:
+		logVerify(subkeys, "error counter blocked, cannot unlock")
+		return VerifyFail(card.errorCounterPW1)
+	}
+
+	// The counter is decreased, and saved, ahead of the verification
+	// attempt so that a power interruption cannot skip it.
+	if err := card.setCounter(&card.errorCounterPW1, card.errorCounterPW1-1); err != nil {
+		return UnrecoverableError()
+	}
+
+	for _, subkey := range subkeys {
+		if !subkey.PrivateKey.Encrypted {
+			continue
+		}
+
+		if subkey.PrivateKey.Decrypt(passphrase) == nil {
+			logVerify([]*openpgp.Subkey{subkey}, "unlocked")
+			unlocked += 1
+		}
+	}
+
+	switch {
+	case unlocked > 0:
+		// Correct verification resets the counter to its default
+		// value, even when a subkey of the group with a different
+		// passphrase remains locked, as it would otherwise be drained
+		// by normal use.
+		card.setCounter(&card.errorCounterPW1, DEFAULT_PW1_ERROR_COUNTER)
+
+		if unlocked < locked {
+			logVerify(subkeys, "partially unlocked")
+		}
+	default:
+		// The standard is not clear on the specific conditions that
+		// decrese the counter as "incorrect usage" is mentioned. This
+		// implementation only cares to prevent passphrase brute
+		// forcing.
+		logVerify(subkeys, "unlock error")
+		rapdu = VerifyFail(card.errorCounterPW1)
+	}
+
+	return
+}
+
+func (card *Interface) lock(subkey *openpgp.Subkey) {
+	var msg string
+
+	card.verified = slices.DeleteFunc(card.verified, func(s *openpgp.Subkey) bool {
+		return s == subkey
+	})
+
+	if subkey.PrivateKey.Encrypted {
+		msg = "already locked"
+	} else {
+		subkey.PrivateKey = card.Restore(subkey)
+
+		if subkey.PrivateKey.Encrypted {
+			msg = "locked"
+		} else {
+			msg = "remains unlocked (no passphrase)"
+		}
+	}
+
+	logVerify([]*openpgp.Subkey{subkey}, msg)
+}
+
+func logVerify(subkeys []*openpgp.Subkey, msg string) {
+	for _, subkey := range subkeys {
+		log.Printf("VERIFY: % X %s", subkey.PrivateKey.Fingerprint, msg)
+	}
+}
+
 func (card *Interface) signalVerificationStatus() {
-	for _, subkey := range []*openpgp.Subkey{card.Sig, card.Dec} {
+	for _, subkey := range []*openpgp.Subkey{card.Sig, card.Dec, card.Aut} {
 		if subkey != nil && subkey.PrivateKey != nil && subkey.PrivateKey.PrivateKey != nil && !subkey.PrivateKey.Encrypted {
 			// at least one key is unlocked
 			LED("blue", true)
@@ -0,0 +1,40 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package oath
+
+import (
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+func AuthenticationRequired() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x82,
+	}
+}
+
+func NoSuchObject() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x84,
+	}
+}
+
+func ResponseMismatch() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x69,
+		SW2: 0x84,
+	}
+}
+
+func NoSpace() *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x6a,
+		SW2: 0x84,
+	}
+}
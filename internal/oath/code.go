@@ -0,0 +1,131 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package oath
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// mac returns the HMAC of a challenge with the access code key.
+func mac(alg byte, key []byte, challenge []byte) ([]byte, error) {
+	h, err := hashFunc(alg & ALG_MASK)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := hmac.New(h, key)
+	m.Write(challenge)
+
+	return m.Sum(nil), nil
+}
+
+// SetCode implements the YKOATH SET CODE command, the access code key is
+// derived by the host from the user password and the device salt. An empty
+// key removes the access code.
+func (oath *Applet) SetCode(data []byte) (rapdu *apdu.RAPDU, err error) {
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	key, ok := tlv[TAG_KEY]
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	s := *oath.state
+
+	if len(key) == 0 {
+		s.CodeAlgorithm = 0
+		s.Code = nil
+	} else {
+		if len(key) < 2 {
+			return applet.WrongData(), nil
+		}
+
+		// verify that the host holds the new key
+		res, err := mac(key[0], key[1:], tlv[TAG_CHALLENGE])
+
+		if err != nil || len(tlv[TAG_CHALLENGE]) == 0 {
+			return applet.WrongData(), nil
+		}
+
+		if !hmac.Equal(res, tlv[TAG_RESPONSE]) {
+			return ResponseMismatch(), nil
+		}
+
+		s.CodeAlgorithm = key[0]
+		s.Code = bytes.Clone(key[1:])
+	}
+
+	if err = oath.save(STORE_STATE, &s); err != nil {
+		log.Printf("OATH SET CODE error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	oath.state = &s
+
+	if len(s.Code) == 0 {
+		log.Printf("OATH access code removed")
+	} else {
+		log.Printf("OATH access code set")
+	}
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// Validate implements the YKOATH VALIDATE command, the response to the SELECT
+// challenge is verified and the host challenge response is returned.
+func (oath *Applet) Validate(data []byte) (rapdu *apdu.RAPDU, err error) {
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	s := oath.state
+	challenge := oath.challenge
+
+	oath.validated = false
+	oath.challenge = nil
+
+	if len(s.Code) == 0 || len(challenge) == 0 {
+		return AuthenticationRequired(), nil
+	}
+
+	expected, err := mac(s.CodeAlgorithm, s.Code, challenge)
+
+	if err != nil {
+		return
+	}
+
+	if !hmac.Equal(expected, tlv[TAG_RESPONSE]) {
+		log.Printf("OATH access code validation failed")
+		return ResponseMismatch(), nil
+	}
+
+	res, err := mac(s.CodeAlgorithm, s.Code, tlv[TAG_CHALLENGE])
+
+	if err != nil {
+		return
+	}
+
+	oath.validated = true
+
+	return applet.CommandCompleted(bertlv.Encode(TAG_RESPONSE, res)), nil
+}
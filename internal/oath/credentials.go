@@ -0,0 +1,373 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package oath
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+	"github.com/usbarmory/GoKey/internal/icc"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// YKOATH credential types (high nibble)
+	TYPE_HOTP = 0x10
+	TYPE_TOTP = 0x20
+	TYPE_MASK = 0xf0
+
+	// YKOATH algorithms (low nibble)
+	ALG_SHA1   = 0x01
+	ALG_SHA256 = 0x02
+	ALG_SHA512 = 0x03
+	ALG_MASK   = 0x0f
+
+	// YKOATH properties
+	PROPERTY_INCREASING = 0x01
+	PROPERTY_TOUCH      = 0x02
+
+	MAX_NAME_LENGTH = 64
+	MIN_DIGITS      = 6
+	MAX_DIGITS      = 8
+	MAX_CREDENTIALS = 32
+
+	// default TOTP period, used to interpret CALCULATE ALL challenges
+	TOTP_PERIOD = 30
+)
+
+var typeNames = map[byte]string{
+	TYPE_HOTP: "HOTP",
+	TYPE_TOTP: "TOTP",
+}
+
+var algorithmNames = map[byte]string{
+	ALG_SHA1:   "SHA1",
+	ALG_SHA256: "SHA256",
+	ALG_SHA512: "SHA512",
+}
+
+// credential represents an OATH credential.
+type credential struct {
+	Name      []byte
+	Type      byte
+	Algorithm byte
+	Digits    byte
+	Secret    []byte
+	Touch     bool
+	// HOTP moving factor
+	Counter uint64
+}
+
+func hashFunc(alg byte) (func() hash.Hash, error) {
+	switch alg {
+	case ALG_SHA1:
+		return sha1.New, nil
+	case ALG_SHA256:
+		return sha256.New, nil
+	case ALG_SHA512:
+		return sha512.New, nil
+	}
+
+	return nil, errors.New("unsupported algorithm")
+}
+
+// parse returns the YKOATH data objects of a command, the property tag is
+// the only one lacking a length field.
+func parse(data []byte) (tlv map[bertlv.Tag][]byte, err error) {
+	var tag bertlv.Tag
+	var value []byte
+
+	tlv = make(map[bertlv.Tag][]byte)
+
+	for len(data) > 0 {
+		if data[0] == TAG_PROPERTY {
+			if len(data) < 2 {
+				return nil, errors.New("invalid property")
+			}
+
+			tlv[TAG_PROPERTY] = data[1:2]
+			data = data[2:]
+
+			continue
+		}
+
+		if tag, value, data, err = bertlv.Next(data); err != nil {
+			return
+		}
+
+		tlv[tag] = value
+	}
+
+	return
+}
+
+func (oath *Applet) find(name []byte) int {
+	return slices.IndexFunc(oath.state.Credentials, func(c *credential) bool {
+		return bytes.Equal(c.Name, name)
+	})
+}
+
+// userPresence verifies the user presence, through the Presence channel, for
+// credentials requiring touch.
+func (oath *Applet) userPresence(c *credential) (present bool) {
+	if !c.Touch {
+		return true
+	}
+
+	if oath.Presence == nil {
+		log.Printf("OATH user presence required, but not available")
+		return false
+	}
+
+	log.Printf("OATH user presence request for %s, type `p` within %ds to confirm", c.Name, icc.PRESENCE_TIMEOUT)
+
+	select {
+	case <-oath.Presence:
+		present = true
+		log.Printf("OATH user presence confirmed")
+	case <-time.After(icc.PRESENCE_TIMEOUT * time.Second):
+		log.Printf("OATH user presence request timed out")
+	}
+
+	return
+}
+
+// calculate returns the HMAC of a challenge, for HOTP credentials the
+// challenge is the moving factor which is incremented.
+func (oath *Applet) calculate(c *credential, challenge []byte) (res []byte, err error) {
+	h, err := hashFunc(c.Algorithm)
+
+	if err != nil {
+		return
+	}
+
+	if c.Type == TYPE_HOTP {
+		challenge = binary.BigEndian.AppendUint64(nil, c.Counter)
+
+		// The counter is increased, and saved, ahead of the
+		// calculation so that codes are never reused.
+		c.Counter += 1
+
+		if err = oath.save(STORE_STATE, oath.state); err != nil {
+			c.Counter -= 1
+			return
+		}
+	}
+
+	mac := hmac.New(h, c.Secret)
+	mac.Write(challenge)
+
+	return mac.Sum(nil), nil
+}
+
+// response returns the full or truncated (RFC 4226, 5.3) response data object
+// for a credential.
+func response(c *credential, mac []byte, truncate bool) []byte {
+	if !truncate {
+		return bertlv.Encode(TAG_RESPONSE, append([]byte{c.Digits}, mac...))
+	}
+
+	off := mac[len(mac)-1] & 0x0f
+	code := binary.BigEndian.Uint32(mac[off:off+4]) & 0x7fffffff
+
+	return bertlv.Encode(TAG_TRUNCATED, binary.BigEndian.AppendUint32([]byte{c.Digits}, code))
+}
+
+// Put implements the YKOATH PUT command, an existing credential with the same
+// name is replaced.
+func (oath *Applet) Put(data []byte) (rapdu *apdu.RAPDU, err error) {
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	name := tlv[TAG_NAME]
+	key := tlv[TAG_KEY]
+
+	if len(name) == 0 || len(name) > MAX_NAME_LENGTH || len(key) < 3 {
+		return applet.WrongData(), nil
+	}
+
+	c := &credential{
+		Name:      bytes.Clone(name),
+		Type:      key[0] & TYPE_MASK,
+		Algorithm: key[0] & ALG_MASK,
+		Digits:    key[1],
+		Secret:    bytes.Clone(key[2:]),
+	}
+
+	if _, ok := typeNames[c.Type]; !ok {
+		return applet.WrongData(), nil
+	}
+
+	if _, err = hashFunc(c.Algorithm); err != nil || c.Digits < MIN_DIGITS || c.Digits > MAX_DIGITS {
+		return applet.WrongData(), nil
+	}
+
+	if p, ok := tlv[TAG_PROPERTY]; ok {
+		c.Touch = p[0]&PROPERTY_TOUCH != 0
+	}
+
+	if imf, ok := tlv[TAG_IMF]; ok {
+		if c.Type != TYPE_HOTP || len(imf) != 4 {
+			return applet.WrongData(), nil
+		}
+
+		c.Counter = uint64(binary.BigEndian.Uint32(imf))
+	}
+
+	credentials := slices.Clone(oath.state.Credentials)
+
+	if i := oath.find(name); i >= 0 {
+		credentials[i] = c
+	} else if len(credentials) >= MAX_CREDENTIALS {
+		return NoSpace(), nil
+	} else {
+		credentials = append(credentials, c)
+	}
+
+	if rapdu = oath.setCredentials(credentials); rapdu != nil {
+		return
+	}
+
+	log.Printf("OATH credential %s stored (%s %s)", c.Name, typeNames[c.Type], algorithmNames[c.Algorithm])
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// Delete implements the YKOATH DELETE command.
+func (oath *Applet) Delete(data []byte) (rapdu *apdu.RAPDU, err error) {
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	i := oath.find(tlv[TAG_NAME])
+
+	if i < 0 {
+		return NoSuchObject(), nil
+	}
+
+	credentials := slices.Delete(slices.Clone(oath.state.Credentials), i, i+1)
+
+	if rapdu = oath.setCredentials(credentials); rapdu != nil {
+		return
+	}
+
+	log.Printf("OATH credential %s deleted", tlv[TAG_NAME])
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// List implements the YKOATH LIST command.
+func (oath *Applet) List() (rapdu *apdu.RAPDU, err error) {
+	var res []byte
+
+	for _, c := range oath.state.Credentials {
+		res = append(res, bertlv.Encode(TAG_NAME_LIST, append([]byte{c.Type | c.Algorithm}, c.Name...))...)
+	}
+
+	return applet.CommandCompleted(res), nil
+}
+
+// Calculate implements the YKOATH CALCULATE command.
+func (oath *Applet) Calculate(P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	challenge, ok := tlv[TAG_CHALLENGE]
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	i := oath.find(tlv[TAG_NAME])
+
+	if i < 0 {
+		return NoSuchObject(), nil
+	}
+
+	c := oath.state.Credentials[i]
+
+	if !oath.userPresence(c) {
+		return applet.ConditionsNotSatisfied(), nil
+	}
+
+	mac, err := oath.calculate(c, challenge)
+
+	if err != nil {
+		log.Printf("OATH CALCULATE error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	return applet.CommandCompleted(response(c, mac, P2 == CALCULATE_TRUNCATE)), nil
+}
+
+// CalculateAll implements the YKOATH CALCULATE ALL command, codes are
+// returned for all TOTP credentials not requiring touch.
+//
+// The challenge, carrying the host time step for the default TOTP period, is
+// retained as the device time reference.
+func (oath *Applet) CalculateAll(P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	var res []byte
+
+	tlv, err := parse(data)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	challenge, ok := tlv[TAG_CHALLENGE]
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	if len(challenge) == 8 {
+		step := binary.BigEndian.Uint64(challenge)
+		oath.time = time.Unix(int64(step*TOTP_PERIOD), 0).UTC()
+	}
+
+	for _, c := range oath.state.Credentials {
+		res = append(res, bertlv.Encode(TAG_NAME, c.Name)...)
+
+		switch {
+		case c.Type == TYPE_HOTP:
+			res = append(res, bertlv.Encode(TAG_HOTP, []byte{c.Digits})...)
+		case c.Touch:
+			res = append(res, bertlv.Encode(TAG_TOUCH, []byte{c.Digits})...)
+		default:
+			mac, err := oath.calculate(c, challenge)
+
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, response(c, mac, P2 == CALCULATE_TRUNCATE)...)
+		}
+	}
+
+	return applet.CommandCompleted(res), nil
+}
@@ -0,0 +1,281 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package oath implements an OATH (HOTP/TOTP) card application compatible
+// with the Yubico YKOATH protocol, as used by `ykman oath` and Yubico
+// Authenticator.
+package oath
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+	"github.com/usbarmory/GoKey/internal/storage"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// Diversifier for hardware key derivation (OATH credentials wrapping).
+const DiversifierOATH = "GoKeySNVSOATH   "
+
+const (
+	// YKOATH instructions
+	SELECT         = 0xa4
+	PUT            = 0x01
+	DELETE         = 0x02
+	SET_CODE       = 0x03
+	RESET          = 0x04
+	LIST           = 0xa1
+	CALCULATE      = 0xa2
+	VALIDATE       = 0xa3
+	CALCULATE_ALL  = 0xa4 // with P1 other than SELECT_DF_NAME
+	SEND_REMAINING = 0xa5
+
+	// YKOATH tags
+	TAG_NAME           = 0x71
+	TAG_NAME_LIST      = 0x72
+	TAG_KEY            = 0x73
+	TAG_CHALLENGE      = 0x74
+	TAG_RESPONSE       = 0x75
+	TAG_TRUNCATED      = 0x76
+	TAG_HOTP           = 0x77
+	TAG_PROPERTY       = 0x78
+	TAG_VERSION        = 0x79
+	TAG_IMF            = 0x7a
+	TAG_ALGORITHM      = 0x7b
+	TAG_TOUCH          = 0x7c
+	TAG_SELECT_SUCCESS = 0x71
+
+	// YKOATH RESET parameters
+	RESET_P1 = 0xde
+	RESET_P2 = 0xad
+
+	// CALCULATE truncated response
+	CALCULATE_TRUNCATE = 0x01
+
+	// device identifier (and host key derivation salt) size
+	SALT_SIZE = 8
+	// access code challenge size
+	CHALLENGE_SIZE = 8
+)
+
+var (
+	// Yubico OATH application AID
+	AID = []byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x21, 0x01, 0x01}
+
+	// Yubico OATH version returned on SELECT, as it determines the
+	// features expected by management tools the version predating
+	// credential renaming is reported.
+	VERSION = []byte{0x05, 0x02, 0x07}
+)
+
+// Applet implements an OATH card application instance.
+//
+// TOTP codes are computed over the time step sent by the host as challenge,
+// as the device has no real time clock.
+type Applet struct {
+	// enable APDU debugging
+	Debug bool
+	// enable device unique hardware encryption for persistent storage
+	SNVS bool
+	// Presence is a channel used to signal user presence, required by
+	// credentials with touch property enabled.
+	Presence chan bool
+	// persistent storage for credentials and access code (optional)
+	Storage storage.Storage
+
+	// credentials and access code
+	state *state
+
+	// access code validation challenge
+	challenge []byte
+	// host time from last CALCULATE ALL challenge
+	time time.Time
+
+	// response splitting (SEND REMAINING) state
+	chaining applet.Chaining
+
+	// internal state flags
+	initialized bool
+	validated   bool
+}
+
+// Init initializes the OATH applet instance, restoring its state from
+// persistent storage when available.
+func (oath *Applet) Init() (err error) {
+	if oath.initialized {
+		return errors.New("OATH applet already initialized")
+	}
+
+	if err = oath.loadState(); err != nil {
+		return fmt.Errorf("OATH credentials loading failed, %v", err)
+	}
+
+	oath.initialized = true
+
+	log.Printf("OATH applet initialized")
+
+	return
+}
+
+// Initialized returns the OATH applet initialization state.
+func (oath *Applet) Initialized() bool {
+	return oath.initialized
+}
+
+// AID returns the OATH application identifier.
+func (oath *Applet) AID() []byte {
+	return AID
+}
+
+// Deselect resets the access code validation (see applet.Dispatcher).
+func (oath *Applet) Deselect() {
+	oath.validated = false
+	oath.challenge = nil
+	oath.chaining.Reset()
+}
+
+// authenticated returns whether commands are allowed, either as the access
+// code is not set or validated.
+func (oath *Applet) authenticated() bool {
+	return len(oath.state.Code) == 0 || oath.validated
+}
+
+// Select implements the YKOATH SELECT command, a challenge is returned when
+// an access code is set.
+func (oath *Applet) Select(P1 byte, aid []byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != applet.SELECT_DF_NAME || len(aid) < len(AID)-1 || !bytes.HasPrefix(AID, aid) {
+		return applet.FileNotFound(), nil
+	}
+
+	if !oath.initialized {
+		log.Printf("OATH applet not initialized")
+		return applet.FileNotFound(), nil
+	}
+
+	oath.Deselect()
+
+	res := bertlv.Encode(TAG_VERSION, VERSION)
+	res = append(res, bertlv.Encode(TAG_SELECT_SUCCESS, oath.state.Salt)...)
+
+	if len(oath.state.Code) != 0 {
+		if oath.challenge, err = random(CHALLENGE_SIZE); err != nil {
+			return
+		}
+
+		res = append(res, bertlv.Encode(TAG_CHALLENGE, oath.challenge)...)
+		res = append(res, bertlv.Encode(TAG_ALGORITHM, []byte{oath.state.CodeAlgorithm})...)
+	}
+
+	return applet.CommandCompleted(res), nil
+}
+
+// Command parses an APDU command and redirects it to the relevant handler. An
+// APDU response is returned.
+func (oath *Applet) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error) {
+	if oath.Debug {
+		log.Printf("OATH << %+v", capdu)
+	}
+
+	if capdu.CLA != 0x00 {
+		return applet.ClassNotSupported(), nil
+	}
+
+	// SELECT and CALCULATE ALL share the same instruction
+	selection := capdu.INS == SELECT && capdu.P1 == applet.SELECT_DF_NAME
+
+	if !oath.initialized && !selection {
+		return applet.ConditionsNotSatisfied(), nil
+	}
+
+	switch {
+	case selection, capdu.INS == VALIDATE, capdu.INS == RESET, capdu.INS == SEND_REMAINING:
+	case !oath.authenticated():
+		return AuthenticationRequired(), nil
+	}
+
+	switch capdu.INS {
+	case SELECT:
+		if selection {
+			rapdu, err = oath.Select(capdu.P1, capdu.Data)
+		} else {
+			rapdu, err = oath.CalculateAll(capdu.P2, capdu.Data)
+		}
+	case PUT:
+		rapdu, err = oath.Put(capdu.Data)
+	case DELETE:
+		rapdu, err = oath.Delete(capdu.Data)
+	case SET_CODE:
+		rapdu, err = oath.SetCode(capdu.Data)
+	case RESET:
+		rapdu, err = oath.Reset(capdu.P1, capdu.P2)
+	case LIST:
+		rapdu, err = oath.List()
+	case CALCULATE:
+		rapdu, err = oath.Calculate(capdu.P2, capdu.Data)
+	case VALIDATE:
+		rapdu, err = oath.Validate(capdu.Data)
+	case SEND_REMAINING:
+		rapdu = oath.chaining.GetResponse(capdu.P1, capdu.P2, int(capdu.GetLe()))
+	default:
+		log.Printf("OATH unsupported INS %x", capdu.INS)
+		rapdu = applet.InstructionNotSupported()
+	}
+
+	if rapdu == nil {
+		rapdu = applet.ConditionsNotSatisfied()
+	}
+
+	if capdu.INS != SEND_REMAINING {
+		rapdu = oath.chaining.Response(capdu, rapdu)
+	}
+
+	if oath.Debug {
+		log.Printf("OATH >> %+v", rapdu)
+	}
+
+	return
+}
+
+// Status returns the OATH applet credentials status in textual format.
+func (oath *Applet) Status() string {
+	var status bytes.Buffer
+
+	fmt.Fprintf(&status, "---------------------------------------------------------- OATH applet ----\n")
+	fmt.Fprintf(&status, "Initialized ............: %v\n", oath.initialized)
+
+	if !oath.initialized {
+		return status.String()
+	}
+
+	fmt.Fprintf(&status, "Access code ............: %v\n", len(oath.state.Code) != 0)
+
+	if oath.time.IsZero() {
+		fmt.Fprintf(&status, "Host time ..............: unknown\n")
+	} else {
+		fmt.Fprintf(&status, "Host time ..............: %s\n", oath.time.Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(&status, "Credentials ............: %d\n", len(oath.state.Credentials))
+
+	for _, c := range oath.state.Credentials {
+		desc := fmt.Sprintf("%s %s", typeNames[c.Type], algorithmNames[c.Algorithm])
+
+		if c.Touch {
+			desc += ", touch"
+		}
+
+		fmt.Fprintf(&status, "  %s (%s)\n", c.Name, desc)
+	}
+
+	return status.String()
+}
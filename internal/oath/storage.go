@@ -0,0 +1,129 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package oath
+
+import (
+	"crypto/rand"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/storage"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// Persistent storage entry names.
+const (
+	STORE_STATE = "oath-credentials"
+)
+
+// state represents the OATH credentials and access code.
+type state struct {
+	// device identifier and host access code key derivation salt
+	Salt []byte
+
+	CodeAlgorithm byte
+	Code          []byte
+
+	Credentials []*credential
+}
+
+func random(size int) (buf []byte, err error) {
+	buf = make([]byte, size)
+	_, err = rand.Read(buf)
+	return
+}
+
+func newState() (s *state, err error) {
+	s = &state{}
+	s.Salt, err = random(SALT_SIZE)
+	return
+}
+
+// load reads a persistent storage entry, decrypting it when SNVS is enabled.
+// A missing entry (or storage) is not an error and leaves the value
+// unchanged.
+func (oath *Applet) load(name string, v any) (err error) {
+	return storage.Load(oath.Storage, name, DiversifierOATH, oath.SNVS, v)
+}
+
+// save writes a persistent storage entry, encrypting it when SNVS is enabled.
+// Without persistent storage the OATH state is volatile and only retained in
+// memory.
+func (oath *Applet) save(name string, v any) (err error) {
+	if oath.Storage == nil {
+		return
+	}
+
+	return storage.Save(oath.Storage, name, DiversifierOATH, oath.SNVS, v)
+}
+
+func (oath *Applet) loadState() (err error) {
+	s := &state{}
+
+	if err = oath.load(STORE_STATE, s); err != nil {
+		return
+	}
+
+	if len(s.Salt) == 0 {
+		if s, err = newState(); err != nil {
+			return
+		}
+
+		if err = oath.save(STORE_STATE, s); err != nil {
+			return
+		}
+	}
+
+	oath.state = s
+
+	return
+}
+
+// setCredentials updates the credentials, which are kept on persistent
+// storage, encrypted when SNVS is enabled. A nil response is returned on
+// success.
+func (oath *Applet) setCredentials(credentials []*credential) *apdu.RAPDU {
+	s := *oath.state
+	s.Credentials = credentials
+
+	if err := oath.save(STORE_STATE, &s); err != nil {
+		log.Printf("OATH credentials error, %v", err)
+		return applet.MemoryFailure()
+	}
+
+	oath.state = &s
+
+	return nil
+}
+
+// Reset implements the YKOATH RESET command, which deletes all credentials
+// and the access code and changes the device salt.
+func (oath *Applet) Reset(P1 byte, P2 byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != RESET_P1 || P2 != RESET_P2 {
+		return applet.IncorrectParameters(), nil
+	}
+
+	s, err := newState()
+
+	if err != nil {
+		return
+	}
+
+	if err = oath.save(STORE_STATE, s); err != nil {
+		log.Printf("OATH RESET error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	oath.state = s
+	oath.Deselect()
+
+	log.Printf("OATH applet reset")
+
+	return applet.CommandCompleted(nil), nil
+}
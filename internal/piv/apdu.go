@@ -0,0 +1,19 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+func VerifyFail(retries byte) *apdu.RAPDU {
+	return &apdu.RAPDU{
+		SW1: 0x63,
+		SW2: 0xc0 | retries&0x0f,
+	}
+}
@@ -0,0 +1,276 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+	"github.com/usbarmory/GoKey/internal/icc"
+
+	"filippo.io/bigmod"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// NIST SP 800-73-4 Part 2, 3.2.4 GENERAL AUTHENTICATE Card Command
+	TAG_DYNAMIC_AUTHENTICATION_TEMPLATE = 0x7c
+	TAG_WITNESS                         = 0x80
+	TAG_CHALLENGE                       = 0x81
+	TAG_RESPONSE                        = 0x82
+	TAG_EXPONENTIATION                  = 0x85
+)
+
+// GeneralAuthenticate implements
+// NIST SP 800-73-4 Part 2, 3.2.4 GENERAL AUTHENTICATE Card Command.
+//
+// The card management key (9B) supports both mutual and external
+// authentication, key slots support signature (or RSA decryption) of a
+// challenge and ECDH key agreement (exponentiation).
+func (piv *Applet) GeneralAuthenticate(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	template, err := bertlv.Find(data, TAG_DYNAMIC_AUTHENTICATION_TEMPLATE)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	if P2 == KEY_CARD_MANAGEMENT {
+		return piv.authenticateManagementKey(P1, template)
+	}
+
+	if !validSlot(P2) {
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	k, rapdu := piv.slotKey(P2)
+
+	if rapdu != nil {
+		return
+	}
+
+	if P1 != k.Algorithm {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if _, err = bertlv.Find(template, TAG_RESPONSE); err != nil {
+		return applet.WrongData(), nil
+	}
+
+	challenge, errChallenge := bertlv.Find(template, TAG_CHALLENGE)
+	point, errPoint := bertlv.Find(template, TAG_EXPONENTIATION)
+
+	if errChallenge != nil && errPoint != nil {
+		return applet.WrongData(), nil
+	}
+
+	if k.PINPolicy != PIN_POLICY_NEVER && !piv.pinVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	// PIN only valid for one operation
+	if k.PINPolicy == PIN_POLICY_ALWAYS {
+		defer func() { piv.pinVerified = false }()
+	}
+
+	if !piv.userPresence(k) {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	var res []byte
+
+	icc.LED("white", true)
+	defer icc.LED("white", false)
+
+	if errPoint == nil {
+		res, err = agree(k.privateKey, point)
+	} else {
+		res, err = sign(k.privateKey, challenge)
+	}
+
+	if err != nil {
+		log.Printf("PIV GENERAL AUTHENTICATE error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	log.Printf("PIV GENERAL AUTHENTICATE successful (slot %X)", P2)
+
+	response := bertlv.NewConstructed(TAG_DYNAMIC_AUTHENTICATION_TEMPLATE,
+		bertlv.New(TAG_RESPONSE, res),
+	)
+
+	return applet.CommandCompleted(response.Bytes()), nil
+}
+
+// userPresence verifies the user presence, through the Presence channel, when
+// required by the key touch policy. Keys backed by OpenPGP subkeys follow
+// their User Interaction Flag.
+func (piv *Applet) userPresence(k *slotKey) (present bool) {
+	if k.openpgpKey != 0 {
+		return piv.Card.UserPresence(k.openpgpKey)
+	}
+
+	if k.TouchPolicy == TOUCH_POLICY_NEVER {
+		return true
+	}
+
+	if piv.Presence == nil {
+		log.Printf("PIV user presence required, but not available")
+		return false
+	}
+
+	log.Printf("PIV user presence request, type `p` within %ds to confirm", icc.PRESENCE_TIMEOUT)
+
+	select {
+	case <-piv.Presence:
+		present = true
+		log.Printf("PIV user presence confirmed")
+	case <-time.After(icc.PRESENCE_TIMEOUT * time.Second):
+		log.Printf("PIV user presence request timed out")
+	}
+
+	return
+}
+
+// sign performs the private key operation on a challenge, for RSA keys the
+// challenge is expected to be padded by the host while for ECDSA keys it is
+// the hash to be signed.
+func sign(priv any, challenge []byte) (sig []byte, err error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if len(challenge) != k.Size() {
+			return nil, errors.New("invalid challenge length")
+		}
+
+		if digestInfo, ok := unpadPKCS1(challenge); ok {
+			return rsa.SignPKCS1v15(nil, k, crypto.Hash(0), digestInfo)
+		}
+
+		return decryptRSA(k, challenge)
+	case *ecdsa.PrivateKey:
+		if len(challenge) > (k.Curve.Params().BitSize+7)/8 {
+			return nil, errors.New("invalid challenge length")
+		}
+
+		return ecdsa.SignASN1(rand.Reader, k, challenge)
+	}
+
+	return nil, errors.New("invalid key")
+}
+
+// agree performs ECDH key agreement, the shared secret (x coordinate) is
+// returned.
+func agree(priv any, point []byte) (secret []byte, err error) {
+	k, ok := priv.(*ecdsa.PrivateKey)
+
+	if !ok {
+		return nil, errors.New("invalid key")
+	}
+
+	privateKey, err := k.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	publicKey, err := privateKey.Curve().NewPublicKey(point)
+
+	if err != nil {
+		return
+	}
+
+	return privateKey.ECDH(publicKey)
+}
+
+// unpadPKCS1 returns the DigestInfo of a PKCS#1 v1.5 signature block
+// (EMSA-PKCS1-v1_5).
+func unpadPKCS1(em []byte) (t []byte, ok bool) {
+	if len(em) < 11 || em[0] != 0x00 || em[1] != 0x01 {
+		return
+	}
+
+	i := 2
+
+	for i < len(em) && em[i] == 0xff {
+		i++
+	}
+
+	// at least 8 bytes of padding are required
+	if i < 10 || i == len(em) || em[i] != 0x00 {
+		return
+	}
+
+	return em[i+1:], true
+}
+
+// decryptRSA performs the raw RSA private key operation, in constant time, for
+// inputs padded by the host (e.g. RSA decryption or PSS signatures).
+func decryptRSA(k *rsa.PrivateKey, input []byte) (output []byte, err error) {
+	if len(k.Primes) != 2 {
+		return nil, errors.New("unsupported RSA key")
+	}
+
+	if k.Precomputed.Dp == nil {
+		k.Precompute()
+	}
+
+	N, err := bigmod.NewModulus(k.N.Bytes())
+
+	if err != nil {
+		return
+	}
+
+	P, err := bigmod.NewModulus(k.Primes[0].Bytes())
+
+	if err != nil {
+		return
+	}
+
+	Q, err := bigmod.NewModulus(k.Primes[1].Bytes())
+
+	if err != nil {
+		return
+	}
+
+	qInv, err := bigmod.NewNat().SetBytes(k.Precomputed.Qinv.Bytes(), P)
+
+	if err != nil {
+		return
+	}
+
+	c, err := bigmod.NewNat().SetBytes(input, N)
+
+	if err != nil {
+		return nil, errors.New("input out of range")
+	}
+
+	t := bigmod.NewNat()
+
+	// m1 = c^dP mod p, m2 = c^dQ mod q
+	m := bigmod.NewNat().Exp(t.Mod(c, P), k.Precomputed.Dp.Bytes(), P)
+	m2 := bigmod.NewNat().Exp(t.Mod(c, Q), k.Precomputed.Dq.Bytes(), Q)
+
+	// m = m2 + q * (qInv * (m1 - m2) mod p)
+	m.Sub(t.Mod(m2, P), P)
+	m.Mul(qInv, P)
+	m.ExpandFor(N).Mul(t.Mod(Q.Nat(), N), N)
+	m.Add(m2.ExpandFor(N), N)
+
+	// verify the result against faults
+	if t.ExpShortVarTime(m, uint(k.E), N).Equal(c) != 1 {
+		return nil, errors.New("RSA verification failed")
+	}
+
+	return m.Bytes(N), nil
+}
@@ -0,0 +1,271 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"maps"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// NIST SP 800-73-4 Part 1, Table 3 Object Identifiers of the PIV Data
+	// Objects for Interoperable Use
+	OBJECT_CARD_CAPABILITY_CONTAINER = 0x5fc107
+	OBJECT_CHUID                     = 0x5fc102
+	OBJECT_CERT_AUTHENTICATION       = 0x5fc105
+	OBJECT_FINGERPRINTS              = 0x5fc103
+	OBJECT_CERT_SIGNATURE            = 0x5fc10a
+	OBJECT_CERT_KEY_MANAGEMENT       = 0x5fc10b
+	OBJECT_CERT_CARD_AUTHENTICATION  = 0x5fc101
+	OBJECT_FACIAL_IMAGE              = 0x5fc108
+	OBJECT_PRINTED_INFORMATION       = 0x5fc109
+	OBJECT_IRIS_IMAGES               = 0x5fc121
+	OBJECT_DISCOVERY                 = 0x7e
+	OBJECT_BIOMETRIC_GROUP_TEMPLATE  = 0x7f61
+
+	// NIST SP 800-73-4 Part 1, Table 3, container range for PUT DATA
+	OBJECT_FIRST = 0x5fc101
+	OBJECT_LAST  = 0x5fc123
+	// Yubico vendor specific objects (e.g. admin data, PIN protected
+	// management key)
+	OBJECT_YUBICO_MASK = 0xffff00
+	OBJECT_YUBICO      = 0x5fff00
+
+	// NIST SP 800-73-4 Part 2, 3.1.2 GET DATA Card Command
+	GET_DATA_PARAMS = 0x3fff
+	TAG_OBJECT_ID   = 0x5c
+	TAG_DATA        = 0x53
+
+	// NIST SP 800-73-4 Part 1, Table 18 Discovery Object
+	TAG_PIN_USAGE_POLICY = 0x5f2f
+
+	// NIST SP 800-73-4 Part 1, Table 9 Card Holder Unique Identifier
+	TAG_FASC_N          = 0x30
+	TAG_GUID            = 0x34
+	TAG_EXPIRATION_DATE = 0x35
+	TAG_SIGNATURE       = 0x3e
+	TAG_ERROR_DETECTION = 0xfe
+
+	// NIST SP 800-73-4 Part 1, Table 8 Card Capability Container
+	TAG_CARD_IDENTIFIER        = 0xf0
+	TAG_CONTAINER_VERSION      = 0xf1
+	TAG_GRAMMAR_VERSION        = 0xf2
+	TAG_APPLICATIONS_CARD_URL  = 0xf3
+	TAG_PKCS15                 = 0xf4
+	TAG_REGISTERED_DATA_MODEL  = 0xf5
+	TAG_ACCESS_CONTROL_TABLE   = 0xf6
+	TAG_CARD_APDUS             = 0xf7
+	TAG_REDIRECTION            = 0xfa
+	TAG_CAPABILITY_TUPLES      = 0xfb
+	TAG_STATUS_TUPLES          = 0xfc
+	TAG_NEXT_CCC               = 0xfd
+	TAG_CCC_ERROR_DETECTION    = 0xfe
+	CCC_VERSION                = 0x21
+	CCC_DATA_MODEL             = 0x10
+	CHUID_EXPIRATION_DATE      = "20301231"
+	DISCOVERY_PIN_USAGE_POLICY = 0x4000
+)
+
+var (
+	// FASC-N for non-federal issuers (agency code 9999), as used by
+	// common PIV management tools.
+	FASC_N = []byte{
+		0xd4, 0xe7, 0x39, 0xda, 0x73, 0x9c, 0xed, 0x39, 0xce, 0x73,
+		0x9d, 0x83, 0x68, 0x58, 0x21, 0x08, 0x42, 0x10, 0x84, 0x21,
+		0xc8, 0x42, 0x10, 0xc3, 0xeb,
+	}
+
+	// GSC-IS registered application provider identifier
+	GSC_RID = []byte{0xa0, 0x00, 0x00, 0x01, 0x16}
+)
+
+// pinObjects lists the data objects whose read access requires PIN
+// verification.
+var pinObjects = map[uint32]bool{
+	OBJECT_FINGERPRINTS:        true,
+	OBJECT_FACIAL_IMAGE:        true,
+	OBJECT_PRINTED_INFORMATION: true,
+	OBJECT_IRIS_IMAGES:         true,
+}
+
+func objectID(data []byte) (id uint32, ok bool) {
+	tag, err := bertlv.Find(data, TAG_OBJECT_ID)
+
+	if err != nil || len(tag) == 0 || len(tag) > 3 {
+		return
+	}
+
+	for _, b := range tag {
+		id = id<<8 | uint32(b)
+	}
+
+	return id, true
+}
+
+func writableObject(id uint32) bool {
+	return (id >= OBJECT_FIRST && id <= OBJECT_LAST) || id&OBJECT_YUBICO_MASK == OBJECT_YUBICO
+}
+
+// uniqueID returns a card unique identifier, derived from its serial number,
+// for CHUID and CCC default values.
+func (piv *Applet) uniqueID(size int) []byte {
+	h := sha256.Sum256(append([]byte(LABEL), piv.Serial[:]...))
+	return h[:size]
+}
+
+// defaultObject returns the default value, if any, of a data object not set
+// with PUT DATA.
+func (piv *Applet) defaultObject(id uint32) []byte {
+	var tlv [][]byte
+
+	// CHUID and CCC tags are encoded directly as, despite their
+	// constructed bit, their values are primitive.
+	switch id {
+	case OBJECT_CHUID:
+		tlv = [][]byte{
+			bertlv.Encode(TAG_FASC_N, FASC_N),
+			bertlv.Encode(TAG_GUID, piv.uniqueID(16)),
+			bertlv.Encode(TAG_EXPIRATION_DATE, []byte(CHUID_EXPIRATION_DATE)),
+			bertlv.Encode(TAG_SIGNATURE, nil),
+			bertlv.Encode(TAG_ERROR_DETECTION, nil),
+		}
+	case OBJECT_CARD_CAPABILITY_CONTAINER:
+		// card identifier: GSC-RID, manufacturer ID, card type
+		// (Java Card) and card ID
+		cardID := append([]byte{}, GSC_RID...)
+		cardID = append(cardID, 0xff, 0x02)
+		cardID = append(cardID, piv.uniqueID(14)...)
+
+		tlv = [][]byte{
+			bertlv.Encode(TAG_CARD_IDENTIFIER, cardID),
+			bertlv.Encode(TAG_CONTAINER_VERSION, []byte{CCC_VERSION}),
+			bertlv.Encode(TAG_GRAMMAR_VERSION, []byte{CCC_VERSION}),
+			bertlv.Encode(TAG_APPLICATIONS_CARD_URL, nil),
+			bertlv.Encode(TAG_PKCS15, []byte{0x00}),
+			bertlv.Encode(TAG_REGISTERED_DATA_MODEL, []byte{CCC_DATA_MODEL}),
+			bertlv.Encode(TAG_ACCESS_CONTROL_TABLE, nil),
+			bertlv.Encode(TAG_CARD_APDUS, nil),
+			bertlv.Encode(TAG_REDIRECTION, nil),
+			bertlv.Encode(TAG_CAPABILITY_TUPLES, nil),
+			bertlv.Encode(TAG_STATUS_TUPLES, nil),
+			bertlv.Encode(TAG_NEXT_CCC, nil),
+			bertlv.Encode(TAG_CCC_ERROR_DETECTION, nil),
+		}
+	default:
+		return nil
+	}
+
+	return bytes.Join(tlv, nil)
+}
+
+func (piv *Applet) loadObjects() (err error) {
+	objects := make(map[uint32][]byte)
+
+	if err = piv.load(STORE_OBJECTS, &objects); err != nil {
+		return
+	}
+
+	piv.objects = objects
+
+	return
+}
+
+// GetData implements
+// NIST SP 800-73-4 Part 2, 3.1.2 GET DATA Card Command.
+func (piv *Applet) GetData(params uint16, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if params != GET_DATA_PARAMS {
+		return applet.IncorrectParameters(), nil
+	}
+
+	id, ok := objectID(data)
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	if id == OBJECT_DISCOVERY {
+		discovery := bertlv.NewConstructed(OBJECT_DISCOVERY,
+			bertlv.New(TAG_APPLICATION_IDENTIFIER, AID),
+			bertlv.New(TAG_PIN_USAGE_POLICY, []byte{DISCOVERY_PIN_USAGE_POLICY >> 8, DISCOVERY_PIN_USAGE_POLICY & 0xff}),
+		)
+
+		return applet.CommandCompleted(discovery.Bytes()), nil
+	}
+
+	if pinObjects[id] && !piv.pinVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	obj, ok := piv.objects[id]
+
+	if !ok {
+		obj = piv.defaultObject(id)
+	}
+
+	if obj == nil {
+		return applet.FileNotFound(), nil
+	}
+
+	return applet.CommandCompleted(bertlv.Encode(TAG_DATA, obj)), nil
+}
+
+// PutData implements
+// NIST SP 800-73-4 Part 2, 3.3.1 PUT DATA Card Command.
+//
+// Data objects are kept on persistent storage, encrypted when SNVS is
+// enabled, an empty value deletes the object.
+func (piv *Applet) PutData(params uint16, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if !piv.managementVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if params != GET_DATA_PARAMS {
+		return applet.IncorrectParameters(), nil
+	}
+
+	id, ok := objectID(data)
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	if !writableObject(id) {
+		log.Printf("PIV PUT DATA unsupported object %X", id)
+		return applet.FileNotFound(), nil
+	}
+
+	obj, err := bertlv.Find(data, TAG_DATA)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	objects := maps.Clone(piv.objects)
+
+	if len(obj) == 0 {
+		delete(objects, id)
+	} else {
+		objects[id] = obj
+	}
+
+	if err = piv.save(STORE_OBJECTS, objects); err != nil {
+		log.Printf("PIV PUT DATA error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	piv.objects = objects
+
+	return applet.CommandCompleted(nil), nil
+}
@@ -0,0 +1,564 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"math/big"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+	"github.com/usbarmory/GoKey/internal/icc"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgpecdh "github.com/ProtonMail/go-crypto/openpgp/ecdh"
+	pgpecdsa "github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// NIST SP 800-78-4, Table 6-1 Key References
+	SLOT_AUTHENTICATION      = 0x9a
+	KEY_CARD_MANAGEMENT      = 0x9b
+	SLOT_SIGNATURE           = 0x9c
+	SLOT_KEY_MANAGEMENT      = 0x9d
+	SLOT_CARD_AUTHENTICATION = 0x9e
+
+	// NIST SP 800-78-4, Table 6-2 Algorithm Identifiers
+	ALG_3DES    = 0x03
+	ALG_RSA2048 = 0x07
+	ALG_AES128  = 0x08
+	ALG_AES192  = 0x0a
+	ALG_AES256  = 0x0c
+	ALG_ECCP256 = 0x11
+	ALG_ECCP384 = 0x14
+
+	// Yubico algorithm identifiers
+	ALG_RSA3072 = 0x05
+	ALG_RSA4096 = 0x16
+
+	// Yubico PIN and touch policies
+	PIN_POLICY_DEFAULT   = 0x00
+	PIN_POLICY_NEVER     = 0x01
+	PIN_POLICY_ONCE      = 0x02
+	PIN_POLICY_ALWAYS    = 0x03
+	TOUCH_POLICY_DEFAULT = 0x00
+	TOUCH_POLICY_NEVER   = 0x01
+	TOUCH_POLICY_ALWAYS  = 0x02
+	TOUCH_POLICY_CACHED  = 0x03
+
+	// NIST SP 800-73-4 Part 2, 3.3.2 GENERATE ASYMMETRIC KEY PAIR Card
+	// Command
+	TAG_GENERATION_TEMPLATE = 0xac
+	TAG_PUBLIC_KEY          = 0x7f49
+	TAG_MODULUS             = 0x81
+	TAG_EXPONENT            = 0x82
+	TAG_POINT               = 0x86
+
+	// Yubico key policies and IMPORT KEY data objects
+	TAG_PIN_POLICY     = 0xaa
+	TAG_TOUCH_POLICY   = 0xab
+	TAG_PRIME_P        = 0x01
+	TAG_PRIME_Q        = 0x02
+	TAG_EXPONENT_P     = 0x03
+	TAG_EXPONENT_Q     = 0x04
+	TAG_PRIVATE_SCALAR = 0x06
+
+	// key origin
+	ORIGIN_GENERATED = "generated"
+	ORIGIN_IMPORTED  = "imported"
+	ORIGIN_OPENPGP   = "OpenPGP"
+)
+
+var algorithmNames = map[byte]string{
+	ALG_3DES:    "3DES",
+	ALG_AES128:  "AES-128",
+	ALG_AES192:  "AES-192",
+	ALG_AES256:  "AES-256",
+	ALG_RSA2048: "RSA 2048",
+	ALG_RSA3072: "RSA 3072",
+	ALG_RSA4096: "RSA 4096",
+	ALG_ECCP256: "ECC P-256",
+	ALG_ECCP384: "ECC P-384",
+	0x00:        "unsupported algorithm",
+}
+
+// OpenPGP subkeys backing PIV slots
+var openpgpKeys = map[byte]byte{
+	SLOT_AUTHENTICATION: icc.KEY_AUT,
+	SLOT_SIGNATURE:      icc.KEY_SIG,
+	SLOT_KEY_MANAGEMENT: icc.KEY_DEC,
+}
+
+var slotNames = map[byte]string{
+	SLOT_AUTHENTICATION:      "authentication",
+	SLOT_SIGNATURE:           "signature",
+	SLOT_KEY_MANAGEMENT:      "decryption",
+	SLOT_CARD_AUTHENTICATION: "card authentication",
+}
+
+// slotKey represents a PIV key, generated or imported on card, or backed by
+// an OpenPGP subkey.
+type slotKey struct {
+	Algorithm byte
+	// PKCS#8 private key
+	Key         []byte
+	PINPolicy   byte
+	TouchPolicy byte
+	Origin      string
+
+	privateKey any
+	// OpenPGP key backing the slot, if any
+	openpgpKey byte
+}
+
+func validSlot(slot byte) bool {
+	_, ok := slotNames[slot]
+	return ok
+}
+
+// defaultPINPolicy returns the PIN policy of a slot according to
+// NIST SP 800-73-4 Part 1, 3.2 Authentication Mechanisms.
+func defaultPINPolicy(slot byte) byte {
+	switch slot {
+	case SLOT_SIGNATURE:
+		return PIN_POLICY_ALWAYS
+	case SLOT_CARD_AUTHENTICATION:
+		return PIN_POLICY_NEVER
+	}
+
+	return PIN_POLICY_ONCE
+}
+
+// algorithm returns the PIV algorithm identifier of a private key, 0x00 when
+// not supported.
+func algorithm(priv any) byte {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return ALG_RSA2048
+		case 3072:
+			return ALG_RSA3072
+		case 4096:
+			return ALG_RSA4096
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return ALG_ECCP256
+		case elliptic.P384():
+			return ALG_ECCP384
+		}
+	}
+
+	return 0x00
+}
+
+func curve(alg byte) elliptic.Curve {
+	switch alg {
+	case ALG_ECCP256:
+		return elliptic.P256()
+	case ALG_ECCP384:
+		return elliptic.P384()
+	}
+
+	return nil
+}
+
+func generateKey(alg byte) (priv any, err error) {
+	switch alg {
+	case ALG_RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ALG_RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case ALG_RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ALG_ECCP256, ALG_ECCP384:
+		return ecdsa.GenerateKey(curve(alg), rand.Reader)
+	}
+
+	return nil, errors.New("unsupported algorithm")
+}
+
+// openpgpPrivateKey returns the native representation of an unlocked OpenPGP
+// subkey, only RSA and NIST curves are supported.
+func openpgpPrivateKey(subkey *openpgp.Subkey) any {
+	var name string
+	var d []byte
+
+	switch k := subkey.PrivateKey.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return k
+	case *pgpecdsa.PrivateKey:
+		name = k.GetCurve().GetCurveName()
+		d = k.D.Bytes()
+	case *pgpecdh.PrivateKey:
+		name = k.GetCurve().GetCurveName()
+		d = k.D
+	default:
+		return nil
+	}
+
+	var c elliptic.Curve
+
+	switch name {
+	case "P-256":
+		c = elliptic.P256()
+	case "P-384":
+		c = elliptic.P384()
+	default:
+		return nil
+	}
+
+	size := (c.Params().BitSize + 7) / 8
+
+	if len(d) > size {
+		return nil
+	}
+
+	priv, err := ecdsa.ParseRawPrivateKey(c, new(big.Int).SetBytes(d).FillBytes(make([]byte, size)))
+
+	if err != nil {
+		return nil
+	}
+
+	return priv
+}
+
+// subkey returns the OpenPGP subkey backing a slot, if any.
+func (piv *Applet) subkey(slot byte) (subkey *openpgp.Subkey) {
+	if piv.Card == nil || !piv.Card.Initialized() {
+		return
+	}
+
+	switch openpgpKeys[slot] {
+	case icc.KEY_SIG:
+		subkey = piv.Card.Sig
+	case icc.KEY_DEC:
+		subkey = piv.Card.Dec
+	case icc.KEY_AUT:
+		subkey = piv.Card.Aut
+	}
+
+	if subkey == nil || subkey.PrivateKey == nil {
+		return nil
+	}
+
+	return
+}
+
+// slotKey returns the key of a slot, PIV keys take precedence over OpenPGP
+// subkeys which must be unlocked.
+func (piv *Applet) slotKey(slot byte) (*slotKey, *apdu.RAPDU) {
+	if k, ok := piv.keys[slot]; ok {
+		return k, nil
+	}
+
+	subkey := piv.subkey(slot)
+
+	if subkey == nil {
+		return nil, applet.ReferencedDataNotFound()
+	}
+
+	if subkey.PrivateKey.Encrypted {
+		log.Printf("PIV slot %X requires OpenPGP %s subkey unlock", slot, slotNames[slot])
+		return nil, applet.SecurityConditionNotSatisfied()
+	}
+
+	priv := openpgpPrivateKey(subkey)
+	alg := algorithm(priv)
+
+	if alg == 0x00 {
+		log.Printf("PIV slot %X OpenPGP %s subkey algorithm not supported", slot, slotNames[slot])
+		return nil, applet.ReferencedDataNotFound()
+	}
+
+	return &slotKey{
+		Algorithm:   alg,
+		PINPolicy:   defaultPINPolicy(slot),
+		TouchPolicy: TOUCH_POLICY_NEVER,
+		Origin:      ORIGIN_OPENPGP,
+		privateKey:  priv,
+		openpgpKey:  openpgpKeys[slot],
+	}, nil
+}
+
+func (piv *Applet) loadKeys() (err error) {
+	keys := make(map[byte]*slotKey)
+
+	if err = piv.load(STORE_KEYS, &keys); err != nil {
+		return
+	}
+
+	for slot, k := range keys {
+		if k.privateKey, err = x509.ParsePKCS8PrivateKey(k.Key); err != nil {
+			return fmt.Errorf("invalid key %X, %v", slot, err)
+		}
+
+		if !validSlot(slot) || algorithm(k.privateKey) != k.Algorithm {
+			return fmt.Errorf("invalid key %X", slot)
+		}
+	}
+
+	piv.keys = keys
+
+	return
+}
+
+// storeKey sets the key of a slot, keys are kept on persistent storage,
+// encrypted when SNVS is enabled.
+func (piv *Applet) storeKey(slot byte, priv any, pinPolicy byte, touchPolicy byte, origin string) (err error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+
+	if err != nil {
+		return
+	}
+
+	keys := maps.Clone(piv.keys)
+
+	keys[slot] = &slotKey{
+		Algorithm:   algorithm(priv),
+		Key:         der,
+		PINPolicy:   pinPolicy,
+		TouchPolicy: touchPolicy,
+		Origin:      origin,
+		privateKey:  priv,
+	}
+
+	if err = piv.save(STORE_KEYS, keys); err != nil {
+		return
+	}
+
+	piv.keys = keys
+
+	log.Printf("PIV key %X %s (%s)", slot, origin, algorithmNames[algorithm(priv)])
+
+	return
+}
+
+// policies returns the PIN and touch policies requested for a key, defaults
+// are applied when missing.
+func policies(slot byte, data []byte) (pinPolicy byte, touchPolicy byte, err error) {
+	pinPolicy = defaultPINPolicy(slot)
+	touchPolicy = TOUCH_POLICY_NEVER
+
+	if v, e := bertlv.Find(data, TAG_PIN_POLICY); e == nil {
+		if len(v) != 1 || v[0] > PIN_POLICY_ALWAYS {
+			return 0, 0, errors.New("invalid PIN policy")
+		}
+
+		if v[0] != PIN_POLICY_DEFAULT {
+			pinPolicy = v[0]
+		}
+	}
+
+	if v, e := bertlv.Find(data, TAG_TOUCH_POLICY); e == nil {
+		if len(v) != 1 || v[0] > TOUCH_POLICY_CACHED {
+			return 0, 0, errors.New("invalid touch policy")
+		}
+
+		if v[0] != TOUCH_POLICY_DEFAULT {
+			touchPolicy = v[0]
+		}
+	}
+
+	return
+}
+
+// publicKeyTemplate returns the public key data object of a private key.
+func publicKeyTemplate(priv any) (template *bertlv.TLV, err error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		template = bertlv.NewConstructed(TAG_PUBLIC_KEY,
+			bertlv.New(TAG_MODULUS, k.N.Bytes()),
+			bertlv.New(TAG_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+		)
+	case *ecdsa.PrivateKey:
+		point, err := k.PublicKey.Bytes()
+
+		if err != nil {
+			return nil, err
+		}
+
+		template = bertlv.NewConstructed(TAG_PUBLIC_KEY,
+			bertlv.New(TAG_POINT, point),
+		)
+	default:
+		err = errors.New("unsupported key")
+	}
+
+	return
+}
+
+// GenerateAsymmetricKeyPair implements
+// NIST SP 800-73-4 Part 2, 3.3.2 GENERATE ASYMMETRIC KEY PAIR Card Command.
+func (piv *Applet) GenerateAsymmetricKeyPair(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if !piv.managementVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if P1 != 0x00 || !validSlot(P2) {
+		return applet.IncorrectParameters(), nil
+	}
+
+	template, err := bertlv.Find(data, TAG_GENERATION_TEMPLATE)
+
+	if err != nil {
+		return applet.WrongData(), nil
+	}
+
+	alg, err := bertlv.Find(template, TAG_ALGORITHM)
+
+	if err != nil || len(alg) != 1 {
+		return applet.WrongData(), nil
+	}
+
+	pinPolicy, touchPolicy, err := policies(P2, template)
+
+	if err != nil {
+		log.Printf("PIV GENERATE ASYMMETRIC KEY PAIR error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	priv, err := generateKey(alg[0])
+
+	if err != nil {
+		log.Printf("PIV GENERATE ASYMMETRIC KEY PAIR error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	pub, err := publicKeyTemplate(priv)
+
+	if err != nil {
+		return
+	}
+
+	if err = piv.storeKey(P2, priv, pinPolicy, touchPolicy, ORIGIN_GENERATED); err != nil {
+		log.Printf("PIV GENERATE ASYMMETRIC KEY PAIR error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	return applet.CommandCompleted(pub.Bytes()), nil
+}
+
+// ImportKey implements the Yubico PIV IMPORT KEY command.
+func (piv *Applet) ImportKey(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	var priv any
+
+	if !piv.managementVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if !validSlot(P2) {
+		return applet.IncorrectParameters(), nil
+	}
+
+	pinPolicy, touchPolicy, err := policies(P2, data)
+
+	if err != nil {
+		log.Printf("PIV IMPORT KEY error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	switch P1 {
+	case ALG_RSA2048, ALG_RSA3072, ALG_RSA4096:
+		priv, err = importRSA(data)
+	case ALG_ECCP256, ALG_ECCP384:
+		var d []byte
+
+		if d, err = bertlv.Find(data, TAG_PRIVATE_SCALAR); err == nil {
+			priv, err = ecdsa.ParseRawPrivateKey(curve(P1), d)
+		}
+	default:
+		return applet.IncorrectParameters(), nil
+	}
+
+	if err == nil && algorithm(priv) != P1 {
+		err = errors.New("key size mismatch")
+	}
+
+	if err != nil {
+		log.Printf("PIV IMPORT KEY error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	if err = piv.storeKey(P2, priv, pinPolicy, touchPolicy, ORIGIN_IMPORTED); err != nil {
+		log.Printf("PIV IMPORT KEY error, %v", err)
+		return applet.MemoryFailure(), nil
+	}
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// importRSA returns an RSA private key from its primes and CRT exponents, as
+// the IMPORT KEY template does not carry the public exponent it is recovered
+// from the CRT exponents.
+func importRSA(data []byte) (priv *rsa.PrivateKey, err error) {
+	var v [4]*big.Int
+
+	for i, tag := range []bertlv.Tag{TAG_PRIME_P, TAG_PRIME_Q, TAG_EXPONENT_P, TAG_EXPONENT_Q} {
+		buf, err := bertlv.Find(data, tag)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v[i] = new(big.Int).SetBytes(buf)
+	}
+
+	p, q, dp, dq := v[0], v[1], v[2], v[3]
+	one := big.NewInt(1)
+
+	p1 := new(big.Int).Sub(p, one)
+	q1 := new(big.Int).Sub(q, one)
+
+	// e * dP = 1 mod (p - 1) and e * dQ = 1 mod (q - 1)
+	e := new(big.Int).ModInverse(dp, p1)
+
+	if e == nil || !e.IsInt64() || e.Int64() > math.MaxInt32 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+
+	if new(big.Int).Mod(new(big.Int).Mul(e, dq), q1).Cmp(one) != 0 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+
+	phi := new(big.Int).Mul(p1, q1)
+	d := new(big.Int).ModInverse(e, phi)
+
+	if d == nil {
+		return nil, errors.New("invalid RSA primes")
+	}
+
+	priv = &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: new(big.Int).Mul(p, q),
+			E: int(e.Int64()),
+		},
+		D:      d,
+		Primes: []*big.Int{p, q},
+	}
+
+	if err = priv.Validate(); err != nil {
+		return nil, err
+	}
+
+	priv.Precompute()
+
+	return
+}
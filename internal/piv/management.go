@@ -0,0 +1,209 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// Yubico SET MANAGEMENT KEY touch policy
+	MANAGEMENT_TOUCH_NEVER  = 0xff
+	MANAGEMENT_TOUCH_ALWAYS = 0xfe
+)
+
+// managementCipher returns the block cipher for a card management key.
+func managementCipher(alg byte, key []byte) (cipher.Block, error) {
+	var size int
+
+	switch alg {
+	case ALG_3DES:
+		return des.NewTripleDESCipher(key)
+	case ALG_AES128:
+		size = 16
+	case ALG_AES192:
+		size = 24
+	case ALG_AES256:
+		size = 32
+	default:
+		return nil, errors.New("unsupported management key algorithm")
+	}
+
+	if len(key) != size {
+		return nil, errors.New("invalid management key length")
+	}
+
+	return aes.NewCipher(key)
+}
+
+// authenticateManagementKey implements card management key authentication
+// through GENERAL AUTHENTICATE, either mutual (witness followed by challenge)
+// or external (challenge followed by response).
+func (piv *Applet) authenticateManagementKey(alg byte, template []byte) (rapdu *apdu.RAPDU, err error) {
+	c := piv.credentials
+
+	if alg != c.ManagementAlgorithm {
+		return applet.IncorrectParameters(), nil
+	}
+
+	block, err := managementCipher(c.ManagementAlgorithm, c.ManagementKey)
+
+	if err != nil {
+		return
+	}
+
+	size := block.BlockSize()
+
+	witness, errWitness := bertlv.Find(template, TAG_WITNESS)
+	challenge, errChallenge := bertlv.Find(template, TAG_CHALLENGE)
+	response, errResponse := bertlv.Find(template, TAG_RESPONSE)
+
+	var res *bertlv.TLV
+
+	switch {
+	case errWitness == nil && len(witness) == 0:
+		// mutual authentication, witness request
+		piv.managementVerified = false
+		piv.witness = make([]byte, size)
+
+		if _, err = rand.Read(piv.witness); err != nil {
+			return
+		}
+
+		buf := make([]byte, size)
+		block.Encrypt(buf, piv.witness)
+
+		res = bertlv.New(TAG_WITNESS, buf)
+	case errWitness == nil && errChallenge == nil:
+		// mutual authentication, decrypted witness and host challenge
+		expected := piv.witness
+		piv.witness = nil
+
+		if len(expected) == 0 || len(witness) != size || subtle.ConstantTimeCompare(witness, expected) != 1 {
+			log.Printf("PIV management key authentication failed")
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		if len(challenge) != size {
+			return applet.WrongData(), nil
+		}
+
+		if !piv.managementPresence() {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		buf := make([]byte, size)
+		block.Encrypt(buf, challenge)
+
+		res = bertlv.New(TAG_RESPONSE, buf)
+	case errChallenge == nil && len(challenge) == 0:
+		// external authentication, challenge request
+		piv.managementVerified = false
+		piv.challenge = make([]byte, size)
+
+		if _, err = rand.Read(piv.challenge); err != nil {
+			return
+		}
+
+		res = bertlv.New(TAG_CHALLENGE, piv.challenge)
+	case errResponse == nil:
+		// external authentication, encrypted challenge
+		expected := make([]byte, size)
+
+		if len(piv.challenge) == 0 {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		block.Encrypt(expected, piv.challenge)
+		piv.challenge = nil
+
+		if subtle.ConstantTimeCompare(response, expected) != 1 {
+			log.Printf("PIV management key authentication failed")
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+
+		if !piv.managementPresence() {
+			return applet.SecurityConditionNotSatisfied(), nil
+		}
+	default:
+		return applet.WrongData(), nil
+	}
+
+	if res == nil {
+		piv.managementVerified = true
+		log.Printf("PIV management key authenticated")
+
+		return applet.CommandCompleted(nil), nil
+	}
+
+	if res.Tag == TAG_RESPONSE {
+		piv.managementVerified = true
+		log.Printf("PIV management key authenticated")
+	}
+
+	template = bertlv.NewConstructed(TAG_DYNAMIC_AUTHENTICATION_TEMPLATE, res).Bytes()
+
+	return applet.CommandCompleted(template), nil
+}
+
+// managementPresence verifies the user presence when required for card
+// management key authentication.
+func (piv *Applet) managementPresence() bool {
+	if !piv.credentials.ManagementTouch {
+		return true
+	}
+
+	return piv.userPresence(&slotKey{TouchPolicy: TOUCH_POLICY_ALWAYS})
+}
+
+// SetManagementKey implements the Yubico PIV SET MANAGEMENT KEY command.
+func (piv *Applet) SetManagementKey(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if !piv.managementVerified {
+		return applet.SecurityConditionNotSatisfied(), nil
+	}
+
+	if P1 != 0xff || (P2 != MANAGEMENT_TOUCH_NEVER && P2 != MANAGEMENT_TOUCH_ALWAYS) {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(data) < 3 || data[1] != KEY_CARD_MANAGEMENT || int(data[2]) != len(data)-3 {
+		return applet.WrongData(), nil
+	}
+
+	alg := data[0]
+	key := data[3:]
+
+	if _, err = managementCipher(alg, key); err != nil {
+		log.Printf("PIV SET MANAGEMENT KEY error, %v", err)
+		return applet.WrongData(), nil
+	}
+
+	c := *piv.credentials
+	c.ManagementAlgorithm = alg
+	c.ManagementKey = key
+	c.ManagementTouch = P2 == MANAGEMENT_TOUCH_ALWAYS
+
+	if err = piv.setCredentials(&c); err != nil {
+		return applet.MemoryFailure(), nil
+	}
+
+	log.Printf("PIV management key changed (%s)", algorithmNames[alg])
+
+	return applet.CommandCompleted(nil), nil
+}
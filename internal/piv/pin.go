@@ -0,0 +1,311 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+const (
+	// NIST SP 800-78-4, Table 6-1 Key References
+	KEY_PIN = 0x80
+	KEY_PUK = 0x81
+
+	// NIST SP 800-73-4 Part 2, 3.2.1 VERIFY Card Command
+	VERIFY_RESET = 0xff
+
+	DEFAULT_PIN     = "123456"
+	DEFAULT_PUK     = "12345678"
+	DEFAULT_RETRIES = 3
+
+	// NIST SP 800-73-4 Part 2, 2.4.3 Authentication of an Individual
+	PIN_MIN_LENGTH = 6
+	PIN_MAX_LENGTH = 8
+	PIN_PADDING    = 0xff
+)
+
+// DEFAULT_MANAGEMENT_KEY is the well known card management key (3DES) set on
+// initialization.
+var DEFAULT_MANAGEMENT_KEY = []byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+}
+
+var keyNames = map[byte]string{
+	KEY_PIN: "PIN",
+	KEY_PUK: "PUK",
+}
+
+// credentials represents the PIN, PUK and card management key.
+type credentials struct {
+	PIN        *applet.PINVerifier
+	PUK        *applet.PINVerifier
+	PINRetries uint8
+	PUKRetries uint8
+
+	ManagementAlgorithm byte
+	ManagementKey       []byte
+	// touch required for management key authentication
+	ManagementTouch bool
+}
+
+// pad returns a PIN in its padded (0xff) reference data format, PIN verifiers
+// are computed on this format to avoid ambiguities on trailing bytes.
+func pad(pin []byte) []byte {
+	buf := bytes.Repeat([]byte{PIN_PADDING}, PIN_MAX_LENGTH)
+	copy(buf, pin)
+
+	return buf
+}
+
+// unpad returns a PIN from its padded (0xff) reference data format.
+func unpad(buf []byte) (pin []byte, ok bool) {
+	if len(buf) != PIN_MAX_LENGTH {
+		return
+	}
+
+	pin = bytes.TrimRight(buf, string([]byte{PIN_PADDING}))
+
+	return pin, len(pin) >= PIN_MIN_LENGTH && bytes.IndexByte(pin, PIN_PADDING) < 0
+}
+
+func defaultCredentials() (c *credentials, err error) {
+	c = &credentials{
+		PINRetries:          DEFAULT_RETRIES,
+		PUKRetries:          DEFAULT_RETRIES,
+		ManagementAlgorithm: ALG_3DES,
+		ManagementKey:       DEFAULT_MANAGEMENT_KEY,
+	}
+
+	if c.PIN, err = applet.NewPINVerifier(pad([]byte(DEFAULT_PIN))); err != nil {
+		return
+	}
+
+	c.PUK, err = applet.NewPINVerifier(pad([]byte(DEFAULT_PUK)))
+
+	return
+}
+
+func (piv *Applet) loadCredentials() (err error) {
+	c := &credentials{}
+
+	if err = piv.load(STORE_CREDENTIALS, c); err != nil {
+		return
+	}
+
+	if c.PIN == nil || c.PUK == nil {
+		if c, err = defaultCredentials(); err != nil {
+			return
+		}
+	}
+
+	if _, err = managementCipher(c.ManagementAlgorithm, c.ManagementKey); err != nil {
+		return
+	}
+
+	piv.credentials = c
+
+	return
+}
+
+// setCredentials updates the credentials, which are kept on persistent
+// storage, encrypted when SNVS is enabled.
+func (piv *Applet) setCredentials(c *credentials) (err error) {
+	if err = piv.save(STORE_CREDENTIALS, c); err != nil {
+		log.Printf("PIV credentials error, %v", err)
+		return
+	}
+
+	piv.credentials = c
+
+	return
+}
+
+// check verifies a PIN or PUK, a nil response is returned on success.
+func (piv *Applet) check(ref byte, pin []byte) *apdu.RAPDU {
+	c := *piv.credentials
+
+	v, retries := c.PIN, &c.PINRetries
+
+	if ref == KEY_PUK {
+		v, retries = c.PUK, &c.PUKRetries
+	}
+
+	if *retries == 0 {
+		log.Printf("PIV %s blocked", keyNames[ref])
+		return applet.AuthenticationMethodBlocked()
+	}
+
+	// The counter is decreased, and saved, ahead of the verification
+	// attempt so that a power interruption cannot skip it.
+	*retries -= 1
+
+	if err := piv.setCredentials(&c); err != nil {
+		return applet.MemoryFailure()
+	}
+
+	if !v.Verify(pad(pin)) {
+		log.Printf("PIV %s error", keyNames[ref])
+		return VerifyFail(*retries)
+	}
+
+	r := *piv.credentials
+
+	if ref == KEY_PUK {
+		r.PUKRetries = DEFAULT_RETRIES
+	} else {
+		r.PINRetries = DEFAULT_RETRIES
+	}
+
+	if err := piv.setCredentials(&r); err != nil {
+		return applet.MemoryFailure()
+	}
+
+	return nil
+}
+
+// Verify implements
+// NIST SP 800-73-4 Part 2, 3.2.1 VERIFY Card Command.
+func (piv *Applet) Verify(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, _ error) {
+	if P2 != KEY_PIN {
+		return applet.ReferencedDataNotFound(), nil
+	}
+
+	switch P1 {
+	case 0x00:
+	case VERIFY_RESET:
+		if len(data) != 0 {
+			return applet.WrongLength(), nil
+		}
+
+		piv.pinVerified = false
+
+		return applet.CommandCompleted(nil), nil
+	default:
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(data) == 0 {
+		// return verification status when PIN empty
+		switch retries := piv.credentials.PINRetries; {
+		case piv.pinVerified:
+			return applet.CommandCompleted(nil), nil
+		case retries == 0:
+			return applet.AuthenticationMethodBlocked(), nil
+		default:
+			return VerifyFail(retries), nil
+		}
+	}
+
+	if len(data) != PIN_MAX_LENGTH {
+		return applet.WrongData(), nil
+	}
+
+	piv.pinVerified = false
+
+	if rapdu = piv.check(KEY_PIN, data); rapdu != nil {
+		return
+	}
+
+	piv.pinVerified = true
+	log.Printf("PIV VERIFY: PIN verified")
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// ChangeReferenceData implements
+// NIST SP 800-73-4 Part 2, 3.2.2 CHANGE REFERENCE DATA Card Command.
+func (piv *Applet) ChangeReferenceData(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != 0x00 || (P2 != KEY_PIN && P2 != KEY_PUK) {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(data) != PIN_MAX_LENGTH*2 {
+		return applet.WrongData(), nil
+	}
+
+	current := data[:PIN_MAX_LENGTH]
+	pin, ok := unpad(data[PIN_MAX_LENGTH:])
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	if rapdu = piv.check(P2, current); rapdu != nil {
+		return
+	}
+
+	v, err := applet.NewPINVerifier(pad(pin))
+
+	if err != nil {
+		return
+	}
+
+	c := *piv.credentials
+
+	if P2 == KEY_PUK {
+		c.PUK = v
+	} else {
+		c.PIN = v
+	}
+
+	if err = piv.setCredentials(&c); err != nil {
+		return applet.MemoryFailure(), nil
+	}
+
+	log.Printf("PIV %s changed", keyNames[P2])
+
+	return applet.CommandCompleted(nil), nil
+}
+
+// ResetRetryCounter implements
+// NIST SP 800-73-4 Part 2, 3.2.3 RESET RETRY COUNTER Card Command.
+func (piv *Applet) ResetRetryCounter(P1 byte, P2 byte, data []byte) (rapdu *apdu.RAPDU, err error) {
+	if P1 != 0x00 || P2 != KEY_PIN {
+		return applet.IncorrectParameters(), nil
+	}
+
+	if len(data) != PIN_MAX_LENGTH*2 {
+		return applet.WrongData(), nil
+	}
+
+	puk := data[:PIN_MAX_LENGTH]
+	pin, ok := unpad(data[PIN_MAX_LENGTH:])
+
+	if !ok {
+		return applet.WrongData(), nil
+	}
+
+	if rapdu = piv.check(KEY_PUK, puk); rapdu != nil {
+		return
+	}
+
+	v, err := applet.NewPINVerifier(pad(pin))
+
+	if err != nil {
+		return
+	}
+
+	c := *piv.credentials
+	c.PIN = v
+	c.PINRetries = DEFAULT_RETRIES
+
+	if err = piv.setCredentials(&c); err != nil {
+		return applet.MemoryFailure(), nil
+	}
+
+	log.Printf("PIV PIN reset")
+
+	return applet.CommandCompleted(nil), nil
+}
@@ -0,0 +1,307 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package piv implements a Personal Identity Verification (PIV) card
+// application according to NIST SP 800-73-4, along with the Yubico extensions
+// used by common management tools (e.g. ykman and yubico-piv-tool).
+package piv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/bertlv"
+	"github.com/usbarmory/GoKey/internal/icc"
+	"github.com/usbarmory/GoKey/internal/storage"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// Diversifier for hardware key derivation (PIV keys and credentials
+// wrapping).
+const DiversifierPIV = "GoKeySNVSPIV    "
+
+const (
+	// NIST SP 800-73-4 Part 2, 3 PIV Card Application Card Commands
+	SELECT                       = 0xa4
+	GET_DATA                     = 0xcb
+	VERIFY                       = 0x20
+	CHANGE_REFERENCE_DATA        = 0x24
+	RESET_RETRY_COUNTER          = 0x2c
+	GENERAL_AUTHENTICATE         = 0x87
+	PUT_DATA                     = 0xdb
+	GENERATE_ASYMMETRIC_KEY_PAIR = 0x47
+	GET_RESPONSE                 = 0xc0
+
+	// Yubico PIV extensions
+	SET_MANAGEMENT_KEY = 0xff
+	IMPORT_KEY         = 0xfe
+	GET_VERSION        = 0xfd
+	RESET              = 0xfb
+	GET_SERIAL         = 0xf8
+
+	// NIST SP 800-73-4 Part 2, 3.1.1 SELECT Card Command
+	TAG_APPLICATION_PROPERTY_TEMPLATE = 0x61
+	TAG_APPLICATION_IDENTIFIER        = 0x4f
+	TAG_APPLICATION_LABEL             = 0x50
+	TAG_ALLOCATION_AUTHORITY          = 0x79
+	TAG_CRYPTOGRAPHIC_ALGORITHMS      = 0xac
+	TAG_ALGORITHM                     = 0x80
+	TAG_OBJECT_IDENTIFIER             = 0x06
+)
+
+var (
+	// NIST SP 800-73-4 Part 1, 2.2 PIV Card Application AID
+	AID = []byte{0xa0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00, 0x01, 0x00}
+	// NIST registered application provider identifier
+	RID = AID[0:5]
+
+	// Yubico PIV version returned by GET VERSION, as it determines the
+	// features expected by management tools the version predating
+	// metadata and attestation extensions is reported.
+	VERSION = []byte{0x05, 0x02, 0x07}
+
+	// application label returned on SELECT
+	LABEL = "GoKey PIV"
+)
+
+// Applet implements a PIV card application instance.
+//
+// The PIV authentication (9A), digital signature (9C) and key management (9D)
+// slots are backed by the authentication, signature and decryption subkeys of
+// the OpenPGP card, unless a PIV key is generated or imported in them. The
+// card authentication (9E) slot only holds PIV keys.
+type Applet struct {
+	// Unique serial number
+	Serial [4]byte
+	// enable APDU debugging
+	Debug bool
+	// enable device unique hardware encryption for persistent storage
+	SNVS bool
+	// Presence is a channel used to signal user presence, required by
+	// keys with touch policy enabled.
+	Presence chan bool
+	// persistent storage for keys, credentials and data objects
+	// (optional)
+	Storage storage.Storage
+	// OpenPGP card backing the 9A, 9C and 9D slots with its subkeys
+	// (optional)
+	Card *icc.Interface
+
+	// PIN, PUK and management key
+	credentials *credentials
+	// keys generated or imported on card
+	keys map[byte]*slotKey
+	// data objects set with PUT DATA
+	objects map[uint32][]byte
+
+	// management key authentication witness or challenge
+	witness   []byte
+	challenge []byte
+
+	// command chaining and GET RESPONSE state
+	chaining applet.Chaining
+
+	// internal state flags
+	initialized        bool
+	pinVerified        bool
+	managementVerified bool
+}
+
+// Init initializes the PIV applet instance, restoring its state from
+// persistent storage when available.
+func (piv *Applet) Init() (err error) {
+	if piv.initialized {
+		return errors.New("PIV applet already initialized")
+	}
+
+	if err = piv.loadCredentials(); err != nil {
+		return fmt.Errorf("PIV credentials loading failed, %v", err)
+	}
+
+	if err = piv.loadKeys(); err != nil {
+		return fmt.Errorf("PIV key loading failed, %v", err)
+	}
+
+	if err = piv.loadObjects(); err != nil {
+		return fmt.Errorf("PIV data object loading failed, %v", err)
+	}
+
+	piv.initialized = true
+
+	log.Printf("PIV applet initialized")
+
+	return
+}
+
+// Initialized returns the PIV applet initialization state.
+func (piv *Applet) Initialized() bool {
+	return piv.initialized
+}
+
+// AID returns the PIV application identifier.
+func (piv *Applet) AID() []byte {
+	return AID
+}
+
+// Deselect resets the security status of the PIN and management key (see
+// applet.Dispatcher).
+func (piv *Applet) Deselect() {
+	piv.pinVerified = false
+	piv.managementVerified = false
+	piv.witness = nil
+	piv.challenge = nil
+	piv.chaining.Reset()
+}
+
+// Select implements
+// NIST SP 800-73-4 Part 2, 3.1.1 SELECT Card Command.
+func (piv *Applet) Select(P1 byte, aid []byte) (rapdu *apdu.RAPDU, _ error) {
+	if P1 != applet.SELECT_DF_NAME || len(aid) < len(RID) || !bytes.HasPrefix(AID, aid) {
+		return applet.FileNotFound(), nil
+	}
+
+	if !piv.initialized {
+		log.Printf("PIV applet not initialized")
+		return applet.FileNotFound(), nil
+	}
+
+	var algorithms []*bertlv.TLV
+
+	for _, alg := range []byte{ALG_RSA2048, ALG_RSA3072, ALG_RSA4096, ALG_ECCP256, ALG_ECCP384, ALG_3DES, ALG_AES128, ALG_AES192, ALG_AES256} {
+		algorithms = append(algorithms, bertlv.New(TAG_ALGORITHM, []byte{alg}))
+	}
+
+	algorithms = append(algorithms, bertlv.New(TAG_OBJECT_IDENTIFIER, nil))
+
+	apt := bertlv.NewConstructed(TAG_APPLICATION_PROPERTY_TEMPLATE,
+		bertlv.New(TAG_APPLICATION_IDENTIFIER, AID[len(RID):]),
+		bertlv.New(TAG_APPLICATION_LABEL, []byte(LABEL)),
+		bertlv.NewConstructed(TAG_ALLOCATION_AUTHORITY,
+			bertlv.New(TAG_APPLICATION_IDENTIFIER, RID),
+		),
+		bertlv.NewConstructed(TAG_CRYPTOGRAPHIC_ALGORITHMS, algorithms...),
+	)
+
+	return applet.CommandCompleted(apt.Bytes()), nil
+}
+
+// Command parses an APDU command and redirects it to the relevant handler. An
+// APDU response is returned.
+func (piv *Applet) Command(capdu *apdu.CAPDU) (rapdu *apdu.RAPDU, err error) {
+	if piv.Debug {
+		log.Printf("PIV << %+v", capdu)
+	}
+
+	if capdu.CLA&^applet.CLA_CHAINING != 0x00 {
+		return applet.ClassNotSupported(), nil
+	}
+
+	if capdu, rapdu = piv.chaining.Command(capdu); capdu == nil {
+		return
+	}
+
+	if !piv.initialized && capdu.INS != SELECT {
+		return applet.ConditionsNotSatisfied(), nil
+	}
+
+	params := binary.BigEndian.Uint16([]byte{capdu.P1, capdu.P2})
+
+	switch capdu.INS {
+	case SELECT:
+		rapdu, err = piv.Select(capdu.P1, capdu.Data)
+	case GET_DATA:
+		rapdu, err = piv.GetData(params, capdu.Data)
+	case VERIFY:
+		rapdu, err = piv.Verify(capdu.P1, capdu.P2, capdu.Data)
+	case CHANGE_REFERENCE_DATA:
+		rapdu, err = piv.ChangeReferenceData(capdu.P1, capdu.P2, capdu.Data)
+	case RESET_RETRY_COUNTER:
+		rapdu, err = piv.ResetRetryCounter(capdu.P1, capdu.P2, capdu.Data)
+	case GENERAL_AUTHENTICATE:
+		rapdu, err = piv.GeneralAuthenticate(capdu.P1, capdu.P2, capdu.Data)
+	case PUT_DATA:
+		rapdu, err = piv.PutData(params, capdu.Data)
+	case GENERATE_ASYMMETRIC_KEY_PAIR:
+		rapdu, err = piv.GenerateAsymmetricKeyPair(capdu.P1, capdu.P2, capdu.Data)
+	case GET_RESPONSE:
+		rapdu = piv.chaining.GetResponse(capdu.P1, capdu.P2, int(capdu.GetLe()))
+	case SET_MANAGEMENT_KEY:
+		rapdu, err = piv.SetManagementKey(capdu.P1, capdu.P2, capdu.Data)
+	case IMPORT_KEY:
+		rapdu, err = piv.ImportKey(capdu.P1, capdu.P2, capdu.Data)
+	case GET_VERSION:
+		rapdu = applet.CommandCompleted(VERSION)
+	case GET_SERIAL:
+		rapdu = applet.CommandCompleted(piv.Serial[:])
+	case RESET:
+		rapdu, err = piv.Reset()
+	default:
+		log.Printf("PIV unsupported INS %x", capdu.INS)
+		rapdu = applet.InstructionNotSupported()
+	}
+
+	if rapdu == nil {
+		rapdu = applet.ConditionsNotSatisfied()
+	}
+
+	if capdu.INS != GET_RESPONSE {
+		rapdu = piv.chaining.Response(capdu, rapdu)
+	}
+
+	if piv.Debug {
+		log.Printf("PIV >> %+v", rapdu)
+	}
+
+	return
+}
+
+// Status returns the PIV applet credentials and slots status in textual
+// format.
+func (piv *Applet) Status() string {
+	var status bytes.Buffer
+
+	fmt.Fprintf(&status, "----------------------------------------------------------- PIV applet ----\n")
+	fmt.Fprintf(&status, "Initialized ............: %v\n", piv.initialized)
+
+	if !piv.initialized {
+		return status.String()
+	}
+
+	c := piv.credentials
+
+	fmt.Fprintf(&status, "PIN retries ............: %d\n", c.PINRetries)
+	fmt.Fprintf(&status, "PUK retries ............: %d\n", c.PUKRetries)
+	fmt.Fprintf(&status, "Management key .........: %s\n", algorithmNames[c.ManagementAlgorithm])
+
+	for _, slot := range []byte{SLOT_AUTHENTICATION, SLOT_SIGNATURE, SLOT_KEY_MANAGEMENT, SLOT_CARD_AUTHENTICATION} {
+		fmt.Fprintf(&status, "Slot %X .................: ", slot)
+
+		var desc []string
+
+		if k, ok := piv.keys[slot]; ok {
+			desc = append(desc, algorithmNames[k.Algorithm], k.Origin)
+		} else if subkey := piv.subkey(slot); subkey != nil {
+			if subkey.PrivateKey.Encrypted {
+				desc = append(desc, "OpenPGP "+slotNames[slot], "locked")
+			} else {
+				desc = append(desc, algorithmNames[algorithm(openpgpPrivateKey(subkey))], "OpenPGP "+slotNames[slot])
+			}
+		} else {
+			desc = append(desc, "missing")
+		}
+
+		status.WriteString(strings.Join(desc, ", ") + "\n")
+	}
+
+	return status.String()
+}
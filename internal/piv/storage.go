@@ -0,0 +1,81 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package piv
+
+import (
+	"log"
+
+	"github.com/usbarmory/GoKey/internal/applet"
+	"github.com/usbarmory/GoKey/internal/storage"
+
+	"github.com/hsanjuan/go-nfctype4/apdu"
+)
+
+// Persistent storage entry names.
+const (
+	STORE_CREDENTIALS = "piv-credentials"
+	STORE_KEYS        = "piv-keys"
+	STORE_OBJECTS     = "piv-objects"
+)
+
+// load reads a persistent storage entry, decrypting it when SNVS is enabled.
+// A missing entry (or storage) is not an error and leaves the value
+// unchanged.
+func (piv *Applet) load(name string, v any) (err error) {
+	return storage.Load(piv.Storage, name, DiversifierPIV, piv.SNVS, v)
+}
+
+// save writes a persistent storage entry, encrypting it when SNVS is enabled.
+// Without persistent storage the PIV state is volatile and only retained in
+// memory.
+func (piv *Applet) save(name string, v any) (err error) {
+	if piv.Storage == nil {
+		return
+	}
+
+	return storage.Save(piv.Storage, name, DiversifierPIV, piv.SNVS, v)
+}
+
+// Reset implements the Yubico PIV RESET command, which restores the default
+// PIN, PUK and management key and deletes all PIV keys and data objects.
+//
+// As on Yubico devices the reset is only allowed once both PIN and PUK are
+// blocked. OpenPGP subkeys backing PIV slots are not affected.
+func (piv *Applet) Reset() (rapdu *apdu.RAPDU, err error) {
+	if piv.credentials.PINRetries != 0 || piv.credentials.PUKRetries != 0 {
+		return applet.ConditionsNotSatisfied(), nil
+	}
+
+	c, err := defaultCredentials()
+
+	if err != nil {
+		return
+	}
+
+	if piv.Storage != nil {
+		for _, name := range []string{STORE_KEYS, STORE_OBJECTS} {
+			if err = piv.Storage.Delete(name); err != nil {
+				log.Printf("PIV RESET error, %v", err)
+				return applet.MemoryFailure(), nil
+			}
+		}
+	}
+
+	piv.keys = make(map[byte]*slotKey)
+	piv.objects = make(map[uint32][]byte)
+
+	if err = piv.setCredentials(c); err != nil {
+		return applet.MemoryFailure(), nil
+	}
+
+	piv.Deselect()
+
+	log.Printf("PIV applet reset")
+
+	return applet.CommandCompleted(nil), nil
+}
@@ -75,6 +75,13 @@ func DeviceKey() (deviceKey *ecdsa.PrivateKey, err error) {
 	return keygen.ECDSA(elliptic.P256(), key)
 }
 
+// Key derives a key, with a diversifier, from the SNVS device-specific OTPMK
+// secret.
+func Key(diversifier []byte) (key []byte, err error) {
+	iv := make([]byte, aes.BlockSize)
+	return imx6ul.DCP.DeriveKey(diversifier, iv, -1)
+}
+
 // Encrypt performs symmetric AES encryption using AES-256-CTR. The
 // initialization vector is prepended to the encrypted file, the HMAC for
 // authentication is appended: `iv (16 bytes) || ciphertext || hmac (32
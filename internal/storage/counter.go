@@ -0,0 +1,54 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago && arm
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/usbarmory/armoryctl/atecc608"
+)
+
+const (
+	counterCmd = 0x24
+	read       = 0
+	increment  = 1
+)
+
+// ATECC implements a Counter backed by one of the two ATECC608A monotonic
+// counters.
+type ATECC struct {
+	// KeyID is the counter identifier (0 or 1), #1 is used by U2F.
+	KeyID byte
+}
+
+func (c *ATECC) counterCmd(mode byte) (uint32, error) {
+	res, err := atecc608.ExecuteCmd(counterCmd, [1]byte{mode}, [2]byte{c.KeyID, 0x00}, nil, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(res) < 4 {
+		return 0, errors.New("invalid counter response")
+	}
+
+	return binary.LittleEndian.Uint32(res), nil
+}
+
+// Read returns the current counter value.
+func (c *ATECC) Read() (uint32, error) {
+	return c.counterCmd(read)
+}
+
+// Increment increases the counter and returns its new value.
+func (c *ATECC) Increment() (uint32, error) {
+	return c.counterCmd(increment)
+}
@@ -0,0 +1,71 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/fs"
+
+	"github.com/usbarmory/GoKey/internal/snvs"
+)
+
+// Load reads a JSON encoded entry, decrypting it with the SNVS derived key
+// for the diversifier when encrypted is true. A missing entry (or storage) is
+// not an error and leaves the value unchanged.
+func Load(s Storage, name string, diversifier string, encrypted bool, v any) (err error) {
+	if s == nil {
+		return
+	}
+
+	buf, err := s.Read(name)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	if encrypted {
+		if buf, err = snvs.Decrypt(buf, []byte(diversifier)); err != nil {
+			return
+		}
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+// Save writes a JSON encoded entry, encrypting it with the SNVS derived key
+// for the diversifier when encrypted is true.
+func Save(s Storage, name string, diversifier string, encrypted bool, v any) (err error) {
+	if s == nil {
+		return errors.New("persistent storage not available")
+	}
+
+	buf, err := json.Marshal(v)
+
+	if err != nil {
+		return
+	}
+
+	if encrypted {
+		iv := make([]byte, aes.BlockSize)
+
+		if _, err = rand.Read(iv); err != nil {
+			return
+		}
+
+		if buf, err = snvs.Encrypt(buf, []byte(diversifier), iv); err != nil {
+			return
+		}
+	}
+
+	return s.Write(name, buf)
+}
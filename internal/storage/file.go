@@ -0,0 +1,128 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File implements a Storage backed by a host directory, one file for each
+// entry, it is meant for use with virtual smartcard (vpcd) operation.
+type File struct {
+	// Path is the storage directory, created if missing.
+	Path string
+}
+
+func (f *File) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid entry name %q", name)
+	}
+
+	return filepath.Join(f.Path, name), nil
+}
+
+// Read returns the value of a named entry.
+func (f *File) Read(name string) ([]byte, error) {
+	path, err := f.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+// Write creates or replaces a named entry.
+func (f *File) Write(name string, buf []byte) (err error) {
+	path, err := f.path(name)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(f.Path, 0700); err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Delete removes a named entry.
+func (f *File) Delete(name string) (err error) {
+	path, err := f.path(name)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Remove(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return
+}
+
+// FileCounter implements a Counter backed by a host file, it is meant for use
+// with virtual smartcard (vpcd) operation.
+type FileCounter struct {
+	// Path is the counter file, created if missing.
+	Path string
+}
+
+// Read returns the current counter value.
+func (c *FileCounter) Read() (uint32, error) {
+	buf, err := os.ReadFile(c.Path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if len(buf) != 4 {
+		return 0, errors.New("invalid counter file")
+	}
+
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// Increment increases the counter and returns its new value.
+func (c *FileCounter) Increment() (cnt uint32, err error) {
+	if cnt, err = c.Read(); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(c.Path), 0700); err != nil {
+		return
+	}
+
+	cnt += 1
+	tmp := c.Path + ".tmp"
+
+	if err = os.WriteFile(tmp, binary.BigEndian.AppendUint32(nil, cnt), 0600); err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, c.Path)
+
+	return
+}
@@ -0,0 +1,308 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago && arm
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+
+	"github.com/usbarmory/tamago/soc/nxp/usdhc"
+)
+
+const (
+	// Blocks is the default size of the storage area, placed at the end
+	// of the eMMC to avoid any overlap with the firmware image.
+	Blocks = 2048
+
+	magic = "GoKS"
+	// header: magic (4 bytes) || sequence (4 bytes) ||
+	//         payload length (4 bytes) || HMAC (32 bytes)
+	headerSize = 12 + sha256.Size
+)
+
+// MMC implements a Storage backed by a raw eMMC area, entries are kept in
+// memory and written on each change.
+//
+// The area is split in two copies, each change is written to the copy not
+// in use with the next sequence number, so that an interrupted write leaves
+// the previous copy intact. At initialization the valid copy with the highest
+// sequence number is used.
+type MMC struct {
+	sync.Mutex
+
+	// Card is the eMMC card instance.
+	Card *usdhc.USDHC
+	// LBA is the starting block of the storage area, when zero the area is
+	// placed at the end of the card.
+	LBA int
+	// Blocks is the size of the storage area in blocks, when zero the
+	// value of the Blocks constant is used.
+	Blocks int
+	// Key is the HMAC-SHA256 key authenticating each copy, when empty
+	// copies are only verified for integrity.
+	Key []byte
+
+	entries map[string][]byte
+	// sequence number and index of the copy in use
+	seq     uint32
+	current int
+}
+
+// Init detects the eMMC card and loads existing entries.
+func (m *MMC) Init() (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Card == nil {
+		return errors.New("missing card")
+	}
+
+	if err = m.Card.Detect(); err != nil {
+		return
+	}
+
+	info := m.Card.Info()
+
+	if m.Blocks == 0 {
+		m.Blocks = Blocks
+	}
+
+	if m.LBA == 0 {
+		m.LBA = info.Blocks - m.Blocks
+	}
+
+	if m.Blocks < 2 || m.LBA <= 0 || m.LBA+m.Blocks > info.Blocks {
+		return fmt.Errorf("invalid storage area (lba:%d blocks:%d)", m.LBA, m.Blocks)
+	}
+
+	m.entries = make(map[string][]byte)
+	m.current = 1
+
+	valid := false
+
+	for i := 0; i < 2; i++ {
+		seq, payload, err := m.read(i)
+
+		if err != nil {
+			return err
+		}
+
+		if payload == nil || (valid && seq <= m.seq) {
+			continue
+		}
+
+		entries := make(map[string][]byte)
+
+		if err = unmarshal(entries, payload); err != nil {
+			continue
+		}
+
+		m.entries = entries
+		m.seq = seq
+		m.current = i
+		valid = true
+	}
+
+	return
+}
+
+// offset returns the starting block of a copy.
+func (m *MMC) offset(i int) int {
+	return m.LBA + i*(m.Blocks/2)
+}
+
+func (m *MMC) mac(seq uint32, payload []byte) []byte {
+	mac := hmac.New(sha256.New, m.Key)
+	binary.Write(mac, binary.BigEndian, seq)
+	binary.Write(mac, binary.BigEndian, uint32(len(payload)))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// read returns the sequence number and payload of a copy, the payload is nil
+// when the copy is empty or invalid.
+func (m *MMC) read(i int) (seq uint32, payload []byte, err error) {
+	blockSize := m.Card.Info().BlockSize
+	buf := make([]byte, blockSize)
+
+	if err = m.Card.ReadBlocks(m.offset(i), buf); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf[0:len(magic)], []byte(magic)) {
+		return
+	}
+
+	seq = binary.BigEndian.Uint32(buf[4:])
+	size := int(binary.BigEndian.Uint32(buf[8:]))
+
+	if headerSize+size > (m.Blocks/2)*blockSize {
+		return
+	}
+
+	buf = make([]byte, roundUp(headerSize+size, blockSize))
+
+	if err = m.Card.ReadBlocks(m.offset(i), buf); err != nil {
+		return
+	}
+
+	if !hmac.Equal(buf[12:headerSize], m.mac(seq, buf[headerSize:headerSize+size])) {
+		return
+	}
+
+	return seq, buf[headerSize : headerSize+size], nil
+}
+
+func roundUp(n int, size int) int {
+	return ((n + size - 1) / size) * size
+}
+
+func unmarshal(entries map[string][]byte, buf []byte) (err error) {
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return errors.New("invalid entry")
+		}
+
+		n := int(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+
+		if len(buf) < n+4 {
+			return errors.New("invalid entry name")
+		}
+
+		name := string(buf[0:n])
+		size := int(binary.BigEndian.Uint32(buf[n:]))
+		buf = buf[n+4:]
+
+		if len(buf) < size {
+			return errors.New("invalid entry value")
+		}
+
+		entries[name] = bytes.Clone(buf[0:size])
+		buf = buf[size:]
+	}
+
+	return
+}
+
+func (m *MMC) marshal(seq uint32) []byte {
+	var names []string
+	var payload bytes.Buffer
+
+	for name := range m.entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := m.entries[name]
+
+		binary.Write(&payload, binary.BigEndian, uint16(len(name)))
+		payload.WriteString(name)
+		binary.Write(&payload, binary.BigEndian, uint32(len(value)))
+		payload.Write(value)
+	}
+
+	buf := []byte(magic)
+	buf = binary.BigEndian.AppendUint32(buf, seq)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(payload.Len()))
+	buf = append(buf, m.mac(seq, payload.Bytes())...)
+
+	return append(buf, payload.Bytes()...)
+}
+
+// flush writes all entries to the copy not in use, which then replaces it.
+func (m *MMC) flush() (err error) {
+	blockSize := m.Card.Info().BlockSize
+	seq := m.seq + 1
+	next := 1 - m.current
+	buf := m.marshal(seq)
+
+	if len(buf) > (m.Blocks/2)*blockSize {
+		return errors.New("storage area exhausted")
+	}
+
+	buf = append(buf, make([]byte, roundUp(len(buf), blockSize)-len(buf))...)
+
+	if err = m.Card.WriteBlocks(m.offset(next), buf); err != nil {
+		return
+	}
+
+	m.seq = seq
+	m.current = next
+
+	return
+}
+
+// Read returns the value of a named entry.
+func (m *MMC) Read(name string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	value, ok := m.entries[name]
+
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return bytes.Clone(value), nil
+}
+
+// Write creates or replaces a named entry.
+func (m *MMC) Write(name string, buf []byte) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.entries == nil {
+		return errors.New("storage not initialized")
+	}
+
+	prev, exists := m.entries[name]
+	m.entries[name] = bytes.Clone(buf)
+
+	if err = m.flush(); err != nil {
+		if exists {
+			m.entries[name] = prev
+		} else {
+			delete(m.entries, name)
+		}
+	}
+
+	return
+}
+
+// Delete removes a named entry.
+func (m *MMC) Delete(name string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	prev, exists := m.entries[name]
+
+	if !exists {
+		return
+	}
+
+	delete(m.entries, name)
+
+	if err = m.flush(); err != nil {
+		m.entries[name] = prev
+	}
+
+	return
+}
@@ -0,0 +1,37 @@
+// https://github.com/usbarmory/GoKey
+//
+// Copyright (c) The GoKey authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package storage implements persistent storage of application data, such as
+// smartcard data objects, which can be changed at runtime.
+//
+// Data is stored as-is, callers are responsible for its encryption and
+// authentication (e.g. with Load and Save, which use the snvs package).
+package storage
+
+// Diversifier for hardware key derivation (eMMC storage area authentication).
+const DiversifierStorage = "GoKeySNVSStorage"
+
+// Storage represents a persistent key/value store, a missing entry is
+// reported with an error matching fs.ErrNotExist.
+type Storage interface {
+	// Read returns the value of a named entry.
+	Read(name string) ([]byte, error)
+	// Write creates or replaces a named entry.
+	Write(name string, buf []byte) error
+	// Delete removes a named entry.
+	Delete(name string) error
+}
+
+// Counter represents a monotonic counter, meant to detect rollback of
+// persistent storage entries which can be rewritten by an attacker with access
+// to the underlying medium.
+type Counter interface {
+	// Read returns the current counter value.
+	Read() (uint32, error)
+	// Increment increases the counter and returns its new value.
+	Increment() (uint32, error)
+}
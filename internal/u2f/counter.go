@@ -145,6 +145,12 @@ func (c *Counter) Read() (cnt uint32, err error) {
 	return c.counterCmd(read)
 }
 
+// PresenceAvailable returns whether a user presence channel is configured,
+// when not user presence is automatically assumed.
+func (c *Counter) PresenceAvailable() bool {
+	return c.presence != nil
+}
+
 // UserPresence verifies the user presence.
 func (c *Counter) UserPresence() (present bool) {
 	if c.presence == nil {
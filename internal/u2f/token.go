@@ -19,6 +19,7 @@ import (
 	"log"
 	"regexp"
 
+	"github.com/usbarmory/GoKey/internal/fido2"
 	"github.com/usbarmory/GoKey/internal/snvs"
 
 	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
@@ -42,6 +43,9 @@ type Token struct {
 	// Presence is a channel used to signal user presence, when undefined
 	// user presence is implicitly acknowledged.
 	Presence chan bool
+	// FIDO2 authenticator (optional), sharing the U2F HID interface,
+	// master key, counter and user presence.
+	FIDO2 *fido2.Authenticator
 
 	// Keyring instance
 	keyring *keyring.Keyring
@@ -76,6 +80,21 @@ func Configure(device *usb.Device, token *Token) (err error) {
 		return
 	}
 
+	if token.FIDO2 != nil {
+		// CTAPHID_INIT is overridden to advertise CTAP2 support
+		if err = hid.AddMapping(fido2.CTAPHID_INIT, token.FIDO2.HandleInit); err != nil {
+			return
+		}
+
+		if err = hid.AddMapping(fido2.CTAPHID_CBOR, token.FIDO2.HandleCBOR); err != nil {
+			return
+		}
+
+		if err = hid.AddMapping(fido2.CTAPHID_CANCEL, token.FIDO2.HandleCancel); err != nil {
+			return
+		}
+	}
+
 	if err = fidati.ConfigureUSB(device.Configurations[0], device, hid); err != nil {
 		return
 	}
@@ -122,6 +141,19 @@ func (token *Token) Init() (err error) {
 	token.keyring.MasterKey = mk
 	token.keyring.Counter = counter
 	token.counter = counter
+
+	if token.FIDO2 != nil {
+		// the counter carries the user presence channel, which
+		// changes on each initialization
+		token.FIDO2.Counter = counter
+
+		if !token.FIDO2.Initialized() {
+			if err = token.FIDO2.Init(mk); err != nil {
+				return
+			}
+		}
+	}
+
 	token.initialized = true
 
 	log.Printf("U2F token initialized")
@@ -15,6 +15,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -23,10 +24,13 @@ import (
 	"os"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 
 	"github.com/usbarmory/GoKey/internal/age"
 	"github.com/usbarmory/GoKey/internal/icc"
+	"github.com/usbarmory/GoKey/internal/oath"
+	"github.com/usbarmory/GoKey/internal/piv"
 	"github.com/usbarmory/GoKey/internal/snvs"
 	"github.com/usbarmory/GoKey/internal/u2f"
 
@@ -45,17 +49,31 @@ const help = `
   build                         # display build information
 
 
-  init                          # initialize OpenPGP smartcard
-  lock   (all|sig|dec)          # OpenPGP key(s) lock
-  unlock (all|sig|dec)          # OpenPGP key(s) unlock, prompts passphrase
+  init                          # initialize OpenPGP smartcard and PIV/OATH
+                                # applets
+  lock   (all|sig|dec|aut)      # OpenPGP key(s) lock
+  unlock (all|sig|dec|aut)      # OpenPGP key(s) unlock, prompts passphrase
+  admin                         # OpenPGP admin PIN (PW3) set, prompts PIN
+                                # (empty PIN disables PW3)
+  rc                            # OpenPGP resetting code (RC) set, prompts code
+                                # (empty code disables RC)
+  unblock                       # OpenPGP PW1 retry counter reset
+  kdf                           # OpenPGP KDF enable, prompts passphrase
+                                # (empty passphrase disables KDF)
+  attest                        # OpenPGP attestation certificate (PEM)
+  identity [n]                  # OpenPGP identities list or identity select
+  retired (auto|<n>)            # OpenPGP retired decryption subkey selection
+                                # (auto: matched by algorithm and curve)
 
   rpc                           # PKCS#11 RPC socket
                                 # use with 'ssh -L p11kit.sock:127.0.0.1:22'
 
   age-plugin (gen|identity-v1)  # handle age plugin state machine
 
-  u2f                           # initialize U2F token w/  user presence test
-  u2f !test                     # initialize U2F token w/o user presence test
+  u2f                           # initialize U2F/FIDO2 token w/  user presence
+                                # test
+  u2f !test                     # initialize U2F/FIDO2 token w/o user presence
+                                # test
   p                             # confirm user presence
 `
 
@@ -74,6 +92,10 @@ type Console struct {
 
 	// Card is the OpenPGP smartcard instance.
 	Card *icc.Interface
+	// PIV is the PIV applet instance.
+	PIV *piv.Applet
+	// OATH is the OATH applet instance.
+	OATH *oath.Applet
 	// Token is the U2F token instance.
 	Token *u2f.Token
 	// PLugin is the age plugin instance.
@@ -86,19 +108,24 @@ type Console struct {
 	term *terminal.Terminal
 }
 
-var lockCommandPattern = regexp.MustCompile(`(lock|unlock) (all|sig|dec)`)
+var lockCommandPattern = regexp.MustCompile(`(lock|unlock) (all|sig|dec|aut)`)
 var pageCommandPattern = regexp.MustCompile(`age-plugin (.*)`)
+var identityCommandPattern = regexp.MustCompile(`identity ([0-9]+)`)
+var retiredCommandPattern = regexp.MustCompile(`retired (auto|[0-9]+)`)
 
 func (c *Console) lockCommand(op string, arg string) (res string) {
 	var err error
 	var pws []byte
 
-	if arg == "sig" || arg == "all" {
-		pws = append(pws, icc.PW1_CDS)
-	}
-
-	if arg == "dec" || arg == "all" {
-		pws = append(pws, icc.PW1)
+	switch arg {
+	case "all":
+		pws = []byte{icc.PW1_CDS, icc.PW1}
+	case "sig":
+		pws = []byte{icc.PW1_CDS}
+	case "dec":
+		pws = []byte{icc.PW1_DEC}
+	case "aut":
+		pws = []byte{icc.PW1_AUT}
 	}
 
 	if len(pws) == 0 {
@@ -143,6 +170,111 @@ func (c *Console) lockCommand(op string, arg string) (res string) {
 	return
 }
 
+func (c *Console) identityCommand(arg string) (res string) {
+	n, err := strconv.Atoi(arg)
+
+	if err == nil {
+		err = c.Card.SelectIdentity(n)
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return c.Card.Identities()
+}
+
+func (c *Console) retiredCommand(arg string) (res string) {
+	var n int
+	var err error
+
+	if arg != "auto" {
+		n, err = strconv.Atoi(arg)
+	}
+
+	if err == nil {
+		err = c.Card.SelectRetiredKey(n)
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return
+}
+
+func (c *Console) adminCommand() (res string) {
+	pin, err := c.term.ReadPassword("Admin PIN: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	confirm, err := c.term.ReadPassword("Confirm admin PIN: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if pin != confirm {
+		return "admin PIN mismatch"
+	}
+
+	if err = c.Card.SetAdminPIN([]byte(pin)); err != nil {
+		return err.Error()
+	}
+
+	return
+}
+
+func (c *Console) rcCommand() (res string) {
+	code, err := c.term.ReadPassword("Resetting code: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	confirm, err := c.term.ReadPassword("Confirm resetting code: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if code != confirm {
+		return "resetting code mismatch"
+	}
+
+	if err = c.Card.SetResettingCode([]byte(code)); err != nil {
+		return err.Error()
+	}
+
+	return
+}
+
+func (c *Console) kdfCommand() (res string) {
+	passphrase, err := c.term.ReadPassword("Passphrase: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	confirm, err := c.term.ReadPassword("Confirm passphrase: ")
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if passphrase != confirm {
+		return "passphrase mismatch"
+	}
+
+	if err = c.Card.SetKDF([]byte(passphrase)); err != nil {
+		return err.Error()
+	}
+
+	return "admin PIN and resetting code, if any, must be set again"
+}
+
 func (c *Console) handleTerminal(conn ssh.Channel) {
 	log.SetOutput(io.MultiWriter(os.Stdout, c.term))
 	defer log.SetOutput(os.Stdout)
@@ -187,7 +319,35 @@ func (c *Console) handleCommand(conn ssh.Channel, cmd string) (err error) {
 	case "help":
 		res = string(c.term.Escape.Cyan) + help + string(c.term.Escape.Reset)
 	case "init":
-		err = c.Card.Init()
+		if err = c.Card.Init(); err != nil {
+			break
+		}
+
+		if c.PIV != nil && !c.PIV.Initialized() {
+			if err = c.PIV.Init(); err != nil {
+				break
+			}
+		}
+
+		if c.OATH != nil && !c.OATH.Initialized() {
+			err = c.OATH.Init()
+		}
+	case "admin":
+		res = c.adminCommand()
+	case "rc":
+		res = c.rcCommand()
+	case "unblock":
+		err = c.Card.UnblockPW1()
+	case "kdf":
+		res = c.kdfCommand()
+	case "attest":
+		if der := c.Card.AttestationCertificate(); der != nil {
+			res = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		} else {
+			err = errors.New("attestation not available (requires SNVS)")
+		}
+	case "identity":
+		res = c.Card.Identities()
 	case "rpc":
 		return c.Card.ServeRPC(conn)
 	case "u2f":
@@ -197,6 +357,14 @@ func (c *Console) handleCommand(conn ssh.Channel, cmd string) (err error) {
 		c.Token.Presence = nil
 		err = c.Token.Init()
 	case "p":
+		// OpenPGP card presence requests, shared with PIV and OATH,
+		// take precedence
+		select {
+		case c.Card.Presence <- true:
+			return
+		default:
+		}
+
 		if !c.Token.Initialized() {
 			res = "token not initialized, issue 'u2f' first"
 		} else if c.Token.Presence == nil {
@@ -215,7 +383,23 @@ func (c *Console) handleCommand(conn ssh.Channel, cmd string) (err error) {
 	case "reboot":
 		imx6ul.Reset()
 	case "status":
-		res = strings.Join([]string{c.Card.Status(), c.Token.Status()}, "")
+		status := []string{c.Card.Status()}
+
+		if c.PIV != nil {
+			status = append(status, c.PIV.Status())
+		}
+
+		if c.OATH != nil {
+			status = append(status, c.OATH.Status())
+		}
+
+		status = append(status, c.Token.Status())
+
+		if c.Token.FIDO2 != nil {
+			status = append(status, c.Token.FIDO2.Status())
+		}
+
+		res = strings.Join(status, "")
 	case "build":
 		if bi, ok := debug.ReadBuildInfo(); ok {
 			res = bi.String()
@@ -229,6 +413,10 @@ func (c *Console) handleCommand(conn ssh.Channel, cmd string) (err error) {
 			}
 		} else if m := lockCommandPattern.FindStringSubmatch(cmd); len(m) == 3 {
 			res = c.lockCommand(m[1], m[2])
+		} else if m := identityCommandPattern.FindStringSubmatch(cmd); len(m) == 2 {
+			res = c.identityCommand(m[1])
+		} else if m := retiredCommandPattern.FindStringSubmatch(cmd); len(m) == 2 {
+			res = c.retiredCommand(m[1])
 		} else {
 			return errors.New("unknown command, type `help`")
 		}
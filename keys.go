@@ -23,11 +23,14 @@ var (
 
 // OpenPGP
 var (
-	pgpSecretKey []byte
-	URL          string
-	NAME         string
-	LANGUAGE     string
-	SEX          string
+	pgpCard       bool
+	pgpSecretKey  []byte
+	pgpSecretKeys [][]byte
+	URL           string
+	NAME          string
+	LANGUAGE      string
+	SEX           string
+	RAW_PKCS1     bool
 )
 
 // U2F